@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/wailsapp/wails/v2/pkg/options"
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
@@ -13,30 +14,154 @@ import (
 type App struct {
 	ctx     context.Context
 	Manager *DownloadManager
+	// dataDir holds the database and logs
+	dataDir string
+	// lock keeps other instances out of dataDir while the app runs
+	lock *os.File
 }
 
-// NewApp creates a new App application struct
-func NewApp() *App {
-	return &App{}
+// NewApp creates a new App application struct keeping its data in dataDir
+func NewApp(dataDir string) *App {
+	return &App{dataDir: dataDir}
 }
 
 // startup is called when the app starts. The context is saved
 // so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
+
 	var err error
-	a.Manager, err = NewDownloadManager("downloads.db", ctx)
+	a.lock, err = openDataDir(a.dataDir)
+	if err != nil {
+		runtime.LogFatal(ctx, "Failed to open data directory: "+err.Error())
+	}
+	if err := setupLogging(a.dataDir); err != nil {
+		runtime.LogError(ctx, "Failed to open log file: "+err.Error())
+	}
+	if err := migrateLegacyDB(a.dataDir); err != nil {
+		runtime.LogFatal(ctx, "Failed to move database: "+err.Error())
+	}
+
+	a.Manager, err = NewDownloadManager(filepath.Join(a.dataDir, dbFileName), ctx)
 	if err != nil {
 		runtime.LogFatal(ctx, "Failed to initialize DownloadManager: "+err.Error())
 	}
 }
 
+// shutdown is called when the app is closing. Running downloads are stopped
+// without changing their state, so they resume at the next start.
+func (a *App) shutdown(ctx context.Context) {
+	if a.Manager != nil {
+		if err := a.Manager.Close(); err != nil {
+			logger.Error("failed to close download manager", "err", err)
+		}
+	}
+	if a.lock != nil {
+		a.lock.Close()
+	}
+}
+
+// onSecondInstanceLaunch brings the window up when the app is launched again
+// on the same data directory
+func (a *App) onSecondInstanceLaunch(options.SecondInstanceData) {
+	runtime.WindowUnminimise(a.ctx)
+	runtime.WindowShow(a.ctx)
+}
+
+// SetSequential turns sequential mode on or off for a download, so it can be
+// watched while it downloads
+func (a *App) SetSequential(id int64, sequential bool) error {
+	return a.Manager.SetSequential(id, sequential)
+}
+
+// GetStreamURL returns the local URL a player can open a download at while
+// it downloads
+func (a *App) GetStreamURL(id int64) (string, error) {
+	return a.Manager.StreamURL(id)
+}
+
+// GetRecentLogs returns the latest log entries about a download, or about
+// anything when downloadID is 0
+func (a *App) GetRecentLogs(downloadID int64) ([]LogEntry, error) {
+	return RecentLogs(downloadID)
+}
+
+// GetDownloadDiagnostics returns a download's timeline, chunk throughput
+// and a fresh probe of its URL, for attaching to bug reports
+func (a *App) GetDownloadDiagnostics(id int64) (*DownloadDiagnostics, error) {
+	return a.Manager.Diagnostics(id)
+}
+
+// QueryDownloads returns a filtered, sorted page of downloads without their
+// chunks
+func (a *App) QueryDownloads(filter DownloadFilter) (*DownloadPage, error) {
+	return a.Manager.QueryDownloads(filter)
+}
+
 func (a *App) AddDownload(url, path string, chunks, workers int) error {
 	return a.Manager.AddDownload(url, path, chunks, workers)
 }
 
-func (a *App) AllDownloads() []*Download {
-	return a.Manager.AllDownloads()
+// AddAutoDownload adds a download that tunes its own chunk size and worker
+// count
+func (a *App) AddAutoDownload(url, path string) error {
+	return a.Manager.AddAutoDownload(url, path)
+}
+
+// ProbeURL looks up a remote file without downloading it, reporting its
+// size, MIME type, range support and the file name the server suggests
+func (a *App) ProbeURL(url string) (*ProbeResult, error) {
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	return probeURL(a.ctx, url, client)
+}
+
+// ImportMetalink adds the files of a metalink document, read from a URL or a
+// local file, as downloads into dir
+func (a *App) ImportMetalink(source, dir string, chunks, workers int) error {
+	return a.Manager.AddMetalink(source, dir, chunks, workers)
+}
+
+// ImportURLs adds the downloads of a URL list, given as text or a file path,
+// into dir. Plain lists, aria2 input files and CSV with url, path and
+// checksum columns are accepted; the outcome of every entry is returned.
+func (a *App) ImportURLs(source, dir string, chunks, workers int) ([]ImportResult, error) {
+	return a.Manager.ImportURLs(source, dir, chunks, workers)
+}
+
+// ExportHistory writes all downloads to path as "json" or "csv"; an empty
+// format is taken from the extension
+func (a *App) ExportHistory(path, format string) error {
+	return a.Manager.ExportHistory(path, format)
+}
+
+// ImportHistory recreates the unfinished downloads of an exported history,
+// moving target directories as remap, old to new, says
+func (a *App) ImportHistory(path string, remap map[string]string) ([]ImportResult, error) {
+	return a.Manager.ImportHistory(path, remap)
+}
+
+// ProbeMedia lists the variants of a HLS playlist or DASH manifest
+func (a *App) ProbeMedia(url string) ([]MediaVariant, error) {
+	return ProbeMedia(url)
+}
+
+// AddMediaDownload downloads one variant, by its index in ProbeMedia, of a
+// HLS or DASH stream into a single file
+func (a *App) AddMediaDownload(url string, variant int, path string, workers int) error {
+	return a.Manager.AddMediaDownload(url, variant, path, workers)
+}
+
+// AddTorrent downloads a torrent, given as a magnet link, a .torrent URL or a
+// local .torrent file, into dir
+func (a *App) AddTorrent(source, dir string, chunks, workers int) error {
+	return a.Manager.AddTorrent(source, dir, chunks, workers)
+}
+
+func (a *App) AllDownloads(category string) []*Download {
+	return a.Manager.AllDownloads(category)
 }
 
 func (a *App) PauseDownload(id int64) error {
@@ -51,6 +176,121 @@ func (a *App) CancelDownload(id int64) error {
 	return a.Manager.CancelDownload(id)
 }
 
+// PauseDownloads pauses the downloads picked by IDs or a filter at once
+func (a *App) PauseDownloads(sel BulkSelection) (*BulkUpdateEvent, error) {
+	return a.Manager.PauseDownloads(sel)
+}
+
+func (a *App) ResumeDownloads(sel BulkSelection) (*BulkUpdateEvent, error) {
+	return a.Manager.ResumeDownloads(sel)
+}
+
+func (a *App) CancelDownloads(sel BulkSelection) (*BulkUpdateEvent, error) {
+	return a.Manager.CancelDownloads(sel)
+}
+
+func (a *App) GetSSHSettings() SSHSettings {
+	return currentSSHSettings()
+}
+
+func (a *App) SetSSHSettings(settings SSHSettings) error {
+	return a.Manager.SaveSSHSettings(settings)
+}
+
+// GetConflictPolicy returns what happens when a download's file already
+// exists: ask, rename, overwrite, skip or resume
+func (a *App) GetConflictPolicy() (string, error) {
+	policy, err := a.Manager.ConflictPolicy()
+	return string(policy), err
+}
+
+func (a *App) SetConflictPolicy(policy string) error {
+	return a.Manager.SetConflictPolicy(ConflictPolicy(policy))
+}
+
+// ResolveConflict answers a fileConflict event with the policy to apply
+func (a *App) ResolveConflict(id string, policy string) error {
+	return a.Manager.AnswerConflict(id, ConflictPolicy(policy))
+}
+
+// GetMaxHostConnections returns how many connections auto downloads may open
+// to one host
+func (a *App) GetMaxHostConnections() (int, error) {
+	return a.Manager.MaxHostConnections()
+}
+
+func (a *App) SetMaxHostConnections(limit int) error {
+	return a.Manager.SetMaxHostConnections(limit)
+}
+
+// GetLowSpaceThreshold returns the free space in bytes below which active
+// downloads are paused
+func (a *App) GetLowSpaceThreshold() (int64, error) {
+	return a.Manager.LowSpaceThreshold()
+}
+
+func (a *App) SetLowSpaceThreshold(bytes int64) error {
+	return a.Manager.SetLowSpaceThreshold(bytes)
+}
+
+// GetPostProcessing returns the steps run on every download once it completes
+func (a *App) GetPostProcessing() ([]PostStep, error) {
+	return a.Manager.PostProcessing()
+}
+
+func (a *App) SetPostProcessing(steps []PostStep) error {
+	return a.Manager.SetPostProcessing(steps)
+}
+
+// GetCategories returns the categories new downloads are sorted into
+func (a *App) GetCategories() ([]Category, error) {
+	return a.Manager.Categories()
+}
+
+func (a *App) SetCategories(categories []Category) error {
+	return a.Manager.SetCategories(categories)
+}
+
+// GetSchedule returns the time windows scheduled downloads run in
+func (a *App) GetSchedule() (Schedule, error) {
+	return a.Manager.Schedule()
+}
+
+func (a *App) SetSchedule(schedule Schedule) error {
+	return a.Manager.SetSchedule(schedule)
+}
+
+// ScheduleDownload puts a download in or out of the scheduled queue and sets
+// the Unix time it starts at, 0 for none
+func (a *App) ScheduleDownload(id int64, scheduled bool, startAt int64) error {
+	return a.Manager.ScheduleDownload(id, scheduled, startAt)
+}
+
+// GetSpeedLimit returns the limit in bytes per second used while no
+// bandwidth profile is active, 0 for unlimited
+func (a *App) GetSpeedLimit() (int64, error) {
+	return a.Manager.SpeedLimit()
+}
+
+func (a *App) SetSpeedLimit(limit int64) error {
+	return a.Manager.SetSpeedLimit(limit)
+}
+
+// GetBandwidthProfiles returns the speed limits that apply at certain times
+// of day
+func (a *App) GetBandwidthProfiles() ([]BandwidthProfile, error) {
+	return a.Manager.BandwidthProfiles()
+}
+
+func (a *App) SetBandwidthProfiles(profiles []BandwidthProfile) error {
+	return a.Manager.SetBandwidthProfiles(profiles)
+}
+
+// GetActiveBandwidthProfile returns the profile limiting downloads right now
+func (a *App) GetActiveBandwidthProfile() (BandwidthProfileEvent, error) {
+	return a.Manager.ActiveBandwidthProfile()
+}
+
 func (a *App) ShowDirectoryDialog(defaultDir string) (string, error) {
 	return runtime.OpenDirectoryDialog(a.ctx, runtime.OpenDialogOptions{
 		Title:            "Select Download Directory",
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// auto mode tuning. Auto downloads start with AutoInitialWorkers connections
+// and cut their chunks as they go, sized so a chunk takes about
+// AutoChunkDuration on one connection.
+var (
+	AutoInitialWorkers = 2
+	AutoSampleInterval = 3 * time.Second
+	AutoChunkDuration  = 10 * time.Second
+	AutoMinChunk       = int64(1024 * 1024)
+	AutoMaxChunk       = int64(64 * 1024 * 1024)
+)
+
+// autoMinGain is the share by which an added connection must raise the
+// aggregate speed to be kept
+const autoMinGain = 0.1
+
+// autoReprobeSamples is how many samples an auto download holds its worker
+// count before trying another connection again
+const autoReprobeSamples = 10
+
+// defaultHostConnections caps the connections auto downloads open to one host
+const defaultHostConnections = 8
+
+// MaxHostConnections returns how many connections auto downloads may open to
+// one host, counting those of other downloads from it
+func (dm *DownloadManager) MaxHostConnections() (int, error) {
+	value, err := dm.Setting("max_host_connections", strconv.Itoa(defaultHostConnections))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func (dm *DownloadManager) SetMaxHostConnections(limit int) error {
+	if limit < 1 {
+		return errors.New("at least one connection per host is needed")
+	}
+	return dm.SetSetting("max_host_connections", strconv.Itoa(limit))
+}
+
+// AddAutoDownload adds a download that picks its own chunk size and worker
+// count from the throughput it measures. Files of unknown size, which can
+// only be fetched whole, and torrents are added as usual.
+func (dm *DownloadManager) AddAutoDownload(url, path string) error {
+	if strings.HasPrefix(url, "magnet:") {
+		return dm.AddDownload(url, path, 0, 0)
+	}
+
+	if restored, err := dm.restoreExisting(url, path); restored || err != nil {
+		return err
+	}
+
+	d, err := dm.newCategorizedDownload(url, path, 1, AutoInitialWorkers)
+	if err != nil {
+		return err
+	}
+	if restored, err := dm.restoreCategorized(url, path, d); restored || err != nil {
+		return err
+	}
+	if d.TotalSize > 0 && !d.unranged {
+		// chunks are cut while downloading
+		d.Auto = true
+		d.Chunks = nil
+		d.ChunkCount = 0
+		d.WorkersCount = AutoInitialWorkers
+	}
+	return dm.addNewDownload(d)
+}
+
+// AddChunk stores a chunk cut from the rest of an auto download
+func (dm *DownloadManager) AddChunk(d *Download, chunk *ChunkInfo) error {
+	tx, err := dm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO chunks (download_id,chunk_index,start_byte,end_byte,written,state,url,key_url,key_iv,whole) VALUES (?,?,?,?,?,?,?,?,?,?)",
+		d.ID, chunk.Index, chunk.StartByte, chunk.EndByte, chunk.Written, chunk.State, chunk.URL, chunk.KeyURL, chunk.KeyIV, chunk.Whole)
+	if err != nil {
+		return err
+	}
+	if chunk.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE downloads SET chunks=? WHERE id=?", chunk.Index+1, d.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateWorkers stores the worker count an auto download settled on, which
+// the next run starts from
+func (dm *DownloadManager) UpdateWorkers(downloadID int64, workers int) error {
+	_, err := dm.DB.Exec("UPDATE downloads SET workers=? WHERE id=?", workers, downloadID)
+	return err
+}
+
+// ConnectionAllowance returns how many connections d may use within the
+// per-host limit, besides those other running downloads hold to its host
+func (dm *DownloadManager) ConnectionAllowance(d *Download) int {
+	limit, err := dm.MaxHostConnections()
+	if err != nil {
+		d.log().Error("failed to read connection limit", "err", err)
+		limit = defaultHostConnections
+	}
+	host := hostOf(d.URL)
+
+	dm.Mutex.Lock()
+	others := make([]*Download, 0, len(dm.Downloads))
+	for _, other := range dm.Downloads {
+		if other != d {
+			others = append(others, other)
+		}
+	}
+	dm.Mutex.Unlock()
+
+	for _, other := range others {
+		if hostOf(other.URL) == host {
+			limit -= other.connections()
+		}
+	}
+	return max(limit, 1)
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// connections returns how many workers d is running
+func (d *Download) connections() int {
+	d.Mutex.Lock()
+	pool := d.pool
+	d.Mutex.Unlock()
+	if pool == nil {
+		return 0
+	}
+	return int(pool.live.Load())
+}
+
+// carvedEnd is the offset where the part of an auto download not cut into
+// chunks yet starts. The caller holds d.Mutex.
+func (d *Download) carvedEnd() int64 {
+	if len(d.Chunks) == 0 {
+		return 0
+	}
+	return d.Chunks[len(d.Chunks)-1].EndByte + 1
+}
+
+// carveChunk cuts the next chunk of an auto download, of about size bytes,
+// from the part not cut yet. It returns nil once the whole file is cut.
+func (d *Download) carveChunk(size int64) (*ChunkInfo, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	start := d.carvedEnd()
+	if start >= d.TotalSize {
+		return nil, nil
+	}
+	end := min(start+size, d.TotalSize) - 1
+	// a sliver left at the end goes with this chunk
+	if d.TotalSize-end-1 < AutoMinChunk {
+		end = d.TotalSize - 1
+	}
+
+	chunk := &ChunkInfo{StartByte: start, EndByte: end, Index: len(d.Chunks), State: StateActive}
+	if err := d.ChunkWriter.AddChunk(d, chunk); err != nil {
+		return nil, fmt.Errorf("storing new chunk: %w", err)
+	}
+	d.Chunks = append(d.Chunks, chunk)
+	d.ChunkCount = len(d.Chunks)
+	d.ChunkWriter.NotifyChunkUpdate(d.ID, chunk)
+	return chunk, nil
+}
+
+// workerPool runs the workers of one run of a download. Auto downloads
+// resize it as they tune; workers over the target retire between chunks.
+type workerPool struct {
+	d      *Download
+	ctx    context.Context
+	chunks chan *ChunkInfo
+	wg     sync.WaitGroup
+	live   atomic.Int32
+	target atomic.Int32
+	// perConnection is the latest measured speed of one connection, in
+	// bytes per second
+	perConnection atomic.Int64
+}
+
+func newWorkerPool(ctx context.Context, d *Download, workers int) *workerPool {
+	p := &workerPool{d: d, ctx: ctx, chunks: make(chan *ChunkInfo)}
+	d.Mutex.Lock()
+	d.pool = p
+	d.Mutex.Unlock()
+	p.resize(workers)
+	return p
+}
+
+// resize sets how many workers the pool runs, starting any missing. Only the
+// run's own goroutine calls it, and not after wait.
+func (p *workerPool) resize(workers int) {
+	p.target.Store(int32(workers))
+	for p.live.Load() < int32(workers) {
+		p.live.Add(1)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			retired := false
+			p.d.worker(p.ctx, p.chunks, func() bool {
+				retired = p.retire()
+				return retired
+			})
+			if !retired {
+				p.live.Add(-1)
+			}
+		}()
+	}
+}
+
+// retire reports whether the calling worker should stop, as the pool runs
+// more than its target
+func (p *workerPool) retire() bool {
+	for {
+		live := p.live.Load()
+		if live <= p.target.Load() {
+			return false
+		}
+		if p.live.CompareAndSwap(live, live-1) {
+			return true
+		}
+	}
+}
+
+// wait waits for the workers to finish once chunks is closed
+func (p *workerPool) wait() {
+	p.wg.Wait()
+	p.d.Mutex.Lock()
+	p.d.pool = nil
+	p.d.Mutex.Unlock()
+}
+
+// chunkSize is the size of the next chunk cut for an auto download: what one
+// connection fetches in AutoChunkDuration, but no more than an even share of
+// what is left among the workers so they finish together
+func (p *workerPool) chunkSize() int64 {
+	size := p.perConnection.Load() * int64(AutoChunkDuration/time.Second)
+	size = min(max(size, AutoMinChunk), AutoMaxChunk)
+
+	p.d.Mutex.Lock()
+	remaining := p.d.TotalSize - p.d.carvedEnd()
+	p.d.Mutex.Unlock()
+	workers := int64(max(p.target.Load(), 1))
+	share := (remaining + workers - 1) / workers
+	return min(size, max(share, AutoMinChunk))
+}
+
+// tune measures the aggregate speed of an auto download every
+// AutoSampleInterval and adds a connection while each one added raises it
+// by autoMinGain, dropping one that didn't. Once settled it tries another
+// every autoReprobeSamples samples, in case the network got faster. It stops
+// when stop is closed.
+func (p *workerPool) tune(stop <-chan struct{}) {
+	d := p.d
+	ticker := time.NewTicker(AutoSampleInterval)
+	defer ticker.Stop()
+
+	d.Mutex.Lock()
+	lastBytes := d.BytesDownloaded
+	d.Mutex.Unlock()
+	lastTime := time.Now()
+
+	// probing is set after a connection was added, with the speed before it
+	probing := false
+	var before int64
+	held := autoReprobeSamples
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.Mutex.Lock()
+			bytes := d.BytesDownloaded
+			d.Mutex.Unlock()
+			elapsed := now.Sub(lastTime)
+			speed := int64(float64(bytes-lastBytes) / elapsed.Seconds())
+			lastBytes, lastTime = bytes, now
+
+			workers := int(p.target.Load())
+			p.perConnection.Store(speed / int64(max(p.live.Load(), 1)))
+
+			next := workers
+			switch {
+			case probing && float64(speed) < float64(before)*(1+autoMinGain):
+				// the added connection didn't pay off
+				next--
+				probing = false
+				held = 0
+			case probing || held >= autoReprobeSamples:
+				next++
+				probing = true
+				before = speed
+			default:
+				held++
+			}
+
+			allowance := d.ChunkWriter.ConnectionAllowance(d)
+			if next > allowance {
+				next = allowance
+				probing = false
+			}
+			next = max(next, 1)
+			if next == workers {
+				continue
+			}
+
+			d.log().Debug("tuning workers", "from", workers, "to", next, "speed", speed)
+			p.resize(next)
+			d.Mutex.Lock()
+			d.WorkersCount = next
+			d.Mutex.Unlock()
+			if err := d.ChunkWriter.UpdateWorkers(d.ID, next); err != nil {
+				d.log().Error("failed to store worker count", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttledReader serves a file no faster than its connection's and the
+// server's limits
+type throttledReader struct {
+	*bytes.Reader
+	conn, server *rate.Limiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	if len(p) > 16*1024 {
+		p = p[:16*1024]
+	}
+	n, err := r.Reader.Read(p)
+	r.conn.WaitN(context.Background(), n)
+	r.server.WaitN(context.Background(), n)
+	return n, err
+}
+
+// newThrottledServer serves data with each connection limited to perConn
+// bytes per second and all of them together to total
+func newThrottledServer(t *testing.T, data []byte, perConn, total int) *httptest.Server {
+	server := rate.NewLimiter(rate.Limit(total), 64*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn := rate.NewLimiter(rate.Limit(perConn), 64*1024)
+		http.ServeContent(w, r, "file.bin", time.Time{}, throttledReader{bytes.NewReader(data), conn, server})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fastTuning shortens the auto mode intervals for the length of a test
+func fastTuning(t *testing.T) {
+	interval, duration, minChunk := AutoSampleInterval, AutoChunkDuration, AutoMinChunk
+	AutoSampleInterval = 200 * time.Millisecond
+	AutoChunkDuration = time.Second
+	AutoMinChunk = 256 * 1024
+	t.Cleanup(func() {
+		AutoSampleInterval, AutoChunkDuration, AutoMinChunk = interval, duration, minChunk
+	})
+}
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// addAuto adds an auto download of srv's file and returns it
+func addAuto(t *testing.T, dm *DownloadManager, srv *httptest.Server) *Download {
+	t.Helper()
+	target := filepath.Join(t.TempDir(), "file.bin")
+	if err := dm.AddAutoDownload(srv.URL+"/file.bin", target); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dm.getDownload(srv.URL+"/file.bin", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func waitState(t *testing.T, d *Download, state DownloadState, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		s := d.snapshot()
+		if s.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("download is %s, want %s: %s", s.State, state, s.LastError)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// checkCoverage fails unless the chunks of d cover [0, TotalSize) in order
+func checkCoverage(t *testing.T, d *Download) {
+	t.Helper()
+	s := d.snapshot()
+	var next int64
+	for i, chunk := range s.Chunks {
+		if chunk.Index != i || chunk.StartByte != next || chunk.EndByte < chunk.StartByte {
+			t.Fatalf("chunk %d covers [%d, %d], want it to start at %d", chunk.Index, chunk.StartByte, chunk.EndByte, next)
+		}
+		next = chunk.EndByte + 1
+	}
+	if next != s.TotalSize {
+		t.Fatalf("chunks cover %d of %d bytes", next, s.TotalSize)
+	}
+}
+
+func TestCarveChunkMergesRemainder(t *testing.T) {
+	fastTuning(t)
+	dm := newTestManager(t)
+	d := &Download{
+		URL:          "http://example.com/file.bin",
+		TargetPath:   filepath.Join(t.TempDir(), "file.bin"),
+		TotalSize:    10*AutoMinChunk + AutoMinChunk/2,
+		WorkersCount: 1,
+		State:        StatePaused,
+		Auto:         true,
+	}
+	dm.Mutex.Lock()
+	err := dm.saveDownload(d)
+	dm.Mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := d.carveChunk(5 * AutoMinChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.StartByte != 0 || first.Size() != 5*AutoMinChunk {
+		t.Fatalf("first chunk [%d, %d]", first.StartByte, first.EndByte)
+	}
+
+	// half a minimum chunk would be left, so it goes with this one
+	last, err := d.carveChunk(5 * AutoMinChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.EndByte != d.TotalSize-1 {
+		t.Fatalf("last chunk ends at %d, want %d", last.EndByte, d.TotalSize-1)
+	}
+	if chunk, err := d.carveChunk(5 * AutoMinChunk); chunk != nil || err != nil {
+		t.Fatalf("carved %v, %v from a fully cut file", chunk, err)
+	}
+	checkCoverage(t, d)
+
+	var stored int
+	if err := dm.DB.QueryRow("SELECT chunks FROM downloads WHERE id=?", d.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 2 {
+		t.Fatalf("stored chunk count %d, want 2", stored)
+	}
+}
+
+func TestChunkSizeSharesRemainder(t *testing.T) {
+	fastTuning(t)
+	d := &Download{TotalSize: 8 * AutoMinChunk}
+	p := &workerPool{d: d}
+	p.target.Store(4)
+
+	// fast connections want big chunks, but four workers share what is left
+	p.perConnection.Store(AutoMaxChunk)
+	if size := p.chunkSize(); size != 2*AutoMinChunk {
+		t.Fatalf("chunk size %d, want %d", size, 2*AutoMinChunk)
+	}
+
+	// slow connections get the minimum
+	p.perConnection.Store(1)
+	if size := p.chunkSize(); size != AutoMinChunk {
+		t.Fatalf("chunk size %d, want %d", size, AutoMinChunk)
+	}
+}
+
+func TestAutoDownloadCoversFile(t *testing.T) {
+	fastTuning(t)
+	data := randomData(t, 6<<20)
+	srv := newThrottledServer(t, data, 2<<20, 8<<20)
+	dm := newTestManager(t)
+
+	d := addAuto(t, dm, srv)
+	waitState(t, d, StateCompleted, 30*time.Second)
+	checkCoverage(t, d)
+
+	got, err := os.ReadFile(d.snapshot().TargetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the served one")
+	}
+}
+
+func TestTunerGrowsAndShrinks(t *testing.T) {
+	fastTuning(t)
+	// four connections saturate the server
+	data := randomData(t, 24<<20)
+	srv := newThrottledServer(t, data, 1<<20, 4<<20)
+	dm := newTestManager(t)
+
+	d := addAuto(t, dm, srv)
+	workers := func() int {
+		d.Mutex.Lock()
+		defer d.Mutex.Unlock()
+		return d.WorkersCount
+	}
+
+	deadline := time.Now().Add(15 * time.Second)
+	for workers() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker count stayed at %d", workers())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// a lower per-host limit takes the extra connections away
+	if err := dm.SetMaxHostConnections(1); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for workers() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker count stayed at %d", workers())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var stored int
+	if err := dm.DB.QueryRow("SELECT workers FROM downloads WHERE id=?", d.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Fatalf("stored worker count %d, want 1", stored)
+	}
+	if err := dm.CancelDownload(d.ID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+	"golang.org/x/time/rate"
+)
+
+// BandwidthCheckInterval is how often the active bandwidth profile is checked
+var BandwidthCheckInterval = 30 * time.Second
+
+// bandwidthBurst lets a whole read buffer through at once
+const bandwidthBurst = 128 * 1024
+
+// defaultProfileName is reported while no profile's window is open and the
+// plain speed limit applies
+const defaultProfileName = "Default"
+
+// BandwidthProfile caps the combined speed of all downloads, in bytes per
+// second with 0 for unlimited, while one of its windows is open. When windows
+// of several profiles overlap the first one wins.
+type BandwidthProfile struct {
+	Name    string           `json:"name"`
+	Limit   int64            `json:"limit"`
+	Windows []ScheduleWindow `json:"windows"`
+}
+
+// BandwidthProfileEvent reports the profile the rate limiter switched to
+type BandwidthProfileEvent struct {
+	Name  string `json:"name"`
+	Limit int64  `json:"limit"`
+}
+
+// bandwidthLimiter is shared by every chunk of every download
+type bandwidthLimiter struct {
+	mutex   sync.Mutex
+	limiter *rate.Limiter
+	active  *BandwidthProfileEvent
+}
+
+func (b *bandwidthLimiter) get() *rate.Limiter {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.limiter == nil {
+		b.limiter = rate.NewLimiter(rate.Inf, bandwidthBurst)
+	}
+	return b.limiter
+}
+
+// WaitBandwidth blocks until n more bytes may be read without exceeding the
+// active limit
+func (dm *DownloadManager) WaitBandwidth(ctx context.Context, n int) error {
+	limiter := dm.bandwidth.get()
+	for n > 0 {
+		take := min(n, bandwidthBurst)
+		if err := limiter.WaitN(ctx, take); err != nil {
+			return err
+		}
+		n -= take
+	}
+	return nil
+}
+
+func (p BandwidthProfile) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("profile needs a name")
+	}
+	if p.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", p.Limit)
+	}
+	if len(p.Windows) == 0 {
+		return errors.New("profile needs at least one window")
+	}
+	for i, w := range p.Windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// SpeedLimit returns the limit in bytes per second that applies while no
+// profile is active, 0 for unlimited
+func (dm *DownloadManager) SpeedLimit() (int64, error) {
+	value, err := dm.Setting("speed_limit", "0")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (dm *DownloadManager) SetSpeedLimit(limit int64) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid limit %d", limit)
+	}
+	if err := dm.SetSetting("speed_limit", strconv.FormatInt(limit, 10)); err != nil {
+		return err
+	}
+	dm.applyBandwidthProfile()
+	return nil
+}
+
+func (dm *DownloadManager) BandwidthProfiles() ([]BandwidthProfile, error) {
+	value, err := dm.Setting("bandwidth_profiles", "")
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var profiles []BandwidthProfile
+	if err := json.Unmarshal([]byte(value), &profiles); err != nil {
+		return nil, fmt.Errorf("decoding bandwidth profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+func (dm *DownloadManager) SetBandwidthProfiles(profiles []BandwidthProfile) error {
+	for i, p := range profiles {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %d: %w", i+1, err)
+		}
+	}
+	data, err := json.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	if err := dm.SetSetting("bandwidth_profiles", string(data)); err != nil {
+		return err
+	}
+	dm.applyBandwidthProfile()
+	return nil
+}
+
+// activeBandwidthProfile returns the profile whose window is open at t, or
+// the plain speed limit under the default name
+func (dm *DownloadManager) activeBandwidthProfile(t time.Time) (BandwidthProfileEvent, error) {
+	profiles, err := dm.BandwidthProfiles()
+	if err != nil {
+		return BandwidthProfileEvent{}, err
+	}
+	for _, p := range profiles {
+		for _, w := range p.Windows {
+			if w.openAt(t) {
+				return BandwidthProfileEvent{Name: p.Name, Limit: p.Limit}, nil
+			}
+		}
+	}
+
+	limit, err := dm.SpeedLimit()
+	if err != nil {
+		return BandwidthProfileEvent{}, err
+	}
+	return BandwidthProfileEvent{Name: defaultProfileName, Limit: limit}, nil
+}
+
+// ActiveBandwidthProfile returns the profile the rate limiter currently uses
+func (dm *DownloadManager) ActiveBandwidthProfile() (BandwidthProfileEvent, error) {
+	return dm.activeBandwidthProfile(time.Now())
+}
+
+// applyBandwidthProfile sets the rate limiter to the active profile and
+// tells the frontend when it changed
+func (dm *DownloadManager) applyBandwidthProfile() {
+	active, err := dm.activeBandwidthProfile(time.Now())
+	if err != nil {
+		logger.Error("failed to read bandwidth profiles", "err", err)
+		return
+	}
+
+	limiter := dm.bandwidth.get()
+	dm.bandwidth.mutex.Lock()
+	changed := dm.bandwidth.active == nil || *dm.bandwidth.active != active
+	dm.bandwidth.active = &active
+	dm.bandwidth.mutex.Unlock()
+	if !changed {
+		return
+	}
+
+	if active.Limit > 0 {
+		limiter.SetLimit(rate.Limit(active.Limit))
+	} else {
+		limiter.SetLimit(rate.Inf)
+	}
+	logger.Info("bandwidth profile active", "profile", active.Name, "limit", active.Limit)
+
+	if dm.appCtx != nil {
+		runtime.EventsEmit(dm.appCtx, "bandwidthProfile", active)
+	}
+}
+
+// runBandwidthSchedule switches bandwidth profiles as their windows open and
+// close until ctx is done
+func (dm *DownloadManager) runBandwidthSchedule(ctx context.Context) {
+	ticker := time.NewTicker(BandwidthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		dm.applyBandwidthProfile()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
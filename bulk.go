@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// BulkSelection picks the downloads of a bulk operation, by ID or, when no
+// IDs are given, by filter. Paging fields of the filter are ignored.
+type BulkSelection struct {
+	IDs    []int64         `json:"ids"`
+	Filter *DownloadFilter `json:"filter,omitempty"`
+}
+
+// BulkUpdateEvent is sent once per bulk operation instead of an update for
+// every download and chunk
+type BulkUpdateEvent struct {
+	Action      string        `json:"action"`
+	State       DownloadState `json:"state"`
+	DownloadIDs []int64       `json:"downloadIds"`
+	// Rejected are the selected downloads whose state doesn't allow the action
+	Rejected []int64 `json:"rejected,omitempty"`
+}
+
+// selectIDs resolves a selection to download IDs
+func (dm *DownloadManager) selectIDs(sel BulkSelection) ([]int64, error) {
+	if len(sel.IDs) > 0 {
+		return sel.IDs, nil
+	}
+	if sel.Filter == nil {
+		return nil, errors.New("select downloads by ID or filter")
+	}
+
+	where, args := sel.Filter.where()
+	rows, err := dm.DB.Query("SELECT d.id FROM downloads d"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// bulkUpdate moves the selected downloads whose state allows it to state,
+// persisting them in a single transaction, and then has their controllers
+// start or stop their runs to match. The others are reported as rejected.
+// Stopped runs send no chunk updates, the one BulkUpdateEvent covering them.
+func (dm *DownloadManager) bulkUpdate(action string, sel BulkSelection, state DownloadState) (*BulkUpdateEvent, error) {
+	ids, err := dm.selectIDs(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &BulkUpdateEvent{Action: action, State: state, DownloadIDs: []int64{}}
+	selected, err := dm.writeBulkState(ids, state, event)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range selected {
+		if err := dm.control(d, nil); err != nil {
+			d.log().Error("failed to apply bulk action", "action", action, "err", err)
+		}
+		d.quiet.Store(false)
+		event.DownloadIDs = append(event.DownloadIDs, d.ID)
+	}
+
+	logger.Info("bulk action applied", "action", action, "downloads", len(selected))
+	if dm.appCtx != nil {
+		runtime.EventsEmit(dm.appCtx, "downloadsBulkUpdate", *event)
+	}
+	return event, nil
+}
+
+// writeBulkState moves the downloads with the given IDs to state where
+// allowed, storing them in one transaction before the change shows in
+// memory. Each download is only locked while it is checked, written and
+// changed, so runs aren't held up by the whole batch. Rejected IDs are added
+// to event.
+func (dm *DownloadManager) writeBulkState(ids []int64, state DownloadState, event *BulkUpdateEvent) ([]*Download, error) {
+	dm.Mutex.Lock()
+	var downloads []*Download
+	for _, id := range ids {
+		if d, ok := dm.Downloads[id]; ok {
+			downloads = append(downloads, d)
+		}
+	}
+	dm.Mutex.Unlock()
+
+	tx, err := dm.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the state each selected download was written from
+	var selected []*Download
+	from := map[*Download]DownloadState{}
+	for _, d := range downloads {
+		d.Mutex.Lock()
+		current := d.State
+		switch {
+		case current == state:
+		case !canTransition(current, state):
+			event.Rejected = append(event.Rejected, d.ID)
+		default:
+			err = writeState(tx, d, state)
+			selected = append(selected, d)
+			from[d] = current
+		}
+		d.Mutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("updating download %d: %w", d.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	var applied []*Download
+	for _, d := range selected {
+		d.Mutex.Lock()
+		current := d.State
+		if current != from[d] && !canTransition(current, state) {
+			// finished or failed since it was written, which stands. It is
+			// stored before unlocking, or it could overwrite a transition
+			// made meanwhile.
+			if current != state {
+				if _, err := dm.DB.Exec("UPDATE downloads SET state=? WHERE id=?", current, d.ID); err != nil {
+					d.log().Error("failed to restore download state", "err", err)
+				}
+			}
+			d.Mutex.Unlock()
+			continue
+		}
+		if state != StateActive {
+			d.quiet.Store(true)
+		}
+		d.applyState(state)
+		d.Mutex.Unlock()
+		applied = append(applied, d)
+	}
+	return applied, nil
+}
+
+// PauseDownloads pauses the selected downloads that are running or waiting
+func (dm *DownloadManager) PauseDownloads(sel BulkSelection) (*BulkUpdateEvent, error) {
+	return dm.bulkUpdate("pause", sel, StatePaused)
+}
+
+// ResumeDownloads resumes the selected paused, queued or failed downloads.
+// Ones that no longer fit on their disk stay as they are.
+func (dm *DownloadManager) ResumeDownloads(sel BulkSelection) (*BulkUpdateEvent, error) {
+	ids, err := dm.selectIDs(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	var fitting []int64
+	for _, id := range ids {
+		dm.Mutex.Lock()
+		d, ok := dm.Downloads[id]
+		dm.Mutex.Unlock()
+		if !ok {
+			continue
+		}
+		if err := dm.checkDiskSpace(d); errors.Is(err, ErrInsufficientSpace) {
+			d.log().Warn("not resuming download", "err", err)
+			continue
+		}
+		fitting = append(fitting, id)
+	}
+	if len(fitting) == 0 {
+		return &BulkUpdateEvent{Action: "resume", State: StateActive, DownloadIDs: []int64{}}, nil
+	}
+
+	return dm.bulkUpdate("resume", BulkSelection{IDs: fitting}, StateActive)
+}
+
+// CancelDownloads cancels the selected downloads that haven't finished
+func (dm *DownloadManager) CancelDownloads(sel BulkSelection) (*BulkUpdateEvent, error) {
+	return dm.bulkUpdate("cancel", sel, StateCancelled)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Category groups downloads by file type. A download belongs to the first
+// category with a matching URL pattern, MIME type or extension, and without
+// an explicit path, chunk or worker count takes the category's defaults.
+type Category struct {
+	Name       string   `json:"name"`
+	Extensions []string `json:"extensions"`
+	// MimeTypes may end in /* to match a whole type, like video/*
+	MimeTypes []string `json:"mime_types"`
+	// URLPatterns are regular expressions matched against the URL
+	URLPatterns []string `json:"url_patterns"`
+	Dir         string   `json:"dir"`
+	Chunks      int      `json:"chunks"`
+	Workers     int      `json:"workers"`
+}
+
+const (
+	DefaultChunks  = 10
+	DefaultWorkers = 3
+)
+
+// defaultDownloadDir is where downloads without a path or category
+// directory go
+func defaultDownloadDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, "Downloads")
+	}
+	return "Downloads"
+}
+
+func defaultCategories() []Category {
+	downloads := defaultDownloadDir()
+
+	return []Category{
+		{
+			Name:       "Video",
+			Extensions: []string{"mp4", "mkv", "avi", "mov", "webm", "m4v", "wmv", "flv", "ts"},
+			MimeTypes:  []string{"video/*", "application/vnd.apple.mpegurl", "application/dash+xml"},
+			Dir:        filepath.Join(downloads, "Video"),
+			Chunks:     16,
+			Workers:    4,
+		},
+		{
+			Name:       "ISO",
+			Extensions: []string{"iso", "img", "dmg"},
+			MimeTypes:  []string{"application/x-iso9660-image", "application/x-apple-diskimage"},
+			Dir:        filepath.Join(downloads, "ISO"),
+			Chunks:     16,
+			Workers:    4,
+		},
+		{
+			Name:       "Archives",
+			Extensions: []string{"zip", "rar", "7z", "tar", "gz", "tgz", "xz", "txz", "bz2", "zst"},
+			MimeTypes:  []string{"application/zip", "application/x-tar", "application/gzip", "application/x-xz", "application/x-7z-compressed", "application/vnd.rar"},
+			Dir:        filepath.Join(downloads, "Archives"),
+			Chunks:     DefaultChunks,
+			Workers:    DefaultWorkers,
+		},
+		{
+			Name:       "Documents",
+			Extensions: []string{"pdf", "doc", "docx", "xls", "xlsx", "ppt", "pptx", "odt", "ods", "odp", "txt", "rtf", "epub", "csv"},
+			MimeTypes:  []string{"application/pdf", "text/plain", "text/csv", "application/epub+zip", "application/msword"},
+			Dir:        filepath.Join(downloads, "Documents"),
+			Chunks:     4,
+			Workers:    2,
+		},
+	}
+}
+
+func (c Category) validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("category needs a name")
+	}
+	for _, pattern := range c.URLPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid URL pattern %q: %w", pattern, err)
+		}
+	}
+	if c.Chunks < 0 || c.Workers < 0 {
+		return errors.New("chunk and worker counts can't be negative")
+	}
+	return nil
+}
+
+// matches reports whether a download of rawURL, saved as fileName with the
+// given MIME type, belongs to the category
+func (c Category) matches(rawURL, fileName, mimeType string) bool {
+	for _, pattern := range c.URLPatterns {
+		if re, err := regexp.Compile(pattern); err == nil && re.MatchString(rawURL) {
+			return true
+		}
+	}
+
+	if mimeType != "" {
+		for _, m := range c.MimeTypes {
+			if prefix, ok := strings.CutSuffix(m, "/*"); ok {
+				if strings.HasPrefix(mimeType, prefix+"/") {
+					return true
+				}
+			} else if strings.EqualFold(m, mimeType) {
+				return true
+			}
+		}
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(fileName), "."))
+	if ext != "" {
+		for _, e := range c.Extensions {
+			if strings.ToLower(strings.TrimPrefix(e, ".")) == ext {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (dm *DownloadManager) Categories() ([]Category, error) {
+	value, err := dm.Setting("categories", "")
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return defaultCategories(), nil
+	}
+
+	var categories []Category
+	if err := json.Unmarshal([]byte(value), &categories); err != nil {
+		return nil, fmt.Errorf("decoding categories: %w", err)
+	}
+	return categories, nil
+}
+
+func (dm *DownloadManager) SetCategories(categories []Category) error {
+	names := map[string]bool{}
+	for _, c := range categories {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate category %q", c.Name)
+		}
+		names[c.Name] = true
+	}
+
+	data, err := json.Marshal(categories)
+	if err != nil {
+		return err
+	}
+	return dm.SetSetting("categories", string(data))
+}
+
+// categoryFor returns the first category a download matches, or nil
+func (dm *DownloadManager) categoryFor(rawURL, fileName, mimeType string) (*Category, error) {
+	categories, err := dm.Categories()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range categories {
+		if c.matches(rawURL, fileName, mimeType) {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// newCategorizedDownload probes rawURL and fills in what the caller left
+// out, an empty path, or chunk and worker counts of zero, from the category
+// it falls into
+func (dm *DownloadManager) newCategorizedDownload(rawURL, targetPath string, chunks, workers int) (*Download, error) {
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	probe, err := probeURL(context.Background(), rawURL, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file is matched by the name it is saved as
+	fileName := probe.FileName
+	if targetPath != "" && !namesDirectory(targetPath) {
+		fileName = filepath.Base(targetPath)
+	}
+	category, err := dm.categoryFor(rawURL, fileName, probe.MimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	name := ""
+	if category != nil {
+		name = category.Name
+		if category.Dir != "" {
+			targetPath = inCategoryDir(category.Dir, targetPath)
+		}
+		if chunks <= 0 {
+			chunks = category.Chunks
+		}
+		if workers <= 0 {
+			workers = category.Workers
+		}
+	}
+	if targetPath == "" {
+		return nil, errors.New("no download path given and no category directory matches")
+	}
+	if chunks <= 0 {
+		chunks = DefaultChunks
+	}
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	d, err := newProbedDownload(client, rawURL, targetPath, probe, chunks, workers)
+	if err != nil {
+		return nil, err
+	}
+	d.Category = name
+	return d, nil
+}
+
+// inCategoryDir places an empty or relative path in dir. Absolute paths the
+// user picked are kept.
+func inCategoryDir(dir, path string) string {
+	switch {
+	case path == "":
+		return dir + string(filepath.Separator)
+	case filepath.IsAbs(path):
+		return path
+	case namesDirectory(path):
+		return filepath.Join(dir, path) + string(filepath.Separator)
+	}
+	return filepath.Join(dir, path)
+}
+
+// assignCategory categorizes a download added without a probe, like the
+// files of metalinks and torrents, by its URL and file name
+func (dm *DownloadManager) assignCategory(d *Download) {
+	if d.Category != "" {
+		return
+	}
+	rawURL := d.URL
+	if u, err := url.Parse(rawURL); err == nil && u.Scheme == "magnet" {
+		rawURL = ""
+	}
+	category, err := dm.categoryFor(rawURL, filepath.Base(d.TargetPath), "")
+	if err != nil {
+		d.log().Error("failed to categorize download", "err", err)
+		return
+	}
+	if category != nil {
+		d.Category = category.Name
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReaddingRestoresCategorizedDownload(t *testing.T) {
+	data := randomData(t, 64*1024)
+	srv := newThrottledServer(t, data, 1<<20, 1<<20)
+	dm := newTestManager(t)
+	dir := t.TempDir()
+	if err := dm.SetCategories([]Category{{Name: "Binaries", Extensions: []string{"bin"}, Dir: dir}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a path the category places the file
+	rawURL := srv.URL + "/file.bin"
+	if err := dm.AddDownload(rawURL, "", 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "file.bin")
+	d, err := dm.getDownload(rawURL, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, StateCompleted, 10*time.Second)
+
+	// adding it the same way again finds it there
+	if err := dm.AddDownload(rawURL, "", 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := dm.DB.QueryRow("SELECT COUNT(*) FROM downloads").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("%d downloads after adding the same URL twice, want 1", count)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file (1).bin")); err == nil {
+		t.Fatal("the download was added again under a new name")
+	}
+}
+
+func TestInCategoryDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Video")
+	existing := t.TempDir()
+	sep := string(filepath.Separator)
+
+	tests := []struct {
+		name, path, want string
+	}{
+		{"no path", "", dir + sep},
+		{"relative file", "film.mkv", filepath.Join(dir, "film.mkv")},
+		{"relative subdirectory file", filepath.Join("series", "ep1.mkv"), filepath.Join(dir, "series", "ep1.mkv")},
+		{"relative directory", "series" + sep, filepath.Join(dir, "series") + sep},
+		{"absolute file", filepath.Join(existing, "film.mkv"), filepath.Join(existing, "film.mkv")},
+		{"absolute directory", existing, existing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inCategoryDir(dir, tt.path); got != tt.want {
+				t.Fatalf("inCategoryDir(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// newHash accepts both the metalink v4 ("sha-256") and v3 ("sha256") spelling
+func newHash(algo string) (hash.Hash, error) {
+	switch strings.ReplaceAll(strings.ToLower(algo), "-", "") {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha224":
+		return sha256.New224(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash type %q", algo)
+	}
+}
+
+// hashRank orders hash types by strength so the strongest available one is used
+func hashRank(algo string) int {
+	switch strings.ReplaceAll(strings.ToLower(algo), "-", "") {
+	case "sha512":
+		return 6
+	case "sha384":
+		return 5
+	case "sha256":
+		return 4
+	case "sha224":
+		return 3
+	case "sha1":
+		return 2
+	case "md5":
+		return 1
+	default:
+		return 0
+	}
+}
+
+func verifyFile(path, algo, expected string) error {
+	h, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, expected) {
+		return fmt.Errorf("%s checksum mismatch: expected %s, got %s", algo, expected, sum)
+	}
+	return nil
+}
+
+// verifyChunk checks the pieces covered by a completed chunk against the
+// piece hashes. Chunks are aligned to piece boundaries when piece hashes are
+// known, so every piece lies entirely within one part file.
+func (d *Download) verifyChunk(chunk *ChunkInfo) error {
+	if d.PieceLength <= 0 || len(d.PieceHashes) == 0 || chunk.StartByte%d.PieceLength != 0 {
+		return nil
+	}
+
+	file, err := os.Open(d.partPath(chunk))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	length := chunk.EndByte - chunk.StartByte + 1
+	piece := int(chunk.StartByte / d.PieceLength)
+	for offset := int64(0); offset < length && piece < len(d.PieceHashes); offset += d.PieceLength {
+		h, err := newHash(d.PieceType)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(h, file, min(d.PieceLength, length-offset)); err != nil {
+			return fmt.Errorf("reading piece %d: %w", piece, err)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, d.PieceHashes[piece]) {
+			return fmt.Errorf("piece %d hash mismatch", piece)
+		}
+		piece++
+	}
+	return nil
+}
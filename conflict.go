@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// ConflictPolicy decides what happens when a download's target file already
+// exists, both when the download is added and again before its chunks are
+// combined.
+type ConflictPolicy string
+
+const (
+	// ConflictAsk lets the user pick one of the other policies
+	ConflictAsk ConflictPolicy = "ask"
+	// ConflictRename saves to "name (1).ext", "name (2).ext", ...
+	ConflictRename ConflictPolicy = "rename"
+	// ConflictOverwrite replaces the existing file
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip keeps the existing file and doesn't download
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictResume treats a file of the expected size and checksum as the
+	// finished download, and renames otherwise
+	ConflictResume ConflictPolicy = "resume"
+)
+
+const defaultConflictPolicy = ConflictRename
+
+var ErrTargetExists = errors.New("target file already exists")
+
+// ConflictAnswerTimeout is how long a fileConflict event waits for the user
+// before the file is renamed
+var ConflictAnswerTimeout = 5 * time.Minute
+
+func (p ConflictPolicy) valid() bool {
+	switch p {
+	case ConflictAsk, ConflictRename, ConflictOverwrite, ConflictSkip, ConflictResume:
+		return true
+	}
+	return false
+}
+
+// conflictOutcome tells the caller what to do with the path a conflict was
+// resolved to
+type conflictOutcome int
+
+const (
+	// conflictProceed downloads to the returned path
+	conflictProceed conflictOutcome = iota
+	// conflictSkip leaves the existing file alone
+	conflictSkip
+	// conflictExisting uses the existing file as the finished download
+	conflictExisting
+)
+
+// FileConflictEvent asks the frontend how to handle an existing target file.
+// It answers with App.ResolveConflict.
+type FileConflictEvent struct {
+	ID          string `json:"id"`
+	DownloadID  int64  `json:"downloadId"`
+	URL         string `json:"url"`
+	Path        string `json:"path"`
+	RenamedPath string `json:"renamed_path"`
+}
+
+var conflictCounter atomic.Int64
+
+type conflictPrompts struct {
+	mutex   sync.Mutex
+	pending map[string]chan ConflictPolicy
+}
+
+func (dm *DownloadManager) ConflictPolicy() (ConflictPolicy, error) {
+	value, err := dm.Setting("conflict_policy", string(defaultConflictPolicy))
+	if err != nil {
+		return "", err
+	}
+	if policy := ConflictPolicy(value); policy.valid() {
+		return policy, nil
+	}
+	return defaultConflictPolicy, nil
+}
+
+func (dm *DownloadManager) SetConflictPolicy(policy ConflictPolicy) error {
+	if !policy.valid() {
+		return fmt.Errorf("unknown conflict policy %q", policy)
+	}
+	return dm.SetSetting("conflict_policy", string(policy))
+}
+
+// ResolveConflict settles an existing file at d's target, or at path when it
+// differs, and another unfinished download saving there. The policy the
+// download was added with takes precedence over the global one, so a file the
+// user agreed to overwrite isn't asked about again before combining. A target
+// taken by another download is renamed unless the policy skips it, as the
+// two would write the same part files.
+func (dm *DownloadManager) ResolveConflict(ctx context.Context, d *Download, path string) (string, conflictOutcome, error) {
+	exists := true
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		exists = false
+	} else if err != nil {
+		return "", conflictProceed, err
+	}
+	inUse, err := dm.targetInUse(d, path)
+	if err != nil {
+		return "", conflictProceed, err
+	}
+	if !exists && !inUse {
+		return path, conflictProceed, nil
+	}
+
+	d.Mutex.Lock()
+	policy := d.ConflictPolicy
+	d.Mutex.Unlock()
+	if policy == "" {
+		if policy, err = dm.ConflictPolicy(); err != nil {
+			return "", conflictProceed, err
+		}
+	}
+	taken := func(candidate string) bool {
+		inUse, err := dm.targetInUse(d, candidate)
+		return inUse || err != nil
+	}
+	if inUse {
+		if policy == ConflictSkip {
+			return path, conflictSkip, nil
+		}
+		return renamedPath(path, taken), conflictProceed, nil
+	}
+
+	if policy == ConflictAsk {
+		if policy, err = dm.askConflict(ctx, d, path); err != nil {
+			return "", conflictProceed, err
+		}
+		if err := dm.setConflictPolicy(d, policy); err != nil {
+			return "", conflictProceed, err
+		}
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		return path, conflictProceed, nil
+	case ConflictSkip:
+		return path, conflictSkip, nil
+	case ConflictResume:
+		if d.matchesFile(path) {
+			return path, conflictExisting, nil
+		}
+	}
+	return renamedPath(path, taken), conflictProceed, nil
+}
+
+// targetInUse reports whether another unfinished download, tracked or only
+// stored, saves to path
+func (dm *DownloadManager) targetInUse(d *Download, path string) (bool, error) {
+	dm.Mutex.Lock()
+	defer dm.Mutex.Unlock()
+	return dm.targetTaken(d, path)
+}
+
+// targetTaken is targetInUse for a caller holding dm.Mutex
+func (dm *DownloadManager) targetTaken(d *Download, path string) (bool, error) {
+	for _, other := range dm.Downloads {
+		if other == d || other.ID == d.ID {
+			continue
+		}
+		other.Mutex.Lock()
+		same := other.TargetPath == path && other.State != StateCompleted && other.State != StateCancelled
+		other.Mutex.Unlock()
+		if same {
+			return true, nil
+		}
+	}
+
+	var id int64
+	err := dm.DB.QueryRow("SELECT id FROM downloads WHERE path=? AND id<>? AND state NOT IN (?,?) LIMIT 1",
+		path, d.ID, StateCompleted, StateCancelled).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setConflictPolicy keeps the user's answer for d, storing it once d is
+// saved so it isn't asked again after a restart
+func (dm *DownloadManager) setConflictPolicy(d *Download, policy ConflictPolicy) error {
+	d.Mutex.Lock()
+	d.ConflictPolicy = policy
+	id := d.ID
+	d.Mutex.Unlock()
+
+	if id == 0 {
+		return nil
+	}
+	_, err := dm.DB.Exec("UPDATE downloads SET conflict_policy=? WHERE id=?", policy, id)
+	return err
+}
+
+// askConflict emits a fileConflict event and waits for the frontend's answer
+// until ctx or the app is done. Without a frontend, or an answer in time, the
+// file is renamed.
+func (dm *DownloadManager) askConflict(ctx context.Context, d *Download, path string) (ConflictPolicy, error) {
+	if dm.appCtx == nil {
+		return ConflictRename, nil
+	}
+
+	id := strconv.FormatInt(conflictCounter.Add(1), 10)
+	answer := make(chan ConflictPolicy, 1)
+	dm.conflicts.mutex.Lock()
+	if dm.conflicts.pending == nil {
+		dm.conflicts.pending = make(map[string]chan ConflictPolicy)
+	}
+	dm.conflicts.pending[id] = answer
+	dm.conflicts.mutex.Unlock()
+
+	defer func() {
+		dm.conflicts.mutex.Lock()
+		delete(dm.conflicts.pending, id)
+		dm.conflicts.mutex.Unlock()
+	}()
+
+	runtime.EventsEmit(dm.appCtx, "fileConflict", FileConflictEvent{
+		ID:          id,
+		DownloadID:  d.ID,
+		URL:         d.URL,
+		Path:        path,
+		RenamedPath: renamedPath(path, nil),
+	})
+
+	timer := time.NewTimer(ConflictAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case policy := <-answer:
+		return policy, nil
+	case <-timer.C:
+		d.log().Warn("file conflict not answered, renaming", "path", path)
+		return ConflictRename, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-dm.appCtx.Done():
+		return "", dm.appCtx.Err()
+	}
+}
+
+// AnswerConflict delivers the user's choice for a fileConflict event
+func (dm *DownloadManager) AnswerConflict(id string, policy ConflictPolicy) error {
+	if !policy.valid() || policy == ConflictAsk {
+		return fmt.Errorf("invalid answer %q", policy)
+	}
+
+	dm.conflicts.mutex.Lock()
+	defer dm.conflicts.mutex.Unlock()
+	answer, ok := dm.conflicts.pending[id]
+	if !ok {
+		return fmt.Errorf("no pending conflict %q", id)
+	}
+	delete(dm.conflicts.pending, id)
+	answer <- policy
+	return nil
+}
+
+// matchesFile reports whether the file at path is the finished download,
+// judged by its size and, when known, its checksum
+func (d *Download) matchesFile(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || d.TotalSize <= 0 || info.Size() != d.TotalSize {
+		return false
+	}
+	if d.Checksum != "" {
+		return verifyFile(path, d.ChecksumType, d.Checksum) == nil
+	}
+	return true
+}
+
+// renamedPath returns the first of "name (1).ext", "name (2).ext", ... that
+// doesn't exist yet and, when taken isn't nil, isn't taken
+func renamedPath(path string, taken func(string) bool) string {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	// keep compound extensions such as .tar.gz together
+	if inner := filepath.Ext(strings.TrimSuffix(name, ext)); inner == ".tar" {
+		ext = inner + ext
+	}
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		if _, err := os.Lstat(candidate); errors.Is(err, os.ErrNotExist) && (taken == nil || !taken(candidate)) {
+			return candidate
+		}
+	}
+}
+
+// addNewDownload settles a conflict with an existing file at d's target,
+// then saves and starts d
+func (dm *DownloadManager) addNewDownload(d *Download) error {
+	dm.assignCategory(d)
+
+	target, outcome, err := dm.ResolveConflict(context.Background(), d, d.TargetPath)
+	if err != nil {
+		return err
+	}
+
+	switch outcome {
+	case conflictSkip:
+		return fmt.Errorf("%w: %s", ErrTargetExists, target)
+	case conflictExisting:
+		if err := dm.Transition(d, StateCompleted); err != nil {
+			return err
+		}
+		for _, chunk := range d.Chunks {
+			chunk.State = StateCompleted
+			chunk.Written = max(chunk.Size(), 0)
+		}
+		d.CompletedChunks = int64(len(d.Chunks))
+	}
+	d.TargetPath = target
+
+	if schedule, err := dm.Schedule(); err != nil {
+		return err
+	} else if schedule.Enabled && schedule.QueueNew {
+		d.Scheduled = true
+	}
+	completed := d.State == StateCompleted
+	held := !completed && dm.holdIfWaiting(d)
+
+	// another download may have been added to the same target meanwhile
+	dm.Mutex.Lock()
+	taken, err := dm.targetTaken(d, d.TargetPath)
+	if err == nil && taken {
+		err = fmt.Errorf("%w: %s is being downloaded", ErrTargetExists, d.TargetPath)
+	}
+	if err == nil {
+		err = dm.saveDownload(d)
+	}
+	dm.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if completed || held {
+		return nil
+	}
+	return dm.StartDownload(d.ID)
+}
+
+// restoreExisting picks up a download of the same URL and path found in the
+// database, reporting whether there was one
+func (dm *DownloadManager) restoreExisting(url, path string) (bool, error) {
+	dm.Mutex.Lock()
+	existing, err := dm.getDownload(url, path)
+	if err == nil {
+		existing = dm.trackRestored(existing)
+	}
+	dm.Mutex.Unlock()
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, dm.restoreDownload(existing)
+}
+
+// restoreCategorized is restoreExisting for the path a category or the
+// server's file name turned path into, which the caller couldn't look up
+// before probing
+func (dm *DownloadManager) restoreCategorized(url, path string, d *Download) (bool, error) {
+	if d.TargetPath == path {
+		return false, nil
+	}
+	return dm.restoreExisting(url, d.TargetPath)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// downloadController owns the run of one download. Commands changing the
+// download's state are carried out one at a time by its goroutine, which then
+// starts or stops the run to match, so a pause racing a resume can't leave
+// two runs writing the same parts or a paused download still running. The
+// goroutine exits once there is neither a run nor a command waiting, and the
+// next command starts a new one.
+type downloadController struct {
+	dm       *DownloadManager
+	d        *Download
+	commands chan controlCommand
+	// finished receives the result of the run once it returns
+	finished chan error
+	// cancel stops the run in progress, nil when not running. Only the
+	// controller's goroutine touches it.
+	cancel context.CancelFunc
+	// pending counts the commands sent or about to be, under dm.Mutex
+	pending int
+}
+
+type controlCommand struct {
+	apply func() error
+	reply chan error
+}
+
+// controller returns the controller of d, starting it when it has none. The
+// caller holds dm.Mutex.
+func (dm *DownloadManager) controller(d *Download) *downloadController {
+	c, ok := dm.controllers[d.ID]
+	if !ok {
+		c = &downloadController{
+			dm:       dm,
+			d:        d,
+			commands: make(chan controlCommand),
+			finished: make(chan error, 1),
+		}
+		dm.controllers[d.ID] = c
+		go c.loop()
+	}
+	return c
+}
+
+// control has the controller of d call apply, usually a transition, and then
+// start or stop the run to match the state d is left in. apply may be nil to
+// only do the latter. The caller must not hold dm.Mutex, as stopping waits
+// for the run to return.
+func (dm *DownloadManager) control(d *Download, apply func() error) error {
+	dm.Mutex.Lock()
+	c := dm.controller(d)
+	// keeps the goroutine from exiting before it takes the command
+	c.pending++
+	dm.Mutex.Unlock()
+
+	reply := make(chan error, 1)
+	c.commands <- controlCommand{apply: apply, reply: reply}
+	return <-reply
+}
+
+func (c *downloadController) loop() {
+	for {
+		select {
+		case cmd := <-c.commands:
+			c.dm.Mutex.Lock()
+			c.pending--
+			c.dm.Mutex.Unlock()
+
+			// a run that already returned is cleared first, so a resume of
+			// the state it failed in starts a new run
+			select {
+			case err := <-c.finished:
+				c.done(err)
+			default:
+			}
+
+			var err error
+			if cmd.apply != nil {
+				err = cmd.apply()
+			}
+			c.reconcile()
+			cmd.reply <- err
+		case err := <-c.finished:
+			c.done(err)
+			// the download may have been resumed while the run returned
+			c.reconcile()
+		}
+
+		if c.exit() {
+			return
+		}
+	}
+}
+
+// exit removes the controller once it has nothing to do, or its download is
+// gone, and reports whether its goroutine should return
+func (c *downloadController) exit() bool {
+	c.dm.Mutex.Lock()
+	_, tracked := c.dm.Downloads[c.d.ID]
+	if c.pending > 0 || (c.cancel != nil && tracked) {
+		c.dm.Mutex.Unlock()
+		return false
+	}
+	delete(c.dm.controllers, c.d.ID)
+	c.dm.Mutex.Unlock()
+
+	// the run of a removed download is stopped outside dm.Mutex, which it
+	// may need to return
+	c.stop()
+	return true
+}
+
+// reconcile starts the run of an active download and stops that of one
+// that was queued, paused, cancelled or failed. Runs moving through their
+// own states finish by themselves, unless the manager is closing.
+func (c *downloadController) reconcile() {
+	c.d.Mutex.Lock()
+	state := c.d.State
+	c.d.Mutex.Unlock()
+
+	switch {
+	case c.dm.closed.Load():
+		c.stop()
+	case state == StateActive:
+		if c.cancel == nil {
+			c.start()
+		}
+	case state == StateQueued, state == StatePaused, state == StateCancelled, state == StateFailed:
+		c.stop()
+	}
+}
+
+func (c *downloadController) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	go func() {
+		c.finished <- c.dm.runDownload(ctx, c.d)
+	}()
+}
+
+// stop cancels the run in progress and waits for it to return
+func (c *downloadController) stop() {
+	if c.cancel != nil {
+		c.cancel()
+		c.done(<-c.finished)
+	}
+}
+
+// done clears the finished run, post-processing the download if it completed
+func (c *downloadController) done(err error) {
+	c.cancel()
+	c.cancel = nil
+
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			c.d.log().Error("download stopped", "err", err)
+		}
+		return
+	}
+	go c.dm.runPostProcessing(c.d)
+}
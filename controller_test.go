@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestControllerStress(t *testing.T) {
+	data := randomData(t, 2<<20)
+	srv := newThrottledServer(t, data, 4<<20, 64<<20)
+	dm := newTestManager(t)
+	dir := t.TempDir()
+
+	const count = 6
+	var (
+		mu  sync.Mutex
+		ids []int64
+	)
+	added := func() []int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int64(nil), ids...)
+	}
+
+	// several callers add, pause, resume and cancel downloads at random, one
+	// by one and in bulk
+	var wg sync.WaitGroup
+	for caller := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range 60 {
+				current := added()
+				if caller == 0 && op%10 == 0 && len(current) < count {
+					url := fmt.Sprintf("%s/file-%d.bin", srv.URL, len(current))
+					target := filepath.Join(dir, fmt.Sprintf("file-%d.bin", len(current)))
+					if err := dm.AddDownload(url, target, 4, 2); err != nil {
+						t.Errorf("add %s: %v", url, err)
+						return
+					}
+					d, err := dm.getDownload(url, target)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					ids = append(ids, d.ID)
+					mu.Unlock()
+					continue
+				}
+				if len(current) == 0 {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+
+				// transitions refused in the state reached are fine
+				id := current[rand.IntN(len(current))]
+				switch n := rand.IntN(20); {
+				case n == 0:
+					dm.CancelDownload(id)
+				case n == 1:
+					dm.PauseDownloads(BulkSelection{IDs: current})
+				case n == 2:
+					dm.ResumeDownloads(BulkSelection{IDs: current})
+				case n < 10:
+					dm.PauseDownload(id)
+				default:
+					dm.ResumeDownload(id)
+				}
+				time.Sleep(time.Duration(rand.IntN(5)) * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// whatever was not cancelled still finishes once resumed
+	for _, id := range added() {
+		d, err := dm.download(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch d.snapshot().State {
+		case StateCancelled:
+			continue
+		case StatePaused, StateFailed, StateQueued:
+			if err := dm.ResumeDownload(id); err != nil {
+				t.Fatalf("resume %d: %v", id, err)
+			}
+		}
+		waitState(t, d, StateCompleted, 30*time.Second)
+
+		got, err := os.ReadFile(d.snapshot().TargetPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("download %d differs from the served file", id)
+		}
+	}
+
+	// the database agrees with memory on every state
+	for _, id := range added() {
+		d, _ := dm.download(id)
+		var stored DownloadState
+		if err := dm.DB.QueryRow("SELECT state FROM downloads WHERE id=?", id).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if state := d.snapshot().State; stored != state {
+			t.Errorf("download %d is %s in the database, %s in memory", id, stored, state)
+		}
+	}
+
+	// with nothing running, no controller is left behind
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dm.Mutex.Lock()
+		left := len(dm.controllers)
+		dm.Mutex.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d controllers still running", left)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	dbFileName = "downloads.db"
+	// portableMarker next to the executable keeps the data beside it, for
+	// running from a USB stick
+	portableMarker = "portable"
+	lockFileName   = "d4c.lock"
+)
+
+// ErrAlreadyRunning is returned when another instance holds the data
+// directory
+var ErrAlreadyRunning = errors.New("d4c is already running with this data directory")
+
+// resolveDataDir picks the directory the database and logs live in: the
+// override when given, a data directory beside the executable in portable
+// mode, and otherwise d4c in the user's config directory, which follows XDG
+// on Linux
+func resolveDataDir(override string, portable bool) (string, error) {
+	if override != "" {
+		return filepath.Abs(override)
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exeDir := filepath.Dir(exe)
+		if _, statErr := os.Stat(filepath.Join(exeDir, portableMarker)); statErr == nil {
+			portable = true
+		}
+		if portable {
+			return filepath.Join(exeDir, "data"), nil
+		}
+	} else if portable {
+		return "", fmt.Errorf("locating executable for portable mode: %w", err)
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "d4c"), nil
+}
+
+// openDataDir creates dir and takes the lock that keeps other instances out
+// of it. The returned file holds the lock until closed.
+func openDataDir(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyRunning, dir)
+	}
+	return lock, nil
+}
+
+// migrateLegacyDB moves the downloads.db that older versions kept in the
+// working directory, with its journal files, into dir unless dir already has
+// a database
+func migrateLegacyDB(dir string) error {
+	target := filepath.Join(dir, dbFileName)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+
+	legacy, err := filepath.Abs(dbFileName)
+	if err != nil {
+		return err
+	}
+	if legacy == target {
+		return nil
+	}
+	if _, err := os.Stat(legacy); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		err := moveFile(legacy+suffix, target+suffix)
+		if suffix != "" && errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("moving %s to the data directory: %w", legacy+suffix, err)
+		}
+	}
+	logger.Info("moved database to the data directory", "from", legacy, "to", target)
+	return nil
+}
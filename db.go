@@ -44,5 +44,153 @@ func initDB(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("error creatign chunks table: %w", err)
 	}
 
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS settings(
+        key TEXT PRIMARY KEY,
+        value TEXT NOT NULL
+      );
+      `)
+	if err != nil {
+		return nil, fmt.Errorf("error creating settings table: %w", err)
+	}
+
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS post_steps(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        download_id INTEGER NOT NULL,
+        step_index INTEGER NOT NULL,
+        step TEXT NOT NULL,
+        status TEXT NOT NULL,
+        output TEXT NOT NULL,
+        FOREIGN KEY (download_id) REFERENCES downloads (id)
+      );
+      `)
+	if err != nil {
+		return nil, fmt.Errorf("error creating post_steps table: %w", err)
+	}
+
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS download_events(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        download_id INTEGER NOT NULL,
+        time INTEGER NOT NULL,
+        type TEXT NOT NULL,
+        chunk_index INTEGER NOT NULL,
+        message TEXT NOT NULL,
+        status_code INTEGER NOT NULL,
+        retries INTEGER NOT NULL,
+        bytes INTEGER NOT NULL,
+        duration INTEGER NOT NULL,
+        FOREIGN KEY (download_id) REFERENCES downloads (id)
+      );
+      `)
+	if err != nil {
+		return nil, fmt.Errorf("error creating download_events table: %w", err)
+	}
+
+	if err := migrateDB(db); err != nil {
+		return nil, err
+	}
+
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			return nil, fmt.Errorf("error creating index: %w", err)
+		}
+	}
+
 	return db, nil
 }
+
+// indexes for QueryDownloads and loading chunks, created once the migrated
+// columns exist
+var indexes = []string{
+	"CREATE INDEX IF NOT EXISTS idx_chunks_download_id ON chunks (download_id)",
+	"CREATE INDEX IF NOT EXISTS idx_post_steps_download_id ON post_steps (download_id)",
+	"CREATE INDEX IF NOT EXISTS idx_download_events_download_id ON download_events (download_id, id)",
+	"CREATE INDEX IF NOT EXISTS idx_downloads_state ON downloads (state, created_at)",
+	"CREATE INDEX IF NOT EXISTS idx_downloads_category ON downloads (category, created_at)",
+	"CREATE INDEX IF NOT EXISTS idx_downloads_created_at ON downloads (created_at)",
+	"CREATE INDEX IF NOT EXISTS idx_downloads_completed_at ON downloads (completed_at)",
+	"CREATE INDEX IF NOT EXISTS idx_downloads_url_path ON downloads (url, path)",
+}
+
+// columns added after the initial schema, applied to existing databases on startup
+var migrations = []struct {
+	table, column, definition string
+}{
+	{"downloads", "mirrors", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "checksum_type", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "checksum", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "piece_length", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "piece_type", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "piece_hashes", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "kind", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "torrent_info", "BLOB"},
+	{"downloads", "conflict_policy", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "category", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "scheduled", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "start_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "created_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "started_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "completed_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "last_error", "TEXT NOT NULL DEFAULT ''"},
+	{"downloads", "bytes_downloaded", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "average_speed", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "sequential", "INTEGER NOT NULL DEFAULT 0"},
+	{"downloads", "auto", "INTEGER NOT NULL DEFAULT 0"},
+	{"chunks", "url", "TEXT NOT NULL DEFAULT ''"},
+	{"chunks", "key_url", "TEXT NOT NULL DEFAULT ''"},
+	{"chunks", "key_iv", "TEXT NOT NULL DEFAULT ''"},
+	{"chunks", "whole", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// statements filling a column from existing rows, run once when it is added
+var migrationFills = map[string]string{
+	// chunks fetched whole used to be stored with an empty byte range
+	"chunks.whole": "UPDATE chunks SET whole = 1 WHERE end_byte < start_byte",
+}
+
+func migrateDB(db *sql.DB) error {
+	for _, m := range migrations {
+		exists, err := columnExists(db, m.table, m.column)
+		if err != nil {
+			return fmt.Errorf("error inspecting %s table: %w", m.table, err)
+		}
+		if exists {
+			continue
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("error adding column %s.%s: %w", m.table, m.column, err)
+		}
+		if fill, ok := migrationFills[m.table+"."+m.column]; ok {
+			if _, err := db.Exec(fill); err != nil {
+				return fmt.Errorf("error filling column %s.%s: %w", m.table, m.column, err)
+			}
+		}
+	}
+	return nil
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DiagnosticsProbeTimeout bounds the probe made when gathering diagnostics
+var DiagnosticsProbeTimeout = 15 * time.Second
+
+// diagnosticsEventLimit is how many of the latest events diagnostics include
+const diagnosticsEventLimit = 1000
+
+// download event types
+const (
+	EventState      = "state"
+	EventChunkDone  = "chunk_done"
+	EventChunkError = "chunk_error"
+	// EventRace tells which connection finished a chunk raced in endgame
+	EventRace = "race"
+)
+
+// DownloadEvent is one entry in the timeline of a download
+type DownloadEvent struct {
+	ID         int64 `json:"id"`
+	DownloadID int64 `json:"download_id"`
+	// Time is in Unix milliseconds
+	Time int64  `json:"time"`
+	Type string `json:"type"`
+	// Chunk is the chunk index, -1 for events about the whole download
+	Chunk      int    `json:"chunk"`
+	Message    string `json:"message"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Retries    int    `json:"retries,omitempty"`
+	// Bytes and Duration, in milliseconds, measure a chunk's transfer
+	Bytes    int64 `json:"bytes,omitempty"`
+	Duration int64 `json:"duration,omitempty"`
+}
+
+// ProbeDiagnostics describes how the download's URL answers now
+type ProbeDiagnostics struct {
+	URL        string `json:"url"`
+	FinalURL   string `json:"final_url,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	// Protocol is the HTTP version spoken, or the URL scheme for others
+	Protocol   string            `json:"protocol"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// ChunkThroughput sums up the recorded transfers of one chunk
+type ChunkThroughput struct {
+	Index   int           `json:"index"`
+	Size    int64         `json:"size"`
+	Written int64         `json:"written"`
+	State   DownloadState `json:"state"`
+	Bytes   int64         `json:"bytes"`
+	// Duration is in milliseconds, Speed in bytes per second
+	Duration int64 `json:"duration"`
+	Speed    int64 `json:"speed"`
+}
+
+// DownloadDiagnostics gathers what is known about a download for a bug
+// report
+type DownloadDiagnostics struct {
+	DownloadID  int64             `json:"download_id"`
+	URL         string            `json:"url"`
+	Path        string            `json:"path"`
+	Size        int64             `json:"size"`
+	State       DownloadState     `json:"state"`
+	LastError   string            `json:"last_error,omitempty"`
+	GeneratedAt int64             `json:"generated_at"`
+	Probe       *ProbeDiagnostics `json:"probe,omitempty"`
+	Chunks      []ChunkThroughput `json:"chunks"`
+	Events      []DownloadEvent   `json:"events"`
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertEvent(db execer, e *DownloadEvent) error {
+	if e.Time == 0 {
+		e.Time = time.Now().UnixMilli()
+	}
+	_, err := db.Exec("INSERT INTO download_events(download_id,time,type,chunk_index,message,status_code,retries,bytes,duration) VALUES(?,?,?,?,?,?,?,?,?)",
+		e.DownloadID, e.Time, e.Type, e.Chunk, e.Message, e.StatusCode, e.Retries, e.Bytes, e.Duration)
+	return err
+}
+
+// RecordEvent adds an event to the timeline of its download
+func (dm *DownloadManager) RecordEvent(e *DownloadEvent) {
+	if err := insertEvent(dm.DB, e); err != nil {
+		logger.Error("failed to record download event", "download_id", e.DownloadID, "type", e.Type, "err", err)
+	}
+}
+
+// chunkError builds the event for a failed attempt at a chunk
+func (d *Download) chunkError(chunk *ChunkInfo, err error) *DownloadEvent {
+	e := &DownloadEvent{
+		DownloadID: d.ID,
+		Type:       EventChunkError,
+		Chunk:      chunk.Index,
+		Message:    err.Error(),
+		Retries:    chunk.retries,
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		e.StatusCode = statusErr.StatusCode
+	}
+	return e
+}
+
+// Diagnostics returns the timeline and chunk throughput of a download, and
+// probes its URL again for the server's headers, address and protocol
+func (dm *DownloadManager) Diagnostics(id int64) (*DownloadDiagnostics, error) {
+	d, err := dm.download(id)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := d.snapshot()
+
+	diag := &DownloadDiagnostics{
+		DownloadID:  id,
+		URL:         snapshot.URL,
+		Path:        snapshot.TargetPath,
+		Size:        snapshot.TotalSize,
+		State:       snapshot.State,
+		LastError:   snapshot.LastError,
+		GeneratedAt: time.Now().Unix(),
+		Chunks:      []ChunkThroughput{},
+	}
+
+	if diag.Events, err = dm.downloadEvents(id); err != nil {
+		return nil, err
+	}
+
+	type transfer struct{ bytes, duration int64 }
+	transfers := map[int]*transfer{}
+	for _, e := range diag.Events {
+		if e.Type != EventChunkDone {
+			continue
+		}
+		t := transfers[e.Chunk]
+		if t == nil {
+			t = &transfer{}
+			transfers[e.Chunk] = t
+		}
+		t.bytes += e.Bytes
+		t.duration += e.Duration
+	}
+	for _, chunk := range snapshot.Chunks {
+		c := ChunkThroughput{Index: chunk.Index, Size: chunk.Size(), Written: chunk.Written, State: chunk.State}
+		if t := transfers[chunk.Index]; t != nil {
+			c.Bytes, c.Duration = t.bytes, t.duration
+			if t.duration > 0 {
+				c.Speed = t.bytes * 1000 / t.duration
+			}
+		}
+		diag.Chunks = append(diag.Chunks, c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DiagnosticsProbeTimeout)
+	defer cancel()
+	diag.Probe = diagnoseURL(ctx, snapshot.URL)
+	return diag, nil
+}
+
+// downloadEvents returns the latest events of a download, oldest first
+func (dm *DownloadManager) downloadEvents(id int64) ([]DownloadEvent, error) {
+	rows, err := dm.DB.Query(`SELECT id,download_id,time,type,chunk_index,message,status_code,retries,bytes,duration
+		FROM download_events WHERE download_id=? ORDER BY id DESC LIMIT ?`, id, diagnosticsEventLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []DownloadEvent{}
+	for rows.Next() {
+		var e DownloadEvent
+		if err := rows.Scan(&e.ID, &e.DownloadID, &e.Time, &e.Type, &e.Chunk, &e.Message, &e.StatusCode, &e.Retries, &e.Bytes, &e.Duration); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(events)
+	return events, nil
+}
+
+// diagnoseURL probes rawURL, recording the response headers, the address
+// connected to and the HTTP version for HTTP URLs
+func diagnoseURL(ctx context.Context, rawURL string) *ProbeDiagnostics {
+	probe := &ProbeDiagnostics{URL: rawURL}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	probe.Protocol = u.Scheme
+
+	client, err := newHTTPClient()
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		if !isSupportedURL(rawURL) {
+			return probe
+		}
+		result, err := probeURL(ctx, rawURL, client)
+		if err != nil {
+			probe.Error = err.Error()
+		} else {
+			probe.FinalURL = result.FinalURL
+		}
+		return probe
+	}
+
+	// the last connection is the one the final redirect was answered on
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			probe.RemoteAddr = info.Conn.RemoteAddr().String()
+		},
+	})
+
+	res, err := diagnosticRequest(ctx, client, http.MethodHead, rawURL)
+	if err == nil && (res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented) {
+		res.Body.Close()
+		res, err = diagnosticRequest(ctx, client, http.MethodGet, rawURL)
+	}
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	defer res.Body.Close()
+
+	probe.FinalURL = res.Request.URL.String()
+	probe.StatusCode = res.StatusCode
+	probe.Protocol = res.Proto
+	probe.Headers = map[string]string{}
+	for name, values := range res.Header {
+		probe.Headers[name] = strings.Join(values, ", ")
+	}
+	return probe
+}
+
+func diagnosticRequest(ctx context.Context, client *http.Client, method, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	return client.Do(req)
+}
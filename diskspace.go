@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// DiskCheckInterval is how often free space is checked while downloading
+var DiskCheckInterval = 5 * time.Second
+
+// defaultLowSpaceThreshold is the free space, in bytes, below which downloads
+// are paused
+const defaultLowSpaceThreshold = 512 * 1024 * 1024
+
+var ErrInsufficientSpace = errors.New("not enough disk space")
+
+// AutoPauseEvent tells the frontend downloads were paused without the user
+// asking, and why
+type AutoPauseEvent struct {
+	DownloadIDs []int64 `json:"downloadIds"`
+	Reason      string  `json:"reason"`
+	Path        string  `json:"path"`
+	FreeBytes   uint64  `json:"free_bytes"`
+}
+
+// DiskSpaceWarningEvent is sent when a download fits on disk but leaves less
+// free space than the threshold
+type DiskSpaceWarningEvent struct {
+	DownloadID int64  `json:"downloadId"`
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	Required   int64  `json:"required"`
+}
+
+func (dm *DownloadManager) LowSpaceThreshold() (int64, error) {
+	value, err := dm.Setting("low_space_threshold", strconv.Itoa(defaultLowSpaceThreshold))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (dm *DownloadManager) SetLowSpaceThreshold(bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("invalid threshold %d", bytes)
+	}
+	return dm.SetSetting("low_space_threshold", strconv.FormatInt(bytes, 10))
+}
+
+// requiredSpace is what d still needs on disk: the bytes left to download
+// plus a full copy of the file, since combining writes the target while the
+// parts still exist
+func (d *Download) requiredSpace() int64 {
+	if d.TotalSize <= 0 {
+		return 0
+	}
+
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	required := d.TotalSize
+	for _, chunk := range d.Chunks {
+		if size := chunk.Size(); size > 0 && chunk.State != StateCompleted {
+			required += max(size-chunk.Written, 0)
+		}
+	}
+	if d.Auto {
+		// the part of auto downloads not cut into chunks yet
+		required += d.TotalSize - d.carvedEnd()
+	}
+	return required
+}
+
+// checkDiskSpace refuses to start d when its volume can't hold it, and warns
+// when it would leave less than the low space threshold
+func (dm *DownloadManager) checkDiskSpace(d *Download) error {
+	required := d.requiredSpace()
+	if required == 0 {
+		return nil
+	}
+
+	d.Mutex.Lock()
+	dir := filepath.Dir(d.TargetPath)
+	d.Mutex.Unlock()
+	free, err := freeSpace(dir)
+	if err != nil {
+		// don't block downloads on filesystems we can't query
+		d.log().Warn("failed to check free space", "dir", dir, "err", err)
+		return nil
+	}
+
+	if uint64(required) > free {
+		return fmt.Errorf("%w on %s: %d bytes needed, %d available", ErrInsufficientSpace, dir, required, free)
+	}
+
+	threshold, err := dm.LowSpaceThreshold()
+	if err != nil {
+		return err
+	}
+	if free-uint64(required) < uint64(threshold) && dm.appCtx != nil {
+		runtime.EventsEmit(dm.appCtx, "diskSpaceWarning", DiskSpaceWarningEvent{
+			DownloadID: d.ID,
+			Path:       dir,
+			FreeBytes:  free,
+			Required:   required,
+		})
+	}
+	return nil
+}
+
+// refuseWithoutSpace leaves d paused when its volume can't hold it
+func (dm *DownloadManager) refuseWithoutSpace(d *Download) error {
+	err := dm.checkDiskSpace(d)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		return err
+	}
+
+	if stateErr := dm.Transition(d, StatePaused); stateErr != nil {
+		d.log().Error("failed to pause download", "err", stateErr)
+	}
+	return err
+}
+
+// monitorDiskSpace pauses every active download on a volume once its free
+// space drops below the threshold
+func (dm *DownloadManager) monitorDiskSpace(ctx context.Context) {
+	ticker := time.NewTicker(DiskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dm.checkVolumes()
+		}
+	}
+}
+
+func (dm *DownloadManager) checkVolumes() {
+	threshold, err := dm.LowSpaceThreshold()
+	if err != nil {
+		logger.Error("failed to read low space threshold", "err", err)
+		return
+	}
+
+	// group active downloads by the volume they write to
+	type volume struct {
+		dir string
+		ids []int64
+	}
+	volumes := map[string]*volume{}
+
+	dm.Mutex.Lock()
+	for id, d := range dm.Downloads {
+		d.Mutex.Lock()
+		state, path := d.State, d.TargetPath
+		d.Mutex.Unlock()
+		if state != StateActive {
+			continue
+		}
+		dir := filepath.Dir(path)
+		key, err := volumeID(dir)
+		if err != nil {
+			continue
+		}
+		if volumes[key] == nil {
+			volumes[key] = &volume{dir: dir}
+		}
+		volumes[key].ids = append(volumes[key].ids, id)
+	}
+	dm.Mutex.Unlock()
+
+	for _, v := range volumes {
+		free, err := freeSpace(v.dir)
+		if err != nil || free >= uint64(threshold) {
+			continue
+		}
+
+		logger.Warn("low disk space, pausing downloads", "dir", v.dir, "free", free, "downloads", len(v.ids))
+		var paused []int64
+		for _, id := range v.ids {
+			if err := dm.PauseDownload(id); err != nil {
+				logger.Error("failed to pause download", "download_id", id, "err", err)
+				continue
+			}
+			paused = append(paused, id)
+		}
+
+		if dm.appCtx != nil && len(paused) > 0 {
+			runtime.EventsEmit(dm.appCtx, "downloadsAutoPaused", AutoPauseEvent{
+				DownloadIDs: paused,
+				Reason:      fmt.Sprintf("Low disk space: %d MiB free on %s", free/(1024*1024), v.dir),
+				Path:        v.dir,
+				FreeBytes:   free,
+			})
+		}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the bytes available to the user on the filesystem of path
+func freeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// volumeID identifies the filesystem path is on
+func volumeID(path string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(uint64(stat.Dev), 10), nil
+}
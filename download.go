@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,32 +17,116 @@ import (
 
 type DownloadState int
 
+// the values are stored in the database, new states go at the end
 const (
 	StateActive DownloadState = iota
 	StatePaused
 	StateCancelled
 	StateCompleted
+	// StateQueued waits to be started, by the user or the scheduler
+	StateQueued
+	// StateProbing looks up the source before chunks can be fetched
+	StateProbing
+	// StateVerifying checks the combined file against its checksum
+	StateVerifying
+	// StateCombining joins the finished chunks into the target file
+	StateCombining
+	// StateFailed stopped on an error, kept in LastError
+	StateFailed
 )
 
+func (s DownloadState) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StatePaused:
+		return "paused"
+	case StateCancelled:
+		return "cancelled"
+	case StateCompleted:
+		return "completed"
+	case StateQueued:
+		return "queued"
+	case StateProbing:
+		return "probing"
+	case StateVerifying:
+		return "verifying"
+	case StateCombining:
+		return "combining"
+	case StateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("DownloadState(%d)", int(s))
+}
+
 type Download struct {
-	ID              int64           `json:"id"`
-	URL             string          `json:"url"`
-	TargetPath      string          `json:"path"`
-	TotalSize       int64           `json:"size"`
-	ChunkCount      int             `json:"chunks"`
-	Chunks          []*ChunkInfo    `json:"chunk_info"`
-	State           DownloadState   `json:"state"`
-	Mutex           sync.Mutex      `json:"-" `
-	WaitGroup       sync.WaitGroup  `json:"-"`
-	Client          *http.Client    `json:"-"`
-	CompletedChunks int64           `json:"completed_chunks"`
-	WorkersCount    int             `json:"workers"`
-	ChunkWriter     ChunkWriter     `json:"-"`
-	WorkerChannel   chan *ChunkInfo `json:"-"`
-	lastUpdate      time.Time       `json:"-"`
-	updateMutex     sync.Mutex      `json:"-"`
+	ID              int64             `json:"id"`
+	URL             string            `json:"url"`
+	TargetPath      string            `json:"path"`
+	TotalSize       int64             `json:"size"`
+	ChunkCount      int               `json:"chunks"`
+	Chunks          []*ChunkInfo      `json:"chunk_info"`
+	State           DownloadState     `json:"state"`
+	Mutex           sync.Mutex        `json:"-" `
+	Client          *http.Client      `json:"-"`
+	CompletedChunks int64             `json:"completed_chunks"`
+	WorkersCount    int               `json:"workers"`
+	ChunkWriter     ChunkWriter       `json:"-"`
+	lastUpdate      time.Time         `json:"-"`
+	updateMutex     sync.Mutex        `json:"-"`
+	Mirrors         []string          `json:"mirrors,omitempty"`
+	ChecksumType    string            `json:"checksum_type,omitempty"`
+	Checksum        string            `json:"checksum,omitempty"`
+	PieceLength     int64             `json:"piece_length,omitempty"`
+	PieceType       string            `json:"-"`
+	PieceHashes     []string          `json:"-"`
+	Kind            DownloadKind      `json:"kind,omitempty"`
+	TorrentInfo     []byte            `json:"-"`
+	ConflictPolicy  ConflictPolicy    `json:"conflict_policy,omitempty"`
+	PostSteps       []*PostStepResult `json:"post_steps,omitempty"`
+	Category        string            `json:"category,omitempty"`
+	Scheduled       bool              `json:"scheduled"`
+	StartAt         int64             `json:"start_at,omitempty"`
+	CreatedAt       int64             `json:"created_at"`
+	StartedAt       int64             `json:"started_at"`
+	CompletedAt     int64             `json:"completed_at"`
+	LastError       string            `json:"last_error,omitempty"`
+	BytesDownloaded int64             `json:"bytes_downloaded"`
+	AverageSpeed    int64             `json:"average_speed"`
+	Sequential      bool              `json:"sequential"`
+	Auto            bool              `json:"auto"`
+	runStart        time.Time         `json:"-"`
+	runBytes        int64             `json:"-"`
+	mediaKeys       map[string][]byte `json:"-"`
+	// progress is closed when more is written, waking waiting streams
+	progress chan struct{}
+	// seek tells the running feeder that streamAt or Sequential changed
+	seek chan struct{}
+	// streamAt is the offset the latest waiting stream read needs
+	streamAt int64
+	// runs are the chunk transfers of workers, by chunk index
+	runs map[int]*chunkRun
+	// pool runs the workers while the download runs
+	pool *workerPool
+	// unranged is set when adding a download whose server ignores ranges
+	unranged bool
+	// quiet drops the chunk updates of a run a bulk operation stops, whose
+	// one event stands for them
+	quiet atomic.Bool
 }
 
+// DownloadKind tells how a download's chunks map onto the target file
+type DownloadKind string
+
+const (
+	// KindFile splits a single remote file into byte ranges
+	KindFile DownloadKind = ""
+	// KindMedia downloads the segments of a HLS or DASH stream, one per chunk
+	KindMedia DownloadKind = "media"
+	// KindTorrent downloads the pieces of a torrent, grouped into chunks
+	KindTorrent DownloadKind = "torrent"
+)
+
 type ChunkInfo struct {
 	ID        int64         `json:"id"`
 	StartByte int64         `json:"start_byte"`
@@ -49,6 +134,23 @@ type ChunkInfo struct {
 	Written   int64         `json:"written"`
 	Index     int           `json:"index"`
 	State     DownloadState `json:"state"`
+	URL       string        `json:"url,omitempty"`
+	KeyURL    string        `json:"-"`
+	KeyIV     string        `json:"-"`
+	// Whole marks a chunk fetched in one request whose length is unknown
+	// until downloaded: a file of unknown size or a media segment without a
+	// byte range
+	Whole   bool `json:"whole,omitempty"`
+	retries int
+}
+
+// Size returns the length of the chunk's byte range, or -1 for chunks
+// fetched whole
+func (c *ChunkInfo) Size() int64 {
+	if c.Whole {
+		return -1
+	}
+	return c.EndByte - c.StartByte + 1
 }
 
 type DownloadUpdateEvent struct {
@@ -67,7 +169,7 @@ type ChunkUpdateEvent struct {
 
 var UpdateFrequency = 200 * time.Millisecond
 
-func (d *Download) Initialize() error {
+func newHTTPClient() (*http.Client, error) {
 	transport := &http.Transport{
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
@@ -76,63 +178,108 @@ func (d *Download) Initialize() error {
 	}
 
 	if err := http2.ConfigureTransport(transport); err != nil {
-		return fmt.Errorf("failed to configure HTTP/2: %w", err)
+		return nil, fmt.Errorf("failed to configure HTTP/2: %w", err)
 	}
 
-	d.Client = &http.Client{
+	return &http.Client{
 		Transport: transport,
+	}, nil
+}
+
+func (d *Download) Initialize() error {
+	client, err := newHTTPClient()
+	if err != nil {
+		return err
 	}
+	d.Client = client
 
-	d.WorkersCount = min(d.WorkersCount, d.ChunkCount)
+	// auto downloads cut more chunks than they have so far
+	if !d.Auto {
+		d.WorkersCount = min(d.WorkersCount, d.ChunkCount)
+	}
 	d.lastUpdate = time.Now()
 	return nil
 }
 
 func NewDownload(url, targetPath string, chunks, workers int) (*Download, error) {
-	transport := &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		DisableKeepAlives:   false,
-		IdleConnTimeout:     90 * time.Second,
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
 	}
 
-	if err := http2.ConfigureTransport(transport); err != nil {
-		panic("failed to configure HTTP/2" + err.Error())
+	probe, err := probeURL(context.Background(), url, client)
+	if err != nil {
+		return nil, err
 	}
+	return newProbedDownload(client, url, targetPath, probe, chunks, workers)
+}
 
-	client := &http.Client{
-		Transport: transport,
+// namesDirectory reports whether path is a directory, existing or ending in
+// a separator, which lets the server name the file
+func namesDirectory(path string) bool {
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator)) {
+		return true
 	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
 
-	res, err := client.Head(url)
-	if err != nil {
-		return nil, fmt.Errorf("error getting file info: %v\n", err)
+// newProbedDownload builds a download from what probing its URL found
+func newProbedDownload(client *http.Client, url, targetPath string, probe *ProbeResult, chunks, workers int) (*Download, error) {
+	if namesDirectory(targetPath) {
+		targetPath = filepath.Join(targetPath, probe.FileName)
+	}
+
+	// without a known size or ranges the file can only be fetched whole
+	if probe.Size < 0 || !probe.AcceptsRanges {
+		chunks = 1
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("download is not available: %v\n", res.StatusCode)
+	d, err := newSizedDownload(client, url, targetPath, probe.Size, chunks, workers, 0)
+	if err != nil {
+		return nil, err
 	}
+	d.unranged = !probe.AcceptsRanges
+	return d, nil
+}
 
-	size := res.ContentLength
+// newSizedDownload builds a download whose size is already known. When align
+// is positive every chunk boundary falls on a multiple of it.
+func newSizedDownload(client *http.Client, url, targetPath string, size int64, chunks, workers int, align int64) (*Download, error) {
 	targetDir := filepath.Dir(targetPath)
 	if err := os.MkdirAll(targetDir, 0700); err != nil {
-		return nil, fmt.Errorf("failed to create target directory: %v\n", err)
+		return nil, fmt.Errorf("failed to create target directory: %v", err)
 	}
 
 	download := &Download{
-		URL:           url,
-		TargetPath:    targetPath,
-		TotalSize:     size,
-		ChunkCount:    chunks,
-		State:         StateActive,
-		Client:        client,
-		WorkersCount:  min(workers, chunks),
-		WorkerChannel: make(chan *ChunkInfo, min(workers, chunks)),
+		URL:        url,
+		TargetPath: targetPath,
+		TotalSize:  size,
+		State:      StateQueued,
+		Client:     client,
+		Chunks:     splitChunks(size, chunks, align),
 	}
+	download.ChunkCount = len(download.Chunks)
+	download.WorkersCount = min(workers, download.ChunkCount)
+
+	return download, nil
+}
 
+func splitChunks(size int64, chunks int, align int64) []*ChunkInfo {
+	if size < 0 {
+		return []*ChunkInfo{{EndByte: -1, Whole: true, State: StateActive}}
+	}
+	// every chunk holds at least one byte
+	if int64(chunks) > size {
+		chunks = max(int(size), 1)
+	}
 	chunkSize := size / int64(chunks)
+	if align > 0 {
+		chunkSize = max(align, chunkSize/align*align)
+		chunks = min(chunks, int((size+chunkSize-1)/chunkSize))
+	}
 
+	var result []*ChunkInfo
 	for i := range chunks {
 		start := chunkSize * int64(i)
 		end := start + chunkSize - 1
@@ -141,7 +288,7 @@ func NewDownload(url, targetPath string, chunks, workers int) (*Download, error)
 			end = size - 1
 		}
 
-		download.Chunks = append(download.Chunks, &ChunkInfo{
+		result = append(result, &ChunkInfo{
 			StartByte: start,
 			EndByte:   end,
 			Written:   0,
@@ -149,35 +296,151 @@ func NewDownload(url, targetPath string, chunks, workers int) (*Download, error)
 			State:     StateActive,
 		})
 	}
+	return result
+}
 
-	return download, nil
+// safeJoin resolves a file name supplied by a server or document inside
+// dir. Names may contain subdirectories but must not escape dir.
+func safeJoin(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("unsafe file name %q", name)
+	}
+	return target, nil
+}
+
+func (d *Download) partPath(chunk *ChunkInfo) string {
+	return fmt.Sprintf("%s.part-%d", d.TargetPath, chunk.Index)
+}
+
+// sources lists every URL the file can be fetched from, the primary URL first
+func (d *Download) sources() []string {
+	if len(d.Mirrors) > 0 {
+		return d.Mirrors
+	}
+	return []string{d.URL}
 }
 
+// sourceURL spreads chunks across mirrors and moves a chunk to the next
+// mirror each time it is retried
+func (d *Download) sourceURL(chunk *ChunkInfo) string {
+	if chunk.URL != "" {
+		return chunk.URL
+	}
+	sources := d.sources()
+	return sources[(chunk.Index+chunk.retries)%len(sources)]
+}
+
+// snapshot copies what the frontend is shown of d, which running workers
+// keep changing
+func (d *Download) snapshot() *Download {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	chunks := make([]*ChunkInfo, len(d.Chunks))
+	for i, chunk := range d.Chunks {
+		c := *chunk
+		chunks[i] = &c
+	}
+	var steps []*PostStepResult
+	for _, step := range d.PostSteps {
+		s := *step
+		steps = append(steps, &s)
+	}
+	return &Download{
+		ID:              d.ID,
+		URL:             d.URL,
+		TargetPath:      d.TargetPath,
+		TotalSize:       d.TotalSize,
+		ChunkCount:      d.ChunkCount,
+		Chunks:          chunks,
+		State:           d.State,
+		CompletedChunks: atomic.LoadInt64(&d.CompletedChunks),
+		WorkersCount:    d.WorkersCount,
+		Mirrors:         d.Mirrors,
+		ChecksumType:    d.ChecksumType,
+		Checksum:        d.Checksum,
+		PieceLength:     d.PieceLength,
+		Kind:            d.Kind,
+		ConflictPolicy:  d.ConflictPolicy,
+		PostSteps:       steps,
+		Category:        d.Category,
+		Scheduled:       d.Scheduled,
+		StartAt:         d.StartAt,
+		CreatedAt:       d.CreatedAt,
+		StartedAt:       d.StartedAt,
+		CompletedAt:     d.CompletedAt,
+		LastError:       d.LastError,
+		BytesDownloaded: d.BytesDownloaded,
+		AverageSpeed:    d.AverageSpeed,
+		Sequential:      d.Sequential,
+		Auto:            d.Auto,
+	}
+}
+
+// setWritten records the progress of chunk, which the chunk's worker owns
+// but transitions read
+func (d *Download) setWritten(chunk *ChunkInfo, written int64) {
+	d.Mutex.Lock()
+	chunk.Written = written
+	d.Mutex.Unlock()
+}
+
+// completeChunk marks chunk completed, storing and reporting it
+func (d *Download) completeChunk(chunk *ChunkInfo) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	if chunk.State != StateCompleted {
+		chunk.State = StateCompleted
+		atomic.AddInt64(&d.CompletedChunks, 1)
+	}
+	d.signalProgress()
+	if d.ChunkWriter != nil {
+		err := d.ChunkWriter.UpdateChunkState(chunk)
+		if err != nil {
+			d.chunkLog(chunk).Error("failed to update chunk state in DB", "err", err)
+		}
+		d.notify(chunk)
+	}
+}
+
+// DownloadChunk fetches the rest of chunk into its part file. Only one
+// worker handles a chunk at a time; the chunk's state and progress are
+// changed under d.Mutex since transitions read and write them too.
 func (d *Download) DownloadChunk(ctx context.Context, chunk *ChunkInfo) error {
-	if chunk.State == StateCompleted {
+	d.Mutex.Lock()
+	completed := chunk.State == StateCompleted
+	d.Mutex.Unlock()
+	if completed {
 		return nil
 	}
-	partPath := fmt.Sprintf("%s.part-%d", d.TargetPath, chunk.Index)
+	partPath := d.partPath(chunk)
 
 	if info, err := os.Stat(partPath); err == nil {
-		chunk.Written = info.Size()
+		d.setWritten(chunk, info.Size())
 	}
 
-	if chunk.Written >= (chunk.EndByte - chunk.StartByte + 1) {
-		d.Mutex.Lock()
-		if chunk.State != StateCompleted {
-			chunk.State = StateCompleted
-			atomic.AddInt64(&d.CompletedChunks, 1)
+	// a segment of unknown length can't be resumed, fetch it again whole
+	if chunk.Size() < 0 && chunk.Written > 0 {
+		if err := os.Truncate(partPath, 0); err != nil {
+			return err
 		}
-		d.Mutex.Unlock()
-		if d.ChunkWriter != nil {
-			err := d.ChunkWriter.UpdateChunkState(chunk)
-			if err != nil {
-				fmt.Printf("Failed to update chunk state in DB: %v\n", err)
+		d.setWritten(chunk, 0)
+	}
+
+	if size := chunk.Size(); size >= 0 && chunk.Written >= size {
+		if err := d.verifyChunk(chunk); err != nil {
+			d.chunkLog(chunk).Warn("chunk failed verification, downloading again", "err", err)
+			if err := os.Truncate(partPath, 0); err != nil {
+				return err
 			}
-			d.notify(chunk)
+			d.setWritten(chunk, 0)
+		} else {
+			d.completeChunk(chunk)
+			return nil
 		}
-		return nil
 	}
 
 	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
@@ -186,7 +449,8 @@ func (d *Download) DownloadChunk(ctx context.Context, chunk *ChunkInfo) error {
 	}
 	defer file.Close()
 
-	req, err := http.NewRequest("GET", d.URL, nil)
+	source := d.sourceURL(chunk)
+	proto, err := protocolFor(source, d.Client)
 	if err != nil {
 		return err
 	}
@@ -195,65 +459,83 @@ func (d *Download) DownloadChunk(ctx context.Context, chunk *ChunkInfo) error {
 		return err
 	}
 
-	start := chunk.StartByte + chunk.Written
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, chunk.EndByte))
-	req.Close = true
-
+	offset := chunk.Written
+	start := chunk.StartByte + offset
+	end := chunk.EndByte
+	if chunk.Size() < 0 {
+		end = -1
+	}
 	startTime := time.Now()
 
-	res, err := d.Client.Do(req)
+	body, err := proto.OpenRange(ctx, source, start, end)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusPartialContent && res.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status %d\n", res.StatusCode)
-	}
+	defer body.Close()
 
 	buffer := make([]byte, 128*1024)
 	for {
 		select {
 		case <-ctx.Done():
+			// the transition that stopped the run set the chunk's state
 			d.Mutex.Lock()
-			chunk.State = StatePaused
-			d.Mutex.Unlock()
 			if d.ChunkWriter != nil {
 				_ = d.ChunkWriter.UpdateChunkState(chunk)
 				d.notify(chunk)
 			}
-			return fmt.Errorf("download canceled for chunk %v\n", chunk.Index)
+			d.Mutex.Unlock()
+			return fmt.Errorf("chunk %v: %w", chunk.Index, ctx.Err())
 		default:
-			n, readErr := res.Body.Read(buffer)
+			n, readErr := body.Read(buffer)
 			if n > 0 {
 				if _, writeErr := file.Write(buffer[:n]); writeErr != nil {
 					return writeErr
 				}
 				d.Mutex.Lock()
 				chunk.Written += int64(n)
+				d.BytesDownloaded += int64(n)
+				d.signalProgress()
 				if d.ChunkWriter != nil {
 					_ = d.ChunkWriter.UpdateChunkState(chunk)
 					d.notify(chunk)
 				}
 				d.Mutex.Unlock()
+
+				// a cancelled wait is handled at the top of the loop
+				if d.ChunkWriter != nil {
+					_ = d.ChunkWriter.WaitBandwidth(ctx, n)
+				}
 			}
 			if readErr != nil {
 				if readErr == io.EOF {
-					d.Mutex.Lock()
-					if chunk.State != StateCompleted {
-						chunk.State = StateCompleted
-						atomic.AddInt64(&d.CompletedChunks, 1)
-					}
-					if d.ChunkWriter != nil {
-						err := d.ChunkWriter.UpdateChunkState(chunk)
-						if err != nil {
-							fmt.Printf("Failed to update chunk state in DB: %v\n", err)
+					if err := d.verifyChunk(chunk); err != nil {
+						if truncErr := file.Truncate(0); truncErr != nil {
+							return truncErr
 						}
-						d.notify(chunk)
+						d.Mutex.Lock()
+						chunk.Written = 0
+						if d.ChunkWriter != nil {
+							_ = d.ChunkWriter.UpdateChunkState(chunk)
+						}
+						d.Mutex.Unlock()
+						return err
 					}
-					d.Mutex.Unlock()
 
-					fmt.Printf("Chunk %v downloaded in %v \n", chunk.Index, time.Since(startTime))
+					d.completeChunk(chunk)
+
+					elapsed := time.Since(startTime)
+					if d.ChunkWriter != nil {
+						d.ChunkWriter.RecordEvent(&DownloadEvent{
+							DownloadID: d.ID,
+							Type:       EventChunkDone,
+							Chunk:      chunk.Index,
+							Message:    "chunk downloaded",
+							Retries:    chunk.retries,
+							Bytes:      chunk.Written - offset,
+							Duration:   elapsed.Milliseconds(),
+						})
+					}
+					d.chunkLog(chunk).Debug("chunk downloaded", "duration", elapsed)
 					return nil
 				}
 				return readErr
@@ -262,156 +544,203 @@ func (d *Download) DownloadChunk(ctx context.Context, chunk *ChunkInfo) error {
 	}
 }
 
-func (d *Download) Pause() {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+func (d *Download) Start(ctx context.Context) error {
+	startTime := time.Now()
 
-	if d.State == StateActive {
-		d.State = StatePaused
-		for _, chunk := range d.Chunks {
-			if chunk.State == StateActive {
-				chunk.State = StatePaused
-				if d.ChunkWriter != nil {
-					err := d.ChunkWriter.UpdateChunkState(chunk)
-					if err != nil {
-						fmt.Printf("Failed to update chunk state in DB: %v\n", err)
-					}
-					d.notify(chunk)
-				}
-			}
+	if d.Kind == KindTorrent {
+		// finding peers and the metadata may take a while
+		if err := d.ChunkWriter.Transition(d, StateProbing); err != nil {
+			return err
+		}
+		release, err := d.joinSwarm()
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := d.ChunkWriter.Transition(d, StateActive); err != nil {
+			return err
 		}
-		fmt.Println("Download paused")
 	}
 
-	d.ChunkWriter.NotifyDownloadUpdate(d.ID, StatePaused)
-	d.State = StatePaused
-}
-
-func (d *Download) Resume() {
 	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-
-	if d.State == StatePaused {
-		d.State = StateActive
-		for _, chunk := range d.Chunks {
-			if chunk.State == StatePaused {
-				chunk.State = StateActive
-				if d.ChunkWriter != nil {
-					err := d.ChunkWriter.UpdateChunkState(chunk)
-					if err != nil {
-						fmt.Printf("Failed to update chunk state in DB: %v\n", err)
-					}
-					d.notify(chunk)
-				}
-			}
+	var pending []*ChunkInfo
+	for _, chunk := range d.Chunks {
+		if chunk.State != StateCompleted {
+			pending = append(pending, chunk)
 		}
-
-		d.WaitGroup = sync.WaitGroup{}
-		d.WorkerChannel = make(chan *ChunkInfo, d.WorkersCount)
-		d.State = StateActive
-		d.ChunkWriter.NotifyDownloadUpdate(d.ID, StateActive)
-
-		// go func() {
-		// 	if err := d.Start(ctx); err != nil {
-		// 		fmt.Printf("Resume failed: %v\n", err)
-		// 	}
-		// }()
 	}
-}
-
-func (d *Download) Cancel() {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+	seek := make(chan struct{}, 1)
+	d.seek = seek
+	workers, auto := d.WorkersCount, d.Auto
+	d.Mutex.Unlock()
+	defer func() {
+		d.Mutex.Lock()
+		d.seek = nil
+		d.Mutex.Unlock()
+	}()
 
-	d.State = StateCancelled
-	for _, chunk := range d.Chunks {
-		chunk.State = StateCancelled
-		if d.ChunkWriter != nil {
-			err := d.ChunkWriter.UpdateChunkState(chunk)
+	// the channel and workers belong to this run, a later run makes its own
+	pool := newWorkerPool(ctx, d, workers)
+	stopTuning := make(chan struct{})
+	tuned := make(chan struct{})
+	if auto {
+		go func() {
+			defer close(tuned)
+			pool.tune(stopTuning)
+		}()
+	} else {
+		close(tuned)
+	}
+
+	// auto downloads cut their next chunk once the ones left are handed
+	// out. Sequential downloads pick again when a stream seeks while
+	// waiting for a free worker.
+	var feedErr error
+feed:
+	for {
+		if len(pending) == 0 {
+			if !auto {
+				break
+			}
+			chunk, err := d.carveChunk(pool.chunkSize())
 			if err != nil {
-				fmt.Printf("Failed to update chunk state in DB: %v\n", err)
+				feedErr = err
+				break
 			}
-			d.notify(chunk)
+			if chunk == nil {
+				break
+			}
+			pending = append(pending, chunk)
 		}
-	}
-	d.ChunkWriter.NotifyDownloadUpdate(d.ID, StateCancelled)
-	fmt.Println("Download cancelled")
-}
 
-func (d *Download) Start(ctx context.Context) error {
-	d.ChunkWriter.NotifyDownloadUpdate(d.ID, StateActive)
+		i := d.nextChunk(pending)
+		select {
+		case pool.chunks <- pending[i]:
+			pending = append(pending[:i], pending[i+1:]...)
+		case <-seek:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	// the pool is resized by the tuner only until here
+	close(stopTuning)
+	<-tuned
+	close(pool.chunks)
 
-	startTime := time.Now()
+	// the last chunks may be raced on second connections
+	workersDone := make(chan struct{})
+	go func() {
+		pool.wait()
+		close(workersDone)
+	}()
+	var races sync.WaitGroup
+	if ctx.Err() == nil {
+		d.endgame(ctx, workersDone, &races)
+	}
+	<-workersDone
+	races.Wait()
 
-	if d.WorkerChannel == nil {
-		d.WorkerChannel = make(chan *ChunkInfo, d.WorkersCount)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("download %d stopped: %w", d.ID, err)
 	}
-	d.WaitGroup = sync.WaitGroup{}
-	for i := 0; i < d.WorkersCount; i++ {
-		go d.worker(ctx)
+	if feedErr != nil {
+		return feedErr
 	}
 
-	for _, chunk := range d.Chunks {
-		if chunk.State == StateCompleted {
-			continue
-		}
-		d.WorkerChannel <- chunk
+	completed := atomic.LoadInt64(&d.CompletedChunks)
+	d.log().Info("chunks finished", "completed", completed, "chunks", d.ChunkCount)
+
+	if int64(d.ChunkCount) != completed {
+		return fmt.Errorf("not all chunks completed successfully")
+	}
+	d.Mutex.Lock()
+	covered := d.carvedEnd()
+	d.Mutex.Unlock()
+	if d.Kind == KindFile && d.TotalSize > 0 && covered != d.TotalSize {
+		return fmt.Errorf("chunks cover %d of %d bytes", covered, d.TotalSize)
 	}
-	close(d.WorkerChannel)
 
-	done := make(chan struct{})
-	go func() {
-		d.WaitGroup.Wait()
-		close(done)
-	}()
+	// the target may have appeared while downloading
+	target, outcome, err := d.ChunkWriter.ResolveConflict(ctx, d, d.TargetPath)
+	if err != nil {
+		return fmt.Errorf("error resolving file conflict: %w", err)
+	}
+	if outcome == conflictSkip {
+		return fmt.Errorf("%w: %s", ErrTargetExists, target)
+	}
 
-	select {
-	case <-done:
-		if d.State == StateCancelled {
-			return fmt.Errorf("download cancelled")
+	if outcome != conflictExisting {
+		if err := d.ChunkWriter.Transition(d, StateCombining); err != nil {
+			return err
 		}
-
-		fmt.Printf("Chunks completed: %d / %d\n", d.CompletedChunks, d.ChunkCount)
-
-		if int64(d.ChunkCount) != d.CompletedChunks {
-			return fmt.Errorf("not all chunks completed successfully")
+		if err := d.combineChunks(ctx, target); err != nil {
+			return fmt.Errorf("error combining chunks: %w", err)
 		}
-
-		if err := d.combineChunks(); err != nil {
-			fmt.Printf("Total download time: %v\n", time.Since(startTime))
-			return fmt.Errorf("error combining chunks: %w\n", err)
+		if d.Checksum != "" {
+			if err := d.ChunkWriter.Transition(d, StateVerifying); err != nil {
+				return err
+			}
+			if err := verifyFile(target, d.ChecksumType, d.Checksum); err != nil {
+				return fmt.Errorf("error verifying download: %w", err)
+			}
 		}
-		d.State = StateCompleted
-		d.ChunkWriter.NotifyDownloadUpdate(d.ID, StateCompleted)
-		d.cleanup()
-
-		fmt.Println("Download Complete !!")
-		fmt.Printf("Total download time: %v\n", time.Since(startTime))
-		return nil
-	case <-ctx.Done():
-		close(d.WorkerChannel)
-		d.WaitGroup.Wait()
-		return fmt.Errorf("Download Canceled")
 	}
+	if err := d.ChunkWriter.Transition(d, StateCompleted); err != nil {
+		return err
+	}
+	d.cleanup()
+	if target != d.TargetPath {
+		d.Mutex.Lock()
+		d.TargetPath = target
+		d.Mutex.Unlock()
+		if err := d.ChunkWriter.UpdateDownloadPath(d.ID, target); err != nil {
+			d.log().Error("failed to update download path in DB", "path", target, "err", err)
+		}
+	}
+
+	d.log().Info("download complete", "path", target, "duration", time.Since(startTime))
+	return nil
 }
 
-func (d *Download) worker(ctx context.Context) {
-	d.WaitGroup.Add(1)
-	defer d.WaitGroup.Done()
+// worker downloads the chunks it receives until chunks is closed, ctx is
+// done or retire tells it the pool shrank
+func (d *Download) worker(ctx context.Context, chunks <-chan *ChunkInfo, retire func() bool) {
 	for {
+		if retire() {
+			return
+		}
 		select {
 		case <-ctx.Done():
 			return
-		case chunk, ok := <-d.WorkerChannel:
+		case chunk, ok := <-chunks:
 			if !ok {
 				return
 			}
-			err := d.DownloadChunk(ctx, chunk)
+			// a second connection racing the chunk may stop the transfer
+			chunkCtx, run := d.beginRun(ctx, chunk)
+			err := d.DownloadChunk(chunkCtx, chunk)
+			if err != nil && chunkCtx.Err() == nil {
+				d.ChunkWriter.RecordEvent(d.chunkError(chunk, err))
+			}
+			for err != nil && chunkCtx.Err() == nil && chunk.retries+1 < len(d.sources()) {
+				// snapshots copy the chunk under the lock
+				d.Mutex.Lock()
+				chunk.retries++
+				d.Mutex.Unlock()
+				d.chunkLog(chunk).Warn("retrying chunk from next mirror", "err", err)
+				err = d.DownloadChunk(chunkCtx, chunk)
+				if err != nil && chunkCtx.Err() == nil {
+					d.ChunkWriter.RecordEvent(d.chunkError(chunk, err))
+				}
+			}
+			d.endRun(chunk, run, err)
 			if err != nil {
 				if ctx.Err() != nil {
-					fmt.Printf("Download cancelled while processing: %v\n", err)
+					d.chunkLog(chunk).Debug("chunk stopped", "err", err)
+				} else if chunkCtx.Err() != nil {
+					d.chunkLog(chunk).Debug("chunk finished by second connection")
 				} else {
-					fmt.Printf("Error downloading chunk %d: %v\n", chunk.Index, err)
+					d.chunkLog(chunk).Error("chunk failed", "err", err)
 				}
 			}
 		}
@@ -419,6 +748,9 @@ func (d *Download) worker(ctx context.Context) {
 }
 
 func (d *Download) notify(chunk *ChunkInfo) {
+	if d.quiet.Load() {
+		return
+	}
 	d.updateMutex.Lock()
 	defer d.updateMutex.Unlock()
 
@@ -429,36 +761,68 @@ func (d *Download) notify(chunk *ChunkInfo) {
 	}
 }
 
-func (d *Download) combineChunks() error {
-	fmt.Println("Combining Chunks !!")
-	targetFile, err := os.Create(d.TargetPath)
+// combineChunks writes the parts into target in order. When ctx is done
+// first, the partly written target is removed and the parts are kept.
+func (d *Download) combineChunks(ctx context.Context, target string) (err error) {
+	d.log().Info("combining chunks", "path", target)
+	targetFile, err := d.createTarget(target)
 	if err != nil {
 		return err
 	}
-	defer targetFile.Close()
+	closed := false
+	defer func() {
+		if ctx.Err() != nil {
+			if err := removeTarget(targetFile, target); err != nil {
+				d.log().Warn("failed to remove partly combined target", "path", target, "err", err)
+			}
+		} else if !closed {
+			targetFile.Close()
+		}
+	}()
 
-	for i := range d.Chunks {
-		partPath := fmt.Sprintf("%v.part-%v", d.TargetPath, i)
-		partFile, err := os.Open(partPath)
+	for i, chunk := range d.Chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		partPath := d.partPath(chunk)
+		partFile, err := d.openPart(chunk, partPath)
 		if err != nil {
 			return fmt.Errorf("opening part %d: %w", i, err)
 		}
 
-		if _, err := io.Copy(targetFile, partFile); err != nil {
+		if _, err := io.Copy(ctxWriter{ctx, targetFile}, partFile); err != nil {
 			partFile.Close()
 			return fmt.Errorf("copying part %d: %w", i, err)
 		}
 		partFile.Close()
+	}
 
+	// closing creates the trailing empty files of a torrent, so it can fail
+	closed = true
+	if err := targetFile.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", target, err)
 	}
 	return nil
 }
 
+// ctxWriter stops writing once its context is done
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
 func (d *Download) cleanup() {
-	for i := range d.Chunks {
-		partPath := fmt.Sprintf("%s.part-%d", d.TargetPath, i)
+	for _, chunk := range d.Chunks {
+		partPath := d.partPath(chunk)
 		if err := os.Remove(partPath); err != nil {
-			fmt.Printf("warning: failed to remove %s: %v\n", partPath, err)
+			d.chunkLog(chunk).Warn("failed to remove part file", "path", partPath, "err", err)
 		}
 	}
 }
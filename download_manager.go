@@ -3,26 +3,48 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 type DownloadManager struct {
-	DB             *sql.DB
-	Downloads      map[int64]*Download
-	Mutex          sync.Mutex
-	ActiveContexts map[int64]context.CancelFunc
-	appCtx         context.Context
+	DB          *sql.DB
+	Downloads   map[int64]*Download
+	Mutex       sync.Mutex
+	controllers map[int64]*downloadController
+	appCtx      context.Context
+	conflicts   conflictPrompts
+	bandwidth   bandwidthLimiter
+	stream      *streamServer
+	// scheduleMutex serializes checkSchedule
+	scheduleMutex sync.Mutex
+	// stop ends the background checks started with the manager
+	stop context.CancelFunc
+	// closed keeps runs from starting once Close was called
+	closed atomic.Bool
 }
 
 type ChunkWriter interface {
 	UpdateChunkState(chunk *ChunkInfo) error
 	NotifyChunkUpdate(downloadID int64, chunk *ChunkInfo)
 	NotifyDownloadUpdate(downloadID int64, state DownloadState)
+	ResolveConflict(ctx context.Context, d *Download, path string) (string, conflictOutcome, error)
+	UpdateDownloadPath(downloadID int64, path string) error
+	WaitBandwidth(ctx context.Context, n int) error
+	Transition(d *Download, to DownloadState) error
+	RecordEvent(e *DownloadEvent)
+	AddChunk(d *Download, chunk *ChunkInfo) error
+	UpdateWorkers(downloadID int64, workers int) error
+	ConnectionAllowance(d *Download) int
 }
 
 func NewDownloadManager(dbPath string, appCtx context.Context) (*DownloadManager, error) {
@@ -32,65 +54,207 @@ func NewDownloadManager(dbPath string, appCtx context.Context) (*DownloadManager
 	}
 
 	dm := &DownloadManager{
-		DB:             db,
-		Downloads:      make(map[int64]*Download),
-		ActiveContexts: make(map[int64]context.CancelFunc),
-		appCtx:         appCtx,
+		DB:          db,
+		Downloads:   make(map[int64]*Download),
+		controllers: make(map[int64]*downloadController),
+		appCtx:      appCtx,
 	}
 
+	if err := dm.LoadSSHSettings(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// limit speed before loaded downloads resume
+	dm.applyBandwidthProfile()
+
 	if err := dm.LoadFromDB(); err != nil {
+		dm.Close()
 		return nil, err
 	}
 
+	monitorCtx := appCtx
+	if monitorCtx == nil {
+		monitorCtx = context.Background()
+	}
+	monitorCtx, dm.stop = context.WithCancel(monitorCtx)
+	go dm.monitorDiskSpace(monitorCtx)
+	go dm.runScheduler(monitorCtx)
+	go dm.runBandwidthSchedule(monitorCtx)
+
 	return dm, nil
 }
 
-func (dm *DownloadManager) LoadFromDB() error {
-	rows, err := dm.DB.Query("SELECT id,url,path,size,chunks,workers,state FROM downloads")
+// Close stops the background checks and the running downloads, and closes
+// the database. Stopped downloads keep their state, so they resume when the
+// manager is opened again.
+func (dm *DownloadManager) Close() error {
+	if !dm.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if dm.stop != nil {
+		dm.stop()
+	}
+
+	dm.Mutex.Lock()
+	downloads := make([]*Download, 0, len(dm.controllers))
+	for _, c := range dm.controllers {
+		downloads = append(downloads, c.d)
+	}
+	dm.Mutex.Unlock()
+	for _, d := range downloads {
+		if err := dm.control(d, nil); err != nil {
+			d.log().Error("failed to stop download", "err", err)
+		}
+	}
+	return dm.DB.Close()
+}
+
+const downloadColumns = "id,url,path,size,chunks,workers,state,mirrors,checksum_type,checksum,piece_length,piece_type,piece_hashes,kind,torrent_info,conflict_policy,category,scheduled,start_at,created_at,started_at,completed_at,last_error,bytes_downloaded,average_speed,sequential,auto"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDownload(row rowScanner) (*Download, error) {
+	var d Download
+	var mirrors, pieceHashes string
+	if err := row.Scan(&d.ID, &d.URL, &d.TargetPath, &d.TotalSize, &d.ChunkCount, &d.WorkersCount, &d.State,
+		&mirrors, &d.ChecksumType, &d.Checksum, &d.PieceLength, &d.PieceType, &pieceHashes, &d.Kind, &d.TorrentInfo, &d.ConflictPolicy, &d.Category, &d.Scheduled, &d.StartAt,
+		&d.CreatedAt, &d.StartedAt, &d.CompletedAt, &d.LastError, &d.BytesDownloaded, &d.AverageSpeed, &d.Sequential, &d.Auto); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if d.Mirrors, err = decodeList(mirrors); err != nil {
+		return nil, fmt.Errorf("decoding mirrors of download %d: %w", d.ID, err)
+	}
+	if d.PieceHashes, err = decodeList(pieceHashes); err != nil {
+		return nil, fmt.Errorf("decoding piece hashes of download %d: %w", d.ID, err)
+	}
+	return &d, nil
+}
+
+// list columns are stored as JSON arrays, with the empty string for no entries
+func encodeList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+func decodeList(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var values []string
+	err := json.Unmarshal([]byte(value), &values)
+	return values, err
+}
+
+// loadChunks reads the chunks of d, counting those already completed
+func (dm *DownloadManager) loadChunks(d *Download) error {
+	rows, err := dm.DB.Query("SELECT id,chunk_index,start_byte,end_byte,written,state,url,key_url,key_iv,whole FROM chunks WHERE download_id = ? ORDER BY chunk_index", d.ID)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
+	var (
+		chunks    []*ChunkInfo
+		completed int64
+	)
 	for rows.Next() {
-		var d Download
-		if err := rows.Scan(&d.ID, &d.URL, &d.TargetPath, &d.TotalSize, &d.ChunkCount, &d.WorkersCount, &d.State); err != nil {
+		var chunk ChunkInfo
+		if err := rows.Scan(&chunk.ID, &chunk.Index, &chunk.StartByte, &chunk.EndByte, &chunk.Written, &chunk.State, &chunk.URL, &chunk.KeyURL, &chunk.KeyIV, &chunk.Whole); err != nil {
 			return err
 		}
-
-		chunkRows, err := dm.DB.Query("SELECT id,chunk_index,start_byte,end_byte,written,state FROM chunks WHERE download_id = ?", d.ID)
-		if err != nil {
-			return err
+		if chunk.State == StateCompleted {
+			completed++
 		}
 
-		var chunks []*ChunkInfo
-		for chunkRows.Next() {
-			var chunk ChunkInfo
-			if err := chunkRows.Scan(&chunk.ID, &chunk.Index, &chunk.StartByte, &chunk.EndByte, &chunk.Written, &chunk.State); err != nil {
-				return err
-			}
+		chunks = append(chunks, &chunk)
+	}
+	d.Chunks = chunks
+	d.CompletedChunks = completed
+	return rows.Err()
+}
+
+func (dm *DownloadManager) LoadFromDB() error {
+	// read before resuming any, as the runs can't write while rows are open
+	downloads, err := dm.readDownloads()
+	if err != nil {
+		return err
+	}
 
-			chunks = append(chunks, &chunk)
+	for _, d := range downloads {
+		if err := dm.loadChunks(d); err != nil {
+			return err
+		}
+		if err := dm.loadPostSteps(d); err != nil {
+			return err
 		}
 
-		chunkRows.Close()
-		d.Chunks = chunks
-		dm.Downloads[d.ID] = &d
 		d.ChunkWriter = dm
-		if d.State != StateCompleted {
-			d.Initialize()
-			dm.Downloads[d.ID] = &d
-			d.ChunkWriter = dm
-			if err := dm.StartDownload(d.ID); err != nil {
-				return err
+		// runs resumed earlier in the loop read the map
+		dm.Mutex.Lock()
+		dm.Downloads[d.ID] = d
+		dm.Mutex.Unlock()
+
+		// paused, failed and finished downloads wait for the user, and
+		// queued ones for the scheduler
+		switch d.State {
+		case StateProbing, StateCombining, StateVerifying:
+			// interrupted by the app closing, run again from the start
+			d.State = StateActive
+		case StateActive:
+		case StateQueued:
+			if err := d.Initialize(); err != nil {
+				d.log().Error("failed to initialize download", "err", err)
 			}
+			continue
+		default:
+			continue
+		}
 
+		// one download failing to resume leaves the others to start
+		if err := d.Initialize(); err != nil {
+			d.log().Error("failed to initialize download", "err", err)
+			continue
+		}
+		if dm.holdIfWaiting(d) {
+			continue
+		}
+		if err := dm.StartDownload(d.ID); errors.Is(err, ErrInsufficientSpace) {
+			d.log().Warn("not resuming download", "err", err)
+		} else if err != nil {
+			d.log().Error("failed to resume download", "err", err)
 		}
 	}
 
 	return nil
 }
 
+// readDownloads returns every stored download, without its chunks
+func (dm *DownloadManager) readDownloads() ([]*Download, error) {
+	rows, err := dm.DB.Query("SELECT " + downloadColumns + " FROM downloads")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var downloads []*Download
+	for rows.Next() {
+		d, err := scanDownload(rows)
+		if err != nil {
+			return nil, err
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, rows.Err()
+}
+
 func (dm *DownloadManager) NotifyChunkUpdate(downloadID int64, chunk *ChunkInfo) {
 	if dm.appCtx != nil && chunk != nil {
 		payload := ChunkUpdateEvent{
@@ -98,7 +262,7 @@ func (dm *DownloadManager) NotifyChunkUpdate(downloadID int64, chunk *ChunkInfo)
 			ChunkIndex: chunk.Index,
 			ChunkID:    chunk.ID,
 			Written:    chunk.Written,
-			TotalSize:  (chunk.EndByte - chunk.StartByte + 1),
+			TotalSize:  chunk.Size(),
 			State:      chunk.State,
 		}
 
@@ -110,45 +274,88 @@ func (dm *DownloadManager) NotifyDownloadUpdate(downloadID int64, state Download
 	if dm.appCtx != nil {
 		payload := DownloadUpdateEvent{
 			DownloadID: downloadID,
-			State:      dm.Downloads[downloadID].State,
+			State:      state,
 		}
 		runtime.EventsEmit(dm.appCtx, "downloadUpdate", payload)
 	}
 }
 
-func (dm *DownloadManager) AllDownloads() []*Download {
+// AllDownloads returns the downloads of a category, or all of them when
+// category is empty
+func (dm *DownloadManager) AllDownloads(category string) []*Download {
 	dm.Mutex.Lock()
 	defer dm.Mutex.Unlock()
 
 	downloads := make([]*Download, 0, len(dm.Downloads))
 	for _, d := range dm.Downloads {
-		downloads = append(downloads, d)
+		if category != "" && d.Category != category {
+			continue
+		}
+		downloads = append(downloads, d.snapshot())
 	}
 	return downloads
 }
 
 func (dm *DownloadManager) AddDownload(url, path string, chunks, workers int) (err error) {
-	dm.Mutex.Lock()
-	defer dm.Mutex.Unlock()
+	// magnet links need their pieces mapped onto chunks
+	if strings.HasPrefix(url, "magnet:") {
+		return dm.AddTorrent(url, filepath.Dir(path), chunks, workers)
+	}
 
-	existing, err := dm.getDownload(url, path)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if restored, err := dm.restoreExisting(url, path); restored || err != nil {
 		return err
 	}
-	if existing != nil {
-		dm.Downloads[existing.ID] = existing
-		existing.ChunkWriter = dm
 
-		if existing.State != StateCompleted && existing.State != StateCancelled {
-			return dm.StartDownload(existing.ID)
-		}
+	d, err := dm.newCategorizedDownload(url, path, chunks, workers)
+	if err != nil {
+		return err
+	}
+	if restored, err := dm.restoreCategorized(url, path, d); restored || err != nil {
+		return err
+	}
+	return dm.addNewDownload(d)
+}
+
+// trackRestored returns the tracked download with the ID of one read back
+// from the database, tracking the latter when there is none. The caller
+// holds dm.Mutex.
+func (dm *DownloadManager) trackRestored(existing *Download) *Download {
+	if tracked, ok := dm.Downloads[existing.ID]; ok {
+		return tracked
+	}
+
+	switch existing.State {
+	case StateProbing, StateCombining, StateVerifying:
+		// interrupted by the app closing, run again from the start
+		existing.State = StateActive
+	}
+	dm.Downloads[existing.ID] = existing
+	existing.ChunkWriter = dm
+	return existing
+}
+
+// restoreDownload picks a download added again back up unless it already
+// finished, was cancelled or is running
+func (dm *DownloadManager) restoreDownload(existing *Download) error {
+	existing.Mutex.Lock()
+	state := existing.State
+	existing.Mutex.Unlock()
+
+	switch state {
+	case StateCompleted, StateCancelled, StateProbing, StateCombining, StateVerifying:
 		return nil
 	}
+	if dm.holdIfWaiting(existing) {
+		return nil
+	}
+	return dm.StartDownload(existing.ID)
+}
 
-	d, err := NewDownload(url, path, chunks, workers)
+// saveDownload inserts a new download and its chunks and starts tracking it
+func (dm *DownloadManager) saveDownload(d *Download) (err error) {
 	d.ChunkWriter = dm
-	if err != nil {
-		return err
+	if d.CreatedAt == 0 {
+		d.CreatedAt = time.Now().Unix()
 	}
 
 	tx, err := dm.DB.Begin()
@@ -161,7 +368,10 @@ func (dm *DownloadManager) AddDownload(url, path string, chunks, workers int) (e
 		}
 	}()
 
-	res, err := tx.Exec("INSERT INTO downloads (url,path,size,chunks,workers,state) VALUES (?,?,?,?,?,?)", d.URL, d.TargetPath, d.TotalSize, d.ChunkCount, d.WorkersCount, d.State)
+	res, err := tx.Exec("INSERT INTO downloads (url,path,size,chunks,workers,state,mirrors,checksum_type,checksum,piece_length,piece_type,piece_hashes,kind,torrent_info,conflict_policy,category,scheduled,start_at,created_at,started_at,completed_at,last_error,bytes_downloaded,average_speed,sequential,auto) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		d.URL, d.TargetPath, d.TotalSize, d.ChunkCount, d.WorkersCount, d.State,
+		encodeList(d.Mirrors), d.ChecksumType, d.Checksum, d.PieceLength, d.PieceType, encodeList(d.PieceHashes), d.Kind, d.TorrentInfo, d.ConflictPolicy, d.Category, d.Scheduled, d.StartAt,
+		d.CreatedAt, d.StartedAt, d.CompletedAt, d.LastError, d.BytesDownloaded, d.AverageSpeed, d.Sequential, d.Auto)
 	if err != nil {
 		return err
 	}
@@ -173,7 +383,8 @@ func (dm *DownloadManager) AddDownload(url, path string, chunks, workers int) (e
 	d.ID = id
 
 	for _, chunk := range d.Chunks {
-		res, err := tx.Exec("INSERT INTO chunks (download_id,chunk_index,start_byte,end_byte,written,state) VALUES (?,?,?,?,?,?)", d.ID, chunk.Index, chunk.StartByte, chunk.EndByte, chunk.Written, chunk.State)
+		res, err := tx.Exec("INSERT INTO chunks (download_id,chunk_index,start_byte,end_byte,written,state,url,key_url,key_iv,whole) VALUES (?,?,?,?,?,?,?,?,?,?)",
+			d.ID, chunk.Index, chunk.StartByte, chunk.EndByte, chunk.Written, chunk.State, chunk.URL, chunk.KeyURL, chunk.KeyIV, chunk.Whole)
 		if err != nil {
 			return err
 		}
@@ -184,70 +395,94 @@ func (dm *DownloadManager) AddDownload(url, path string, chunks, workers int) (e
 		chunk.ID = id
 	}
 
+	added := &DownloadEvent{DownloadID: d.ID, Type: EventState, Chunk: -1, Message: fmt.Sprintf("added as %s", d.State)}
+	if err := insertEvent(tx, added); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return err
 	}
 
 	dm.Downloads[d.ID] = d
-	return dm.StartDownload(d.ID)
+	return nil
 }
 
+// StartDownload runs a download unless it is already running. The caller
+// must not hold dm.Mutex.
 func (dm *DownloadManager) StartDownload(id int64) error {
-	d, ok := dm.Downloads[id]
-	if !ok {
-		return fmt.Errorf("download with ID %d not found", id)
-	}
-
-	if d.State == StateCompleted {
-		return fmt.Errorf("download already completed")
-	}
-
-	if cancel, exists := dm.ActiveContexts[id]; exists {
-		cancel()
+	d, err := dm.download(id)
+	if err != nil {
+		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	dm.ActiveContexts[id] = cancel
-
-	go func() {
-		defer func() {
-			cancel()
-			dm.Mutex.Lock()
-			delete(dm.ActiveContexts, id)
-			dm.Mutex.Unlock()
-		}()
-		if err := d.Start(ctx); err != nil && err.Error() != "download canceled" {
-			fmt.Printf("error starting download: %v\n", err)
+	return dm.control(d, func() error {
+		if err := dm.refuseWithoutSpace(d); err != nil {
+			return err
 		}
-	}()
-	return nil
+		return dm.Transition(d, StateActive)
+	})
 }
 
-func (dm *DownloadManager) UpdateDownloadStateByID(id int64, state DownloadState) (err error) {
-	d := dm.Downloads[id]
-	tx, err := dm.DB.Begin()
-	if err != nil {
-		return err
+// runDownload runs d until it finishes or ctx is cancelled, recording when
+// it started and finished, the bytes it received and its last error
+func (dm *DownloadManager) runDownload(ctx context.Context, d *Download) error {
+	d.Mutex.Lock()
+	now := time.Now()
+	d.runStart = now
+	d.runBytes = d.BytesDownloaded
+	if d.StartedAt == 0 {
+		d.StartedAt = now.Unix()
+	}
+	d.Mutex.Unlock()
+	if err := dm.saveStats(d); err != nil {
+		d.log().Error("failed to update download stats in DB", "err", err)
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
 
-	if _, err = tx.Exec("UPDATE downloads SET state=? WHERE id=?", state, d.ID); err != nil {
-		return err
+	err := d.Start(ctx)
+
+	d.Mutex.Lock()
+	// the time spent in earlier runs follows from their bytes and speed
+	elapsed := time.Since(d.runStart).Seconds()
+	if d.AverageSpeed > 0 {
+		elapsed += float64(d.runBytes) / float64(d.AverageSpeed)
+	}
+	if elapsed > 0 {
+		d.AverageSpeed = int64(float64(d.BytesDownloaded) / elapsed)
+	}
+	switch {
+	case err == nil:
+		d.CompletedAt = time.Now().Unix()
+		d.LastError = ""
+	case ctx.Err() == nil:
+		// pausing and cancelling aren't errors
+		d.LastError = err.Error()
+	}
+	d.Mutex.Unlock()
+	if statsErr := dm.saveStats(d); statsErr != nil {
+		d.log().Error("failed to update download stats in DB", "err", statsErr)
 	}
 
-	for _, chunk := range d.Chunks {
-		if chunk.State != StateCompleted {
-			if _, err = tx.Exec("UPDATE chunks SET state=?,written=? WHERE id=?", state, chunk.Written, chunk.ID); err != nil {
-				return err
-			}
+	if err != nil && ctx.Err() == nil {
+		if stateErr := dm.Transition(d, StateFailed); stateErr != nil {
+			d.log().Error("failed to mark download failed", "cause", err, "err", stateErr)
 		}
 	}
+	return err
+}
 
-	err = tx.Commit()
+// saveStats stores d's timestamps, byte count and speed
+func (dm *DownloadManager) saveStats(d *Download) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	_, err := dm.DB.Exec("UPDATE downloads SET started_at=?,completed_at=?,last_error=?,bytes_downloaded=?,average_speed=? WHERE id=?",
+		d.StartedAt, d.CompletedAt, d.LastError, d.BytesDownloaded, d.AverageSpeed, d.ID)
+	return err
+}
+
+func (dm *DownloadManager) UpdateDownloadPath(downloadID int64, path string) error {
+	_, err := dm.DB.Exec("UPDATE downloads SET path = ? WHERE id = ?", path, downloadID)
 	return err
 }
 
@@ -259,82 +494,62 @@ func (dm *DownloadManager) UpdateChunkState(chunk *ChunkInfo) error {
 	return err
 }
 
-func (dm *DownloadManager) PauseDownload(id int64) error {
-	d, ok := dm.Downloads[id]
-	if !ok {
-		return fmt.Errorf("download with ID %d not found", id)
-	}
-
+// download returns the tracked download with the given ID
+func (dm *DownloadManager) download(id int64) (*Download, error) {
 	dm.Mutex.Lock()
 	defer dm.Mutex.Unlock()
 
-	cancel, exists := dm.ActiveContexts[id]
-	if exists {
-		cancel()
-		delete(dm.ActiveContexts, id)
-	}
-	d.Pause()
-	return dm.UpdateDownloadStateByID(id, StatePaused)
-}
-
-func (dm *DownloadManager) ResumeDownload(id int64) error {
-	dm.Mutex.Lock()
-	defer dm.Mutex.Unlock()
 	d, ok := dm.Downloads[id]
 	if !ok {
-		return fmt.Errorf("download with ID %d not found", id)
+		return nil, fmt.Errorf("download with ID %d not found", id)
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	dm.ActiveContexts[id] = cancel
-	d.Resume()
+	return d, nil
+}
 
-	go func() {
-		err := d.Start(ctx)
-		if err != nil && err.Error() != "download canceled" {
-			fmt.Printf("error resuming download: %v\n", err)
-		}
-	}()
+func (dm *DownloadManager) PauseDownload(id int64) error {
+	d, err := dm.download(id)
+	if err != nil {
+		return err
+	}
+	if err := dm.control(d, func() error { return dm.Transition(d, StatePaused) }); err != nil {
+		return err
+	}
+	d.log().Info("download paused")
+	return nil
+}
 
-	return dm.UpdateDownloadStateByID(id, StateActive)
+// ResumeDownload starts a paused, queued or failed download again
+func (dm *DownloadManager) ResumeDownload(id int64) error {
+	return dm.StartDownload(id)
 }
 
 func (dm *DownloadManager) CancelDownload(id int64) error {
-	if cancel, ok := dm.ActiveContexts[id]; ok {
-		cancel()
-		delete(dm.ActiveContexts, id)
+	d, err := dm.download(id)
+	if err != nil {
+		return err
+	}
+	if err := dm.control(d, func() error { return dm.Transition(d, StateCancelled) }); err != nil {
+		return err
 	}
-	return dm.UpdateDownloadStateByID(id, StateCancelled)
+	d.log().Info("download cancelled")
+	return nil
 }
 
 func (dm *DownloadManager) getDownload(url, path string) (*Download, error) {
-	row := dm.DB.QueryRow("SELECT id,size,chunks,workers FROM downloads WHERE url=? AND path=?", url, path)
+	row := dm.DB.QueryRow("SELECT "+downloadColumns+" FROM downloads WHERE url=? AND path=?", url, path)
 
-	var d Download
-	d.URL = url
-	d.TargetPath = path
-
-	if err := row.Scan(&d.ID, &d.TotalSize, &d.ChunkCount, &d.WorkersCount); err != nil {
+	d, err := scanDownload(row)
+	if err != nil {
 		return nil, err
 	}
 
-	rows, err := dm.DB.Query("SELECT id,chunk_index,start_byte,end_byte,written,state FROM chunks where download_id=? ", d.ID)
-	if err != nil {
+	if err := dm.loadChunks(d); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var chunks []*ChunkInfo
-
-	for rows.Next() {
-		var chunk ChunkInfo
-		err := rows.Scan(&chunk.ID, &chunk.Index, &chunk.StartByte, &chunk.EndByte, &chunk.Written, &chunk.State)
-		if err != nil {
-			return nil, err
-		}
-		chunks = append(chunks, &chunk)
+	if err := dm.loadPostSteps(d); err != nil {
+		return nil, err
 	}
-	d.Chunks = chunks
 	d.Initialize()
 
-	return &d, nil
+	return d, nil
 }
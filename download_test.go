@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// addFile adds a download of srv's file split into chunks and returns it
+func addFile(t *testing.T, dm *DownloadManager, srv *httptest.Server, chunks int) *Download {
+	t.Helper()
+	target := filepath.Join(t.TempDir(), "file.bin")
+	if err := dm.AddDownload(srv.URL+"/file.bin", target, chunks, chunks); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dm.getDownload(srv.URL+"/file.bin", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestSplitChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64
+		chunks int
+		want   [][2]int64
+	}{
+		{"even", 8, 4, [][2]int64{{0, 1}, {2, 3}, {4, 5}, {6, 7}}},
+		{"remainder in the last chunk", 10, 3, [][2]int64{{0, 2}, {3, 5}, {6, 9}}},
+		{"fewer bytes than chunks", 5, 8, [][2]int64{{0, 0}, {1, 1}, {2, 2}, {3, 3}, {4, 4}}},
+		{"empty", 0, 4, [][2]int64{{0, -1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitChunks(tt.size, tt.chunks, 0)
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d chunks, want %d", len(got), len(tt.want))
+			}
+			for i, chunk := range got {
+				if chunk.Whole || chunk.StartByte != tt.want[i][0] || chunk.EndByte != tt.want[i][1] {
+					t.Errorf("chunk %d covers [%d, %d] whole=%v, want %v", i, chunk.StartByte, chunk.EndByte, chunk.Whole, tt.want[i])
+				}
+			}
+		})
+	}
+
+	unknown := splitChunks(-1, 4, 0)
+	if len(unknown) != 1 || !unknown[0].Whole || unknown[0].Size() != -1 {
+		t.Fatalf("unknown size split into %d chunks, first whole=%v", len(unknown), unknown[0].Whole)
+	}
+}
+
+func TestDownloadSmallerThanChunkCount(t *testing.T) {
+	data := []byte("hello")
+	srv := newThrottledServer(t, data, 1<<20, 1<<20)
+	dm := newTestManager(t)
+
+	d := addFile(t, dm, srv, 8)
+	waitState(t, d, StateCompleted, 10*time.Second)
+
+	if n := d.snapshot().ChunkCount; n != len(data) {
+		t.Fatalf("%d chunks, want %d", n, len(data))
+	}
+	got, err := os.ReadFile(d.snapshot().TargetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %q, want %q", got, data)
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	data := randomData(t, 2<<20)
+	srv := newThrottledServer(t, data, 512*1024, 4<<20)
+	dbPath := filepath.Join(t.TempDir(), dbFileName)
+	first, err := NewDownloadManager(dbPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.Close() })
+
+	// two workers finish the eight chunks a few at a time
+	rawURL, target := srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin")
+	if err := first.AddDownload(rawURL, target, 8, 2); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := first.getDownload(rawURL, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := first.download(stored.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt64(&d.CompletedChunks) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no chunks completed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the app closes while the download is running
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := d.snapshot(); s.State != StateActive {
+		t.Fatalf("download is %s after closing, want it left %s", s.State, StateActive)
+	}
+	completed := atomic.LoadInt64(&d.CompletedChunks)
+
+	second, err := NewDownloadManager(dbPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { second.Close() })
+	resumed, err := second.download(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&resumed.CompletedChunks); n < completed {
+		t.Fatalf("%d chunks completed after the restart, %d before", n, completed)
+	}
+	waitState(t, resumed, StateCompleted, 30*time.Second)
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("resumed file differs from the served one")
+	}
+}
+
+func TestLoadFromDBContinuesAfterFailedResume(t *testing.T) {
+	data := randomData(t, 64*1024)
+	srv := newThrottledServer(t, data, 1<<20, 1<<20)
+	dbPath := filepath.Join(t.TempDir(), dbFileName)
+	first, err := NewDownloadManager(dbPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.Close() })
+
+	// both were running when the app closed
+	dir := t.TempDir()
+	var ids []int64
+	for _, name := range []string{"a.bin", "b.bin"} {
+		d := &Download{
+			URL:          srv.URL + "/" + name,
+			TargetPath:   filepath.Join(dir, name),
+			TotalSize:    int64(len(data)),
+			ChunkCount:   2,
+			WorkersCount: 2,
+			State:        StateActive,
+			Chunks:       splitChunks(int64(len(data)), 2, 0),
+		}
+		first.Mutex.Lock()
+		err := first.saveDownload(d)
+		first.Mutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, d.ID)
+	}
+	// checking disk space before resuming fails on this setting
+	if err := first.SetSetting("low_space_threshold", "lots"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := NewDownloadManager(dbPath, nil)
+	if err != nil {
+		t.Fatalf("opening with downloads failing to resume: %v", err)
+	}
+	t.Cleanup(func() { second.Close() })
+	for _, id := range ids {
+		if _, err := second.download(id); err != nil {
+			t.Errorf("download %d not loaded: %v", id, err)
+		}
+	}
+}
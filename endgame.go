@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EndgameThreshold is how many unfinished chunks a download has left when
+// idle workers start racing the slowest of them on a second connection
+var EndgameThreshold = 2
+
+// EndgameInterval is how often the end of a run looks for chunks to race
+var EndgameInterval = 500 * time.Millisecond
+
+// endgameMinRemaining keeps chunks nearly done from being raced, as a new
+// connection wouldn't catch up
+const endgameMinRemaining = 256 * 1024
+
+// chunkRun is a worker's transfer of one chunk
+type chunkRun struct {
+	chunk *ChunkInfo
+	// cancel stops the transfer, for a duplicate that finished first
+	cancel context.CancelFunc
+	// done is closed once the worker is through with the chunk
+	done chan struct{}
+	// cancelDup stops the duplicate racing the chunk, nil when not raced
+	cancelDup context.CancelFunc
+}
+
+// beginRun registers the transfer of chunk by a worker, returning the
+// context the duplicate that wins a race cancels
+func (d *Download) beginRun(ctx context.Context, chunk *ChunkInfo) (context.Context, *chunkRun) {
+	chunkCtx, cancel := context.WithCancel(ctx)
+	run := &chunkRun{chunk: chunk, cancel: cancel, done: make(chan struct{})}
+
+	d.Mutex.Lock()
+	if d.runs == nil {
+		d.runs = map[int]*chunkRun{}
+	}
+	d.runs[chunk.Index] = run
+	d.Mutex.Unlock()
+	return chunkCtx, run
+}
+
+// endRun unregisters the transfer of chunk, stopping its duplicate when the
+// worker completed the chunk first
+func (d *Download) endRun(chunk *ChunkInfo, run *chunkRun, err error) {
+	d.Mutex.Lock()
+	delete(d.runs, chunk.Index)
+	if err == nil && run.cancelDup != nil {
+		run.cancelDup()
+	}
+	d.Mutex.Unlock()
+	run.cancel()
+	close(run.done)
+}
+
+// endgame races the chunks still downloading on second connections until
+// the workers are done, while at most EndgameThreshold chunks are left and
+// workers are idle. Duplicates are added to races, which the caller waits
+// for.
+func (d *Download) endgame(ctx context.Context, workersDone <-chan struct{}, races *sync.WaitGroup) {
+	if d.Kind != KindFile {
+		return
+	}
+	ticker := time.NewTicker(EndgameInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-workersDone:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.Mutex.Lock()
+		unfinished := 0
+		connections := 0
+		for _, chunk := range d.Chunks {
+			if chunk.State != StateCompleted {
+				unfinished++
+			}
+		}
+		var candidates []*ChunkInfo
+		for _, run := range d.runs {
+			connections++
+			if run.cancelDup != nil {
+				connections++
+				continue
+			}
+			chunk := run.chunk
+			if size := chunk.Size(); size >= 0 && size-chunk.Written >= endgameMinRemaining {
+				candidates = append(candidates, chunk)
+			}
+		}
+		if unfinished <= EndgameThreshold {
+			// the chunks with the most left are the slow ones
+			sort.Slice(candidates, func(i, j int) bool {
+				return candidates[i].Size()-candidates[i].Written > candidates[j].Size()-candidates[j].Written
+			})
+			for _, chunk := range candidates {
+				if connections >= d.WorkersCount {
+					break
+				}
+				connections++
+				run := d.runs[chunk.Index]
+				raceCtx, cancel := context.WithCancel(ctx)
+				run.cancelDup = cancel
+				races.Add(1)
+				go func(offset int64) {
+					defer races.Done()
+					defer cancel()
+					d.race(ctx, raceCtx, chunk, run, offset)
+				}(chunk.Written)
+			}
+		}
+		d.Mutex.Unlock()
+	}
+}
+
+func (d *Download) racePath(chunk *ChunkInfo) string {
+	return d.partPath(chunk) + ".race"
+}
+
+// raceSource picks the URL a duplicate fetches chunk from, another mirror
+// than the worker's first choice when there are several
+func (d *Download) raceSource(chunk *ChunkInfo) string {
+	if chunk.URL != "" {
+		return chunk.URL
+	}
+	sources := d.sources()
+	return sources[(chunk.Index+1)%len(sources)]
+}
+
+// race fetches the rest of chunk from offset on a second connection. If it
+// finishes before the worker, the worker's transfer is stopped and the
+// fetched bytes replace the end of the part. Which connection won is
+// recorded as an event.
+func (d *Download) race(ctx, raceCtx context.Context, chunk *ChunkInfo, run *chunkRun, offset int64) {
+	source := d.raceSource(chunk)
+	log := d.chunkLog(chunk).With("race_url", source)
+	log.Debug("racing chunk on a second connection", "offset", offset)
+
+	event := &DownloadEvent{DownloadID: d.ID, Type: EventRace, Chunk: chunk.Index}
+	startTime := time.Now()
+	path := d.racePath(chunk)
+	defer os.Remove(path)
+
+	written, err := d.fetchRace(raceCtx, chunk, source, path, offset)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		// stop the worker before touching its part
+		run.cancel()
+		<-run.done
+	}
+
+	d.Mutex.Lock()
+	completed := chunk.State == StateCompleted
+	d.Mutex.Unlock()
+	switch {
+	case completed:
+		event.Message = "original connection won the race"
+		d.ChunkWriter.RecordEvent(event)
+		return
+	case err != nil:
+		event.Message = fmt.Sprintf("second connection failed: %v", err)
+		d.ChunkWriter.RecordEvent(event)
+		return
+	}
+
+	if err := d.spliceRace(chunk, path, offset); err != nil {
+		log.Error("failed to use the chunk fetched on the second connection", "err", err)
+		event.Message = fmt.Sprintf("second connection won but its data was rejected: %v", err)
+		d.ChunkWriter.RecordEvent(event)
+		return
+	}
+	d.completeChunk(chunk)
+
+	elapsed := time.Since(startTime)
+	d.ChunkWriter.RecordEvent(&DownloadEvent{
+		DownloadID: d.ID,
+		Type:       EventChunkDone,
+		Chunk:      chunk.Index,
+		Message:    "chunk downloaded on a second connection",
+		Bytes:      written,
+		Duration:   elapsed.Milliseconds(),
+	})
+	event.Message = fmt.Sprintf("second connection won the race from %s", source)
+	event.Bytes = written
+	event.Duration = elapsed.Milliseconds()
+	d.ChunkWriter.RecordEvent(event)
+	log.Debug("second connection won the race", "duration", elapsed)
+}
+
+// fetchRace downloads chunk from offset to its end into path
+func (d *Download) fetchRace(ctx context.Context, chunk *ChunkInfo, source, path string, offset int64) (int64, error) {
+	proto, err := protocolFor(source, d.Client)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	body, err := proto.OpenRange(ctx, source, chunk.StartByte+offset, chunk.EndByte)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	var written int64
+	buffer := make([]byte, 128*1024)
+	for {
+		n, readErr := body.Read(buffer)
+		if n > 0 {
+			if _, err := file.Write(buffer[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			d.Mutex.Lock()
+			d.BytesDownloaded += int64(n)
+			d.Mutex.Unlock()
+			if err := d.ChunkWriter.WaitBandwidth(ctx, n); err != nil {
+				return written, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+	if want := chunk.Size() - offset; written != want {
+		return written, fmt.Errorf("got %d bytes, expected %d", written, want)
+	}
+	return written, nil
+}
+
+// spliceRace writes the bytes fetched by a duplicate over the part from
+// offset, which the stopped worker wrote up to or past, and verifies it
+func (d *Download) spliceRace(chunk *ChunkInfo, path string, offset int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	part, err := os.OpenFile(d.partPath(chunk), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, src); err != nil {
+		return err
+	}
+	if err := part.Truncate(chunk.Size()); err != nil {
+		return err
+	}
+
+	d.Mutex.Lock()
+	chunk.Written = chunk.Size()
+	d.signalProgress()
+	d.Mutex.Unlock()
+
+	if err := d.verifyChunk(chunk); err != nil {
+		if truncErr := part.Truncate(0); truncErr != nil {
+			return truncErr
+		}
+		d.setWritten(chunk, 0)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpliceRaceKeepsOnlyTheDuplicate(t *testing.T) {
+	data := randomData(t, 64*1024)
+	const offset = 10000
+
+	d := &Download{TargetPath: filepath.Join(t.TempDir(), "file.bin")}
+	chunk := &ChunkInfo{Index: 0, StartByte: 0, EndByte: int64(len(data)) - 1}
+
+	// the stopped worker got past offset with bytes of its own, and beyond
+	// the end of the chunk
+	worker := append(bytes.Clone(data[:offset]), bytes.Repeat([]byte{0xee}, len(data))...)
+	if err := os.WriteFile(d.partPath(chunk), worker, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(d.racePath(chunk), data[offset:], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.spliceRace(chunk, d.racePath(chunk), offset); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(d.partPath(chunk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("part holds %d bytes differing from the chunk's %d", len(got), len(data))
+	}
+	if chunk.Written != chunk.Size() {
+		t.Fatalf("%d bytes written, want %d", chunk.Written, chunk.Size())
+	}
+}
+
+func TestSpliceRaceRejectsCorruptDuplicate(t *testing.T) {
+	data := randomData(t, 32*1024)
+	const offset = 4096
+
+	sum := sha256.Sum256(data)
+	d := &Download{
+		TargetPath:  filepath.Join(t.TempDir(), "file.bin"),
+		PieceLength: int64(len(data)),
+		PieceType:   "sha-256",
+		PieceHashes: []string{hex.EncodeToString(sum[:])},
+	}
+	chunk := &ChunkInfo{Index: 0, StartByte: 0, EndByte: int64(len(data)) - 1}
+
+	if err := os.WriteFile(d.partPath(chunk), data[:offset], 0600); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := bytes.Clone(data[offset:])
+	corrupt[0] ^= 0xff
+	if err := os.WriteFile(d.racePath(chunk), corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.spliceRace(chunk, d.racePath(chunk), offset); err == nil {
+		t.Fatal("corrupt duplicate accepted")
+	}
+	info, err := os.Stat(d.partPath(chunk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 || chunk.Written != 0 {
+		t.Fatalf("part left at %d bytes, %d written, want it emptied", info.Size(), chunk.Written)
+	}
+}
+
+func TestEndgameRaceReplacesSlowMirror(t *testing.T) {
+	interval := EndgameInterval
+	EndgameInterval = 50 * time.Millisecond
+	t.Cleanup(func() { EndgameInterval = interval })
+
+	const chunkSize = 1 << 20
+	data := randomData(t, 2*chunkSize)
+	raced, dumped := make(chan struct{}), make(chan struct{})
+	var raceOnce, dumpOnce sync.Once
+
+	// the fast mirror holds the duplicate of the second chunk back until the
+	// slow one sent the worker bytes of its own
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), fmt.Sprintf("bytes=%d-", chunkSize)) {
+			raceOnce.Do(func() { close(raced) })
+			select {
+			case <-dumped:
+			case <-time.After(10 * time.Second):
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(fast.Close)
+
+	// the slow mirror sends nothing until the chunk is raced, then garbage
+	// that must not end up in the file, and then stalls
+	var slowRequests int
+	var slowMutex sync.Mutex
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowMutex.Lock()
+		slowRequests++
+		slowMutex.Unlock()
+
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-raced:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(bytes.Repeat([]byte{0xee}, 256*1024))
+		w.(http.Flusher).Flush()
+		dumpOnce.Do(func() { close(dumped) })
+		<-r.Context().Done()
+	}))
+	t.Cleanup(slow.Close)
+
+	dm := newTestManager(t)
+	dir := t.TempDir()
+	list := fmt.Sprintf("%s/file.bin\t%s/file.bin\n  out=file.bin\n", fast.URL, slow.URL)
+	results, err := dm.ImportURLs(list, dir, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].Added {
+		t.Fatalf("import results %+v", results)
+	}
+	target := filepath.Join(dir, "file.bin")
+	d, err := dm.getDownload(fast.URL+"/file.bin", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, StateCompleted, 20*time.Second)
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes differing from the served %d", len(got), len(data))
+	}
+	slowMutex.Lock()
+	asked := slowRequests
+	slowMutex.Unlock()
+	if asked == 0 {
+		t.Fatal("the slow mirror was never asked")
+	}
+
+	var message string
+	err = dm.DB.QueryRow("SELECT message FROM download_events WHERE download_id=? AND type=?", d.ID, EventRace).Scan(&message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "second connection won the race from " + fast.URL; !strings.HasPrefix(message, want) {
+		t.Fatalf("race recorded as %q, want %q", message, want)
+	}
+	if _, err := os.Stat(d.racePath(d.Chunks[1])); !os.IsNotExist(err) {
+		t.Fatalf("race file left behind: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultFileName is used when neither the server nor the URL suggest a name
+const defaultFileName = "download"
+
+// maxFileNameLength is the limit in bytes of most filesystems
+const maxFileNameLength = 255
+
+var (
+	// characters not allowed in file names on Windows, plus control characters
+	reservedFileChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f\x7f]`)
+	// device names Windows reserves regardless of extension
+	reservedFileNames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])(\..*)?$`)
+	// fallback for headers mime.ParseMediaType rejects, such as unquoted spaces
+	dispositionFileName = regexp.MustCompile(`(?i)filename\s*=\s*("([^"]*)"|[^;]*)`)
+)
+
+// contentDispositionName returns the file name suggested by a
+// Content-Disposition header (RFC 6266), preferring the RFC 5987 encoded
+// filename* parameter over the plain one
+func contentDispositionName(header string) string {
+	if header == "" {
+		return ""
+	}
+	if _, params, err := mime.ParseMediaType(header); err == nil {
+		// ParseMediaType decodes filename* into filename, overriding the plain value
+		return params["filename"]
+	}
+
+	match := dispositionFileName.FindStringSubmatch(header)
+	if match == nil {
+		return ""
+	}
+	if match[2] != "" {
+		return match[2]
+	}
+	return strings.TrimSpace(match[1])
+}
+
+// urlFileName returns the last path segment of a URL
+func urlFileName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// sanitizeFileName turns a name suggested by a server into one that is safe
+// to create in the download directory on any platform: directories are
+// stripped, reserved characters replaced and the length limited while keeping
+// the extension.
+func sanitizeFileName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = reservedFileChars.ReplaceAllString(name, "_")
+	name = strings.Trim(name, " .")
+	if reservedFileNames.MatchString(name) {
+		name = "_" + name
+	}
+
+	if len(name) > maxFileNameLength {
+		ext := path.Ext(name)
+		if len(ext) > maxFileNameLength/2 {
+			ext = ""
+		}
+		base := name[:maxFileNameLength-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+
+	if name == "" {
+		return defaultFileName
+	}
+	return name
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentDispositionName(t *testing.T) {
+	tests := []struct {
+		name, header, want string
+	}{
+		{"empty", "", ""},
+		{"no file name", "inline", ""},
+		{"quoted", `attachment; filename="report 2024.pdf"`, "report 2024.pdf"},
+		{"token", "attachment; filename=report.pdf", "report.pdf"},
+		{"escaped quote", `attachment; filename="say \"hi\".txt"`, `say "hi".txt`},
+		{"RFC 5987", "attachment; filename*=UTF-8''%E2%82%AC%20rates.pdf", "€ rates.pdf"},
+		{"RFC 5987 with language", "attachment; filename*=UTF-8'en'na%C3%AFve.txt", "naïve.txt"},
+		{"RFC 5987 preferred", `attachment; filename="fallback.pdf"; filename*=UTF-8''%E2%82%AC.pdf`, "€.pdf"},
+		{"RFC 5987 preferred when first", `attachment; filename*=UTF-8''%E2%82%AC.pdf; filename="fallback.pdf"`, "€.pdf"},
+		{"unquoted spaces", "attachment; filename=my file.zip", "my file.zip"},
+		{"unquoted spaces before another parameter", "attachment; filename=my file.zip; size=10", "my file.zip"},
+		{"path kept for sanitizing", `attachment; filename="../../etc/passwd"`, "../../etc/passwd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentDispositionName(tt.header); got != tt.want {
+				t.Fatalf("contentDispositionName(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	longExt := strings.Repeat("a", 300) + ".txt"
+	longRunes := strings.Repeat("é", 200) + ".txt"
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"unicode", "naïve €.txt", "naïve €.txt"},
+		{"empty", "", defaultFileName},
+		{"dots only", "..", defaultFileName},
+		{"slash only", "/", defaultFileName},
+		{"unix directories", "dir/sub/file.txt", "file.txt"},
+		{"parent directories", "../../etc/passwd", "passwd"},
+		{"windows directories", `C:\Users\me\file.txt`, "file.txt"},
+		{"trailing separator", "dir/", defaultFileName},
+		{"reserved characters", `a<b>c:d"e|f?g*h.txt`, "a_b_c_d_e_f_g_h.txt"},
+		{"control characters", "tab\there\x00.txt", "tab_here_.txt"},
+		{"invalid UTF-8", "a\xffb.txt", "a_b.txt"},
+		{"surrounding dots and spaces", " .hidden. ", "hidden"},
+		{"reserved device name", "CON", "_CON"},
+		{"reserved name with extension", "nul.txt", "_nul.txt"},
+		{"reserved numbered device", "com1.log", "_com1.log"},
+		{"reserved name in lower case", "lpt9", "_lpt9"},
+		{"device prefix only", "console.txt", "console.txt"},
+		{"long name keeps extension", longExt, strings.Repeat("a", 251) + ".txt"},
+		{"long name cut between runes", longRunes, strings.Repeat("é", 125) + ".txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFileName(tt.in)
+			if got != tt.want {
+				t.Fatalf("sanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(got) > maxFileNameLength {
+				t.Fatalf("%d bytes, more than %d", len(got), maxFileNameLength)
+			}
+		})
+	}
+}
+
+func TestURLFileName(t *testing.T) {
+	tests := []struct {
+		name, url, want string
+	}{
+		{"file", "http://example.com/pub/file.iso", "file.iso"},
+		{"query and fragment", "http://example.com/file.iso?token=1#part", "file.iso"},
+		{"escaped", "http://example.com/my%20file.txt", "my file.txt"},
+		{"root", "http://example.com/", ""},
+		{"no path", "http://example.com", ""},
+		{"directory", "http://example.com/pub/", "pub"},
+		{"invalid", "http://[::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := urlFileName(tt.url); got != tt.want {
+				t.Fatalf("urlFileName(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeURLFallbacks(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/named", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../CON.txt"`)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", "10")
+	})
+	mux.HandleFunc("/go", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/real.pdf", http.StatusFound)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "20")
+		w.Header().Set("Accept-Ranges", "bytes")
+	})
+	mux.HandleFunc("/get-only/file.pdf", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// no body, which the server would sniff a type from
+		w.Header().Set("Content-Range", "bytes 0-0/1234")
+		w.WriteHeader(http.StatusPartialContent)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name, path, fileName, mimeType string
+		size                           int64
+		ranges                         bool
+	}{
+		{"header name sanitized", "/named", "_CON.txt", "text/plain", 10, false},
+		{"name of the redirect target", "/go", "real.pdf", "application/pdf", 20, true},
+		{"GET when HEAD isn't allowed", "/get-only/file.pdf", "file.pdf", "application/pdf", 1234, true},
+		{"nothing to go by", "/", defaultFileName, "application/octet-stream", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := probeURL(context.Background(), srv.URL+tt.path, srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if probe.FileName != tt.fileName || probe.MimeType != tt.mimeType || probe.Size != tt.size || probe.AcceptsRanges != tt.ranges {
+				t.Fatalf("probed %q %q size %d ranges %v, want %q %q size %d ranges %v",
+					probe.FileName, probe.MimeType, probe.Size, probe.AcceptsRanges, tt.fileName, tt.mimeType, tt.size, tt.ranges)
+			}
+		})
+	}
+}
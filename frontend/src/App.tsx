@@ -1,9 +1,37 @@
+import { useEffect } from "react";
 import { BrowserRouter as Router, Routes, Route } from "react-router";
 import Navbar from "./components/Navbar";
 import Home from "./components/Home";
 import Download from "./components/Download";
+import { EventsOn } from "../wailsjs/runtime/runtime";
+import { ResolveConflict } from "../wailsjs/go/main/App";
+
+type FileConflictEvent = {
+  id: string;
+  path: string;
+  renamed_path: string;
+};
+
+const conflictAnswers = ["rename", "overwrite", "skip", "resume"];
 
 function App() {
+  // the backend waits for an answer when the conflict policy is "ask"
+  useEffect(() => {
+    return EventsOn("fileConflict", (event: FileConflictEvent) => {
+      const answer = window.prompt(
+        `${event.path} already exists.\n` +
+          `Type rename (saves as ${event.renamed_path}), overwrite, skip or resume:`,
+        "rename",
+      );
+      const policy = conflictAnswers.includes(answer?.trim() ?? "")
+        ? answer!.trim()
+        : "skip";
+      ResolveConflict(event.id, policy).catch((error) =>
+        console.error("Resolving file conflict failed:", error),
+      );
+    });
+  }, []);
+
   return (
     <Router>
       <Navbar />
@@ -10,9 +10,11 @@ import {
 } from "lucide-react";
 import {
   AddDownload,
+  AddAutoDownload,
   ShowDirectoryDialog,
   ShowFileDialog,
   GetDefaultDownloadPath,
+  ProbeURL,
 } from "../../wailsjs/go/main/App";
 
 const fallbackPath = "./Downloads";
@@ -52,6 +54,7 @@ export default function AddDownloadPage() {
   const [directory, setDirectory] = useState("");
   const [chunks, setChunks] = useState(10);
   const [workers, setWorkers] = useState(3);
+  const [auto, setAuto] = useState(false);
   const [isLoading, setIsLoading] = useState(false);
   const [urlError, setUrlError] = useState("");
   const [pathError, setPathError] = useState("");
@@ -77,6 +80,21 @@ export default function AddDownloadPage() {
     }
   }, [url, filename]);
 
+  // ask the server for its suggested filename once typing pauses
+  useEffect(() => {
+    if (!url || !isValidUrl(url)) return;
+
+    const timer = setTimeout(async () => {
+      try {
+        const probe = await ProbeURL(url);
+        if (probe.file_name) setFilename(probe.file_name);
+      } catch (error) {
+        console.log("Probing the URL failed:", error);
+      }
+    }, 500);
+    return () => clearTimeout(timer);
+  }, [url]);
+
   const openDirectoryDialog = async () => {
     try {
       const selectedDir = await ShowDirectoryDialog(directory);
@@ -132,7 +150,11 @@ export default function AddDownloadPage() {
           ? directory + filename
           : directory + "/" + filename;
 
-      await AddDownload(url, path, chunks, workers);
+      if (auto) {
+        await AddAutoDownload(url, path);
+      } else {
+        await AddDownload(url, path, chunks, workers);
+      }
       alert("Download added successfully!");
 
       setUrl("");
@@ -143,6 +165,7 @@ export default function AddDownloadPage() {
 
       setChunks(10);
       setWorkers(3);
+      setAuto(false);
     } catch (err) {
       console.error("AddDownload failed:", err);
       alert("Download failed. Check inputs and try again.");
@@ -261,12 +284,21 @@ export default function AddDownloadPage() {
                 <Settings className="w-4 h-4" />
                 Advanced Settings
               </label>
+              <label className="flex items-center gap-2 text-sm text-gray-700">
+                <input
+                  type="checkbox"
+                  checked={auto}
+                  onChange={(e) => setAuto(e.target.checked)}
+                />
+                Auto: tune chunks and workers to the connection
+              </label>
               <div className="grid grid-cols-2 gap-4">
                 <div>
                   <label className="text-xs text-gray-600">Chunks</label>
                   <input
                     type="number"
                     value={chunks}
+                    disabled={auto}
                     min={1}
                     max={32}
                     onChange={(e) =>
@@ -282,6 +314,7 @@ export default function AddDownloadPage() {
                   <input
                     type="number"
                     value={workers}
+                    disabled={auto}
                     min={1}
                     max={16}
                     onChange={(e) =>
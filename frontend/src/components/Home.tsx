@@ -1,12 +1,25 @@
 import { useEffect, useState, useRef, useCallback } from "react";
-import { Download, Pause, Play, X, ChevronDown, ChevronUp } from "lucide-react";
+import {
+  Download,
+  Pause,
+  Play,
+  X,
+  ChevronDown,
+  ChevronUp,
+  Bug,
+  ListOrdered,
+  Tv,
+} from "lucide-react";
 import {
   AllDownloads,
   PauseDownload,
   ResumeDownload,
   CancelDownload,
+  GetDownloadDiagnostics,
+  SetSequential,
+  GetStreamURL,
 } from "../../wailsjs/go/main/App";
-import { EventsOn } from "../../wailsjs/runtime/runtime";
+import { EventsOn, ClipboardSetText } from "../../wailsjs/runtime/runtime";
 import * as models from "../../wailsjs/go/models";
 
 const AppDownloadState = {
@@ -14,8 +27,22 @@ const AppDownloadState = {
   Paused: 1,
   Cancelled: 2,
   Completed: 3,
+  Queued: 4,
+  Probing: 5,
+  Verifying: 6,
+  Combining: 7,
+  Failed: 8,
 };
 
+// states the chunks can't tell apart, shown as the download reports them
+const stagedStates = [
+  AppDownloadState.Queued,
+  AppDownloadState.Probing,
+  AppDownloadState.Verifying,
+  AppDownloadState.Combining,
+  AppDownloadState.Failed,
+];
+
 interface ChunkUpdateEvent {
   downloadId: number;
   chunkIndex: number;
@@ -30,6 +57,29 @@ interface DownloadUpdateEvent {
   state: number;
 }
 
+interface BulkUpdateEvent {
+  action: string;
+  state: number;
+  downloadIds: number[];
+}
+
+interface PostStepResult {
+  id: number;
+  downloadId: number;
+  index: number;
+  step: { type: string };
+  status: string;
+  output: string;
+}
+
+const postStepStatusColor: Record<string, string> = {
+  pending: "text-gray-500",
+  running: "text-blue-600",
+  succeeded: "text-green-600",
+  failed: "text-red-600",
+  skipped: "text-gray-400",
+};
+
 interface DownloadStats {
   progress: number;
   speed: number;
@@ -49,6 +99,16 @@ const getDownloadStateString = (state: number) => {
       return "Cancelled";
     case AppDownloadState.Completed:
       return "Completed";
+    case AppDownloadState.Queued:
+      return "Queued";
+    case AppDownloadState.Probing:
+      return "Probing";
+    case AppDownloadState.Verifying:
+      return "Verifying";
+    case AppDownloadState.Combining:
+      return "Combining";
+    case AppDownloadState.Failed:
+      return "Failed";
     default:
       return "Unknown";
   }
@@ -88,6 +148,12 @@ const getStateColor = (state: number) => {
       return "text-red-600";
     case AppDownloadState.Completed:
       return "text-green-600";
+    case AppDownloadState.Probing:
+    case AppDownloadState.Verifying:
+    case AppDownloadState.Combining:
+      return "text-indigo-600";
+    case AppDownloadState.Failed:
+      return "text-red-600";
     default:
       return "text-gray-600";
   }
@@ -103,6 +169,12 @@ const getProgressColor = (state: number) => {
       return "bg-red-500";
     case AppDownloadState.Completed:
       return "bg-green-500";
+    case AppDownloadState.Probing:
+    case AppDownloadState.Verifying:
+    case AppDownloadState.Combining:
+      return "bg-indigo-500";
+    case AppDownloadState.Failed:
+      return "bg-red-500";
     default:
       return "bg-gray-300";
   }
@@ -130,7 +202,11 @@ const getChunkStateColor = (state: number, progress: number = 0) => {
 };
 
 const getCorrectDownloadState = (download: models.main.Download): number => {
-  if (!download.chunk_info || download.chunk_info.length === 0) {
+  if (
+    !download.chunk_info ||
+    download.chunk_info.length === 0 ||
+    stagedStates.includes(download.state)
+  ) {
     return download.state;
   }
 
@@ -171,6 +247,28 @@ const getCorrectDownloadState = (download: models.main.Download): number => {
   return download.state;
 };
 
+// copies a download's diagnostics as JSON, for attaching to bug reports
+const copyDiagnostics = async (id: number) => {
+  try {
+    const diagnostics = await GetDownloadDiagnostics(id);
+    await ClipboardSetText(JSON.stringify(diagnostics, null, 2));
+    alert("Diagnostics copied to the clipboard");
+  } catch (err) {
+    alert(err);
+  }
+};
+
+// copies the local URL a player can open a download at while it downloads
+const copyStreamURL = async (id: number) => {
+  try {
+    const url = await GetStreamURL(id);
+    await ClipboardSetText(url);
+    alert("Stream URL copied to the clipboard, open it in a media player");
+  } catch (err) {
+    alert(err);
+  }
+};
+
 function updateDownload(
   prev: models.main.Download[],
   downloadId: number,
@@ -249,7 +347,7 @@ export default function Home() {
 
   const initializeDownloads = async () => {
     try {
-      const data = await AllDownloads();
+      const data = await AllDownloads("");
       const downloadsData = data || [];
 
       const correctedDownloads = downloadsData.map((dl) => {
@@ -308,9 +406,25 @@ export default function Home() {
         setDownloads((prev) =>
           // @ts-ignore
           updateDownload(prev, payload.downloadId, (dl) => {
-            if (!dl.chunk_info) return dl;
-
-            const updatedChunks = dl.chunk_info.map((chunk) => {
+            const known = (dl.chunk_info || []).some(
+              (chunk) =>
+                (payload.chunkId !== 0 && chunk.id === payload.chunkId) ||
+                chunk.index === payload.chunkIndex,
+            );
+            // auto downloads cut new chunks as they go
+            const chunkInfo = known
+              ? dl.chunk_info
+              : [
+                  ...(dl.chunk_info || []),
+                  models.main.ChunkInfo.createFrom({
+                    id: payload.chunkId,
+                    index: payload.chunkIndex,
+                    written: payload.written,
+                    state: payload.state,
+                  }),
+                ];
+
+            const updatedChunks = chunkInfo.map((chunk) => {
               if (
                 (payload.chunkId !== 0 && chunk.id === payload.chunkId) ||
                 chunk.index === payload.chunkIndex
@@ -327,9 +441,13 @@ export default function Home() {
             const completed = updatedChunks.filter(
               (c) => c.state === AppDownloadState.Completed,
             ).length;
+            const chunkCount = Math.max(dl.chunks, updatedChunks.length);
 
+            // the download reports leaving the staged states itself
             let newState = dl.state;
-            if (completed === dl.chunks && dl.chunks > 0) {
+            if (stagedStates.includes(dl.state)) {
+              newState = dl.state;
+            } else if (completed === chunkCount && chunkCount > 0) {
               newState = AppDownloadState.Completed;
             } else if (
               updatedChunks.some((c) => c.state === AppDownloadState.Active)
@@ -348,6 +466,7 @@ export default function Home() {
             return {
               ...dl,
               chunk_info: updatedChunks,
+              chunks: chunkCount,
               completed_chunks: completed,
               state: newState,
             };
@@ -379,7 +498,39 @@ export default function Home() {
       },
     );
 
-    eventCleanupRef.current = [chunkUpdateCleanup, downloadUpdateCleanup];
+    const postProcessCleanup = EventsOn(
+      "postProcessUpdate",
+      (payload: PostStepResult) => {
+        setDownloads((prev) =>
+          // @ts-ignore
+          updateDownload(prev, payload.downloadId, (dl) => {
+            const steps = [...(dl.post_steps ?? [])];
+            steps[payload.index] = payload as any;
+            return { ...dl, post_steps: steps };
+          }),
+        );
+      },
+    );
+
+    const bulkUpdateCleanup = EventsOn(
+      "downloadsBulkUpdate",
+      (payload: BulkUpdateEvent) => {
+        const ids = new Set(payload.downloadIds);
+        setDownloads((prev) =>
+          // @ts-ignore
+          prev.map((dl) =>
+            ids.has(dl.id) ? { ...dl, state: payload.state } : dl,
+          ),
+        );
+      },
+    );
+
+    eventCleanupRef.current = [
+      chunkUpdateCleanup,
+      downloadUpdateCleanup,
+      postProcessCleanup,
+      bulkUpdateCleanup,
+    ];
 
     return () => {
       eventCleanupRef.current.forEach((cleanup) => cleanup());
@@ -522,33 +673,86 @@ export default function Home() {
 
                     <div className="flex items-center justify-between">
                       <div className="flex gap-2">
-                        {dl.state === AppDownloadState.Active && (
+                        {(dl.state === AppDownloadState.Active ||
+                          dl.state === AppDownloadState.Queued ||
+                          dl.state === AppDownloadState.Probing) && (
                           <button
-                            onClick={() => PauseDownload(dl.id)}
+                            onClick={() =>
+                              PauseDownload(dl.id).catch((err) => alert(err))
+                            }
                             className="flex items-center gap-2 bg-yellow-500 hover:bg-yellow-600 text-white px-4 py-2 rounded-lg text-sm font-medium transition-colors"
                           >
                             <Pause className="w-4 h-4" />
                             Pause
                           </button>
                         )}
-                        {dl.state === AppDownloadState.Paused && (
+                        {(dl.state === AppDownloadState.Paused ||
+                          dl.state === AppDownloadState.Queued ||
+                          dl.state === AppDownloadState.Failed) && (
                           <button
-                            onClick={() => ResumeDownload(dl.id)}
+                            onClick={() =>
+                              ResumeDownload(dl.id).catch((err) => alert(err))
+                            }
                             className="flex items-center gap-2 bg-blue-500 hover:bg-blue-600 text-white px-4 py-2 rounded-lg text-sm font-medium transition-colors"
                           >
                             <Play className="w-4 h-4" />
                             Resume
                           </button>
                         )}
-                        {dl.state !== AppDownloadState.Completed && (
+                        {dl.state !== AppDownloadState.Completed &&
+                          dl.state !== AppDownloadState.Cancelled && (
                           <button
-                            onClick={() => CancelDownload(dl.id)}
+                            onClick={() =>
+                              CancelDownload(dl.id).catch((err) => alert(err))
+                            }
                             className="flex items-center gap-2 bg-red-500 hover:bg-red-600 text-white px-4 py-2 rounded-lg text-sm font-medium transition-colors"
                           >
                             <X className="w-4 h-4" />
                             Cancel
                           </button>
                         )}
+                        {!dl.kind &&
+                          dl.state !== AppDownloadState.Completed &&
+                          dl.state !== AppDownloadState.Cancelled && (
+                          <button
+                            onClick={() =>
+                              SetSequential(dl.id, !dl.sequential)
+                                .then(() =>
+                                  setDownloads((prev) =>
+                                    updateDownload(prev, dl.id, (d) => ({
+                                      ...d,
+                                      sequential: !dl.sequential,
+                                    })),
+                                  ),
+                                )
+                                .catch((err) => alert(err))
+                            }
+                            className={`flex items-center gap-2 px-4 py-2 rounded-lg text-sm font-medium transition-colors ${
+                              dl.sequential
+                                ? "bg-indigo-500 hover:bg-indigo-600 text-white"
+                                : "bg-gray-200 hover:bg-gray-300 text-gray-700"
+                            }`}
+                          >
+                            <ListOrdered className="w-4 h-4" />
+                            Sequential
+                          </button>
+                        )}
+                        {!dl.kind && dl.state !== AppDownloadState.Cancelled && (
+                          <button
+                            onClick={() => copyStreamURL(dl.id)}
+                            className="flex items-center gap-2 bg-gray-200 hover:bg-gray-300 text-gray-700 px-4 py-2 rounded-lg text-sm font-medium transition-colors"
+                          >
+                            <Tv className="w-4 h-4" />
+                            Stream
+                          </button>
+                        )}
+                        <button
+                          onClick={() => copyDiagnostics(dl.id)}
+                          className="flex items-center gap-2 bg-gray-200 hover:bg-gray-300 text-gray-700 px-4 py-2 rounded-lg text-sm font-medium transition-colors"
+                        >
+                          <Bug className="w-4 h-4" />
+                          Diagnostics
+                        </button>
                       </div>
 
                       {dl.chunk_info && dl.chunk_info.length > 0 && (
@@ -700,6 +904,39 @@ Written: ${formatBytes(chunk.written)} / ${formatBytes(dl.size / dl.chunks)}`}
                           </p>
                         </div>
                       </div>
+
+                      {/* Post-processing steps */}
+                      {dl.post_steps && dl.post_steps.length > 0 && (
+                        <div className="mt-6">
+                          <h4 className="text-sm font-semibold text-gray-700 mb-3">
+                            Post-processing
+                          </h4>
+                          <div className="bg-white rounded-lg border divide-y text-sm">
+                            {dl.post_steps.map((step) => (
+                              <div key={step.index} className="p-3">
+                                <div className="flex justify-between">
+                                  <span className="font-medium capitalize">
+                                    {step.step.type}
+                                  </span>
+                                  <span
+                                    className={
+                                      postStepStatusColor[step.status] ??
+                                      "text-gray-500"
+                                    }
+                                  >
+                                    {step.status}
+                                  </span>
+                                </div>
+                                {step.output && (
+                                  <pre className="mt-2 text-xs text-gray-600 whitespace-pre-wrap break-all">
+                                    {step.output}
+                                  </pre>
+                                )}
+                              </div>
+                            ))}
+                          </div>
+                        </div>
+                      )}
                     </div>
                   )}
                 </div>
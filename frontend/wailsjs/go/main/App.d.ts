@@ -2,20 +2,96 @@
 // This file is automatically generated. DO NOT EDIT
 import {main} from '../models';
 
+export function AddAutoDownload(arg1:string,arg2:string):Promise<void>;
+
 export function AddDownload(arg1:string,arg2:string,arg3:number,arg4:number):Promise<void>;
 
-export function AllDownloads():Promise<Array<main.Download>>;
+export function AddMediaDownload(arg1:string,arg2:number,arg3:string,arg4:number):Promise<void>;
+
+export function AddTorrent(arg1:string,arg2:string,arg3:number,arg4:number):Promise<void>;
+
+export function AllDownloads(arg1:string):Promise<Array<main.Download>>;
 
 export function CancelDownload(arg1:number):Promise<void>;
 
+export function CancelDownloads(arg1:main.BulkSelection):Promise<main.BulkUpdateEvent>;
+
+export function ExportHistory(arg1:string,arg2:string):Promise<void>;
+
+export function GetActiveBandwidthProfile():Promise<main.BandwidthProfileEvent>;
+
+export function GetBandwidthProfiles():Promise<Array<main.BandwidthProfile>>;
+
+export function GetCategories():Promise<Array<main.Category>>;
+
+export function GetConflictPolicy():Promise<string>;
+
 export function GetDefaultDownloadPath():Promise<string>;
 
+export function GetDownloadDiagnostics(arg1:number):Promise<main.DownloadDiagnostics>;
+
+export function GetLowSpaceThreshold():Promise<number>;
+
+export function GetMaxHostConnections():Promise<number>;
+
+export function GetPostProcessing():Promise<Array<main.PostStep>>;
+
+export function GetRecentLogs(arg1:number):Promise<Array<main.LogEntry>>;
+
+export function GetSSHSettings():Promise<main.SSHSettings>;
+
+export function GetSchedule():Promise<main.Schedule>;
+
+export function GetSpeedLimit():Promise<number>;
+
+export function GetStreamURL(arg1:number):Promise<string>;
+
 export function Greet(arg1:string):Promise<string>;
 
+export function ImportHistory(arg1:string,arg2:Record<string, string>):Promise<Array<main.ImportResult>>;
+
+export function ImportMetalink(arg1:string,arg2:string,arg3:number,arg4:number):Promise<void>;
+
+export function ImportURLs(arg1:string,arg2:string,arg3:number,arg4:number):Promise<Array<main.ImportResult>>;
+
 export function PauseDownload(arg1:number):Promise<void>;
 
+export function PauseDownloads(arg1:main.BulkSelection):Promise<main.BulkUpdateEvent>;
+
+export function ProbeMedia(arg1:string):Promise<Array<main.MediaVariant>>;
+
+export function ProbeURL(arg1:string):Promise<main.ProbeResult>;
+
+export function QueryDownloads(arg1:main.DownloadFilter):Promise<main.DownloadPage>;
+
+export function ResolveConflict(arg1:string,arg2:string):Promise<void>;
+
 export function ResumeDownload(arg1:number):Promise<void>;
 
+export function ResumeDownloads(arg1:main.BulkSelection):Promise<main.BulkUpdateEvent>;
+
+export function ScheduleDownload(arg1:number,arg2:boolean,arg3:number):Promise<void>;
+
+export function SetBandwidthProfiles(arg1:Array<main.BandwidthProfile>):Promise<void>;
+
+export function SetCategories(arg1:Array<main.Category>):Promise<void>;
+
+export function SetConflictPolicy(arg1:string):Promise<void>;
+
+export function SetLowSpaceThreshold(arg1:number):Promise<void>;
+
+export function SetMaxHostConnections(arg1:number):Promise<void>;
+
+export function SetPostProcessing(arg1:Array<main.PostStep>):Promise<void>;
+
+export function SetSSHSettings(arg1:main.SSHSettings):Promise<void>;
+
+export function SetSchedule(arg1:main.Schedule):Promise<void>;
+
+export function SetSequential(arg1:number,arg2:boolean):Promise<void>;
+
+export function SetSpeedLimit(arg1:number):Promise<void>;
+
 export function ShowDirectoryDialog(arg1:string):Promise<string>;
 
 export function ShowFileDialog(arg1:string,arg2:string):Promise<string>;
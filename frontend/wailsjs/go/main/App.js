@@ -2,34 +2,186 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function AddAutoDownload(arg1, arg2) {
+  return window['go']['main']['App']['AddAutoDownload'](arg1, arg2);
+}
+
 export function AddDownload(arg1, arg2, arg3, arg4) {
   return window['go']['main']['App']['AddDownload'](arg1, arg2, arg3, arg4);
 }
 
-export function AllDownloads() {
-  return window['go']['main']['App']['AllDownloads']();
+export function AddMediaDownload(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['AddMediaDownload'](arg1, arg2, arg3, arg4);
+}
+
+export function AddTorrent(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['AddTorrent'](arg1, arg2, arg3, arg4);
+}
+
+export function AllDownloads(arg1) {
+  return window['go']['main']['App']['AllDownloads'](arg1);
 }
 
 export function CancelDownload(arg1) {
   return window['go']['main']['App']['CancelDownload'](arg1);
 }
 
+export function CancelDownloads(arg1) {
+  return window['go']['main']['App']['CancelDownloads'](arg1);
+}
+
+export function ExportHistory(arg1, arg2) {
+  return window['go']['main']['App']['ExportHistory'](arg1, arg2);
+}
+
+export function GetActiveBandwidthProfile() {
+  return window['go']['main']['App']['GetActiveBandwidthProfile']();
+}
+
+export function GetBandwidthProfiles() {
+  return window['go']['main']['App']['GetBandwidthProfiles']();
+}
+
+export function GetCategories() {
+  return window['go']['main']['App']['GetCategories']();
+}
+
+export function GetConflictPolicy() {
+  return window['go']['main']['App']['GetConflictPolicy']();
+}
+
 export function GetDefaultDownloadPath() {
   return window['go']['main']['App']['GetDefaultDownloadPath']();
 }
 
+export function GetDownloadDiagnostics(arg1) {
+  return window['go']['main']['App']['GetDownloadDiagnostics'](arg1);
+}
+
+export function GetLowSpaceThreshold() {
+  return window['go']['main']['App']['GetLowSpaceThreshold']();
+}
+
+export function GetMaxHostConnections() {
+  return window['go']['main']['App']['GetMaxHostConnections']();
+}
+
+export function GetPostProcessing() {
+  return window['go']['main']['App']['GetPostProcessing']();
+}
+
+export function GetRecentLogs(arg1) {
+  return window['go']['main']['App']['GetRecentLogs'](arg1);
+}
+
+export function GetSSHSettings() {
+  return window['go']['main']['App']['GetSSHSettings']();
+}
+
+export function GetSchedule() {
+  return window['go']['main']['App']['GetSchedule']();
+}
+
+export function GetSpeedLimit() {
+  return window['go']['main']['App']['GetSpeedLimit']();
+}
+
+export function GetStreamURL(arg1) {
+  return window['go']['main']['App']['GetStreamURL'](arg1);
+}
+
 export function Greet(arg1) {
   return window['go']['main']['App']['Greet'](arg1);
 }
 
+export function ImportHistory(arg1, arg2) {
+  return window['go']['main']['App']['ImportHistory'](arg1, arg2);
+}
+
+export function ImportMetalink(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['ImportMetalink'](arg1, arg2, arg3, arg4);
+}
+
+export function ImportURLs(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['ImportURLs'](arg1, arg2, arg3, arg4);
+}
+
 export function PauseDownload(arg1) {
   return window['go']['main']['App']['PauseDownload'](arg1);
 }
 
+export function PauseDownloads(arg1) {
+  return window['go']['main']['App']['PauseDownloads'](arg1);
+}
+
+export function ProbeMedia(arg1) {
+  return window['go']['main']['App']['ProbeMedia'](arg1);
+}
+
+export function ProbeURL(arg1) {
+  return window['go']['main']['App']['ProbeURL'](arg1);
+}
+
+export function QueryDownloads(arg1) {
+  return window['go']['main']['App']['QueryDownloads'](arg1);
+}
+
+export function ResolveConflict(arg1, arg2) {
+  return window['go']['main']['App']['ResolveConflict'](arg1, arg2);
+}
+
 export function ResumeDownload(arg1) {
   return window['go']['main']['App']['ResumeDownload'](arg1);
 }
 
+export function ResumeDownloads(arg1) {
+  return window['go']['main']['App']['ResumeDownloads'](arg1);
+}
+
+export function ScheduleDownload(arg1, arg2, arg3) {
+  return window['go']['main']['App']['ScheduleDownload'](arg1, arg2, arg3);
+}
+
+export function SetBandwidthProfiles(arg1) {
+  return window['go']['main']['App']['SetBandwidthProfiles'](arg1);
+}
+
+export function SetCategories(arg1) {
+  return window['go']['main']['App']['SetCategories'](arg1);
+}
+
+export function SetConflictPolicy(arg1) {
+  return window['go']['main']['App']['SetConflictPolicy'](arg1);
+}
+
+export function SetLowSpaceThreshold(arg1) {
+  return window['go']['main']['App']['SetLowSpaceThreshold'](arg1);
+}
+
+export function SetMaxHostConnections(arg1) {
+  return window['go']['main']['App']['SetMaxHostConnections'](arg1);
+}
+
+export function SetPostProcessing(arg1) {
+  return window['go']['main']['App']['SetPostProcessing'](arg1);
+}
+
+export function SetSSHSettings(arg1) {
+  return window['go']['main']['App']['SetSSHSettings'](arg1);
+}
+
+export function SetSchedule(arg1) {
+  return window['go']['main']['App']['SetSchedule'](arg1);
+}
+
+export function SetSequential(arg1, arg2) {
+  return window['go']['main']['App']['SetSequential'](arg1, arg2);
+}
+
+export function SetSpeedLimit(arg1) {
+  return window['go']['main']['App']['SetSpeedLimit'](arg1);
+}
+
 export function ShowDirectoryDialog(arg1) {
   return window['go']['main']['App']['ShowDirectoryDialog'](arg1);
 }
@@ -21,6 +21,172 @@ export namespace http {
 
 export namespace main {
 	
+	export class ScheduleWindow {
+	    days: number[];
+	    start: string;
+	    stop: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ScheduleWindow(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.days = source["days"];
+	        this.start = source["start"];
+	        this.stop = source["stop"];
+	    }
+	}
+	export class BandwidthProfile {
+	    name: string;
+	    limit: number;
+	    windows: ScheduleWindow[];
+	
+	    static createFrom(source: any = {}) {
+	        return new BandwidthProfile(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.limit = source["limit"];
+	        this.windows = this.convertValues(source["windows"], ScheduleWindow);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class BandwidthProfileEvent {
+	    name: string;
+	    limit: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new BandwidthProfileEvent(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.limit = source["limit"];
+	    }
+	}
+	export class DownloadFilter {
+	    states: number[];
+	    category: string;
+	    search: string;
+	    created_after: number;
+	    created_before: number;
+	    sort_by: string;
+	    sort_desc: boolean;
+	    offset: number;
+	    limit: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new DownloadFilter(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.states = source["states"];
+	        this.category = source["category"];
+	        this.search = source["search"];
+	        this.created_after = source["created_after"];
+	        this.created_before = source["created_before"];
+	        this.sort_by = source["sort_by"];
+	        this.sort_desc = source["sort_desc"];
+	        this.offset = source["offset"];
+	        this.limit = source["limit"];
+	    }
+	}
+	export class BulkSelection {
+	    ids: number[];
+	    filter?: DownloadFilter;
+	
+	    static createFrom(source: any = {}) {
+	        return new BulkSelection(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.ids = source["ids"];
+	        this.filter = this.convertValues(source["filter"], DownloadFilter);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class BulkUpdateEvent {
+	    action: string;
+	    state: number;
+	    downloadIds: number[];
+	    rejected?: number[];
+	
+	    static createFrom(source: any = {}) {
+	        return new BulkUpdateEvent(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.action = source["action"];
+	        this.state = source["state"];
+	        this.downloadIds = source["downloadIds"];
+	        this.rejected = source["rejected"];
+	    }
+	}
+	export class Category {
+	    name: string;
+	    extensions: string[];
+	    mime_types: string[];
+	    url_patterns: string[];
+	    dir: string;
+	    chunks: number;
+	    workers: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new Category(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.extensions = source["extensions"];
+	        this.mime_types = source["mime_types"];
+	        this.url_patterns = source["url_patterns"];
+	        this.dir = source["dir"];
+	        this.chunks = source["chunks"];
+	        this.workers = source["workers"];
+	    }
+	}
 	export class ChunkInfo {
 	    id: number;
 	    start_byte: number;
@@ -28,6 +194,8 @@ export namespace main {
 	    written: number;
 	    index: number;
 	    state: number;
+	    url?: string;
+	    whole?: boolean;
 	
 	    static createFrom(source: any = {}) {
 	        return new ChunkInfo(source);
@@ -41,7 +209,93 @@ export namespace main {
 	        this.written = source["written"];
 	        this.index = source["index"];
 	        this.state = source["state"];
+	        this.url = source["url"];
+	        this.whole = source["whole"];
+	    }
+	}
+	export class ChunkThroughput {
+	    index: number;
+	    size: number;
+	    written: number;
+	    state: number;
+	    bytes: number;
+	    duration: number;
+	    speed: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ChunkThroughput(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.index = source["index"];
+	        this.size = source["size"];
+	        this.written = source["written"];
+	        this.state = source["state"];
+	        this.bytes = source["bytes"];
+	        this.duration = source["duration"];
+	        this.speed = source["speed"];
+	    }
+	}
+	export class PostStep {
+	    type: string;
+	    dir?: string;
+	    mode?: string;
+	    command?: string;
+	    args?: string[];
+	
+	    static createFrom(source: any = {}) {
+	        return new PostStep(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.type = source["type"];
+	        this.dir = source["dir"];
+	        this.mode = source["mode"];
+	        this.command = source["command"];
+	        this.args = source["args"];
+	    }
+	}
+	export class PostStepResult {
+	    id: number;
+	    downloadId: number;
+	    index: number;
+	    step: PostStep;
+	    status: string;
+	    output: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new PostStepResult(source);
 	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.downloadId = source["downloadId"];
+	        this.index = source["index"];
+	        this.step = this.convertValues(source["step"], PostStep);
+	        this.status = source["status"];
+	        this.output = source["output"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
 	}
 	export class Download {
 	    id: number;
@@ -53,6 +307,24 @@ export namespace main {
 	    state: number;
 	    completed_chunks: number;
 	    workers: number;
+	    mirrors?: string[];
+	    checksum_type?: string;
+	    checksum?: string;
+	    piece_length?: number;
+	    kind?: string;
+	    conflict_policy?: string;
+	    post_steps?: PostStepResult[];
+	    category?: string;
+	    scheduled: boolean;
+	    start_at?: number;
+	    created_at: number;
+	    started_at: number;
+	    completed_at: number;
+	    last_error?: string;
+	    bytes_downloaded: number;
+	    average_speed: number;
+	    sequential: boolean;
+	    auto: boolean;
 	
 	    static createFrom(source: any = {}) {
 	        return new Download(source);
@@ -69,6 +341,342 @@ export namespace main {
 	        this.state = source["state"];
 	        this.completed_chunks = source["completed_chunks"];
 	        this.workers = source["workers"];
+	        this.mirrors = source["mirrors"];
+	        this.checksum_type = source["checksum_type"];
+	        this.checksum = source["checksum"];
+	        this.piece_length = source["piece_length"];
+	        this.kind = source["kind"];
+	        this.conflict_policy = source["conflict_policy"];
+	        this.post_steps = this.convertValues(source["post_steps"], PostStepResult);
+	        this.category = source["category"];
+	        this.scheduled = source["scheduled"];
+	        this.start_at = source["start_at"];
+	        this.created_at = source["created_at"];
+	        this.started_at = source["started_at"];
+	        this.completed_at = source["completed_at"];
+	        this.last_error = source["last_error"];
+	        this.bytes_downloaded = source["bytes_downloaded"];
+	        this.average_speed = source["average_speed"];
+	        this.sequential = source["sequential"];
+	        this.auto = source["auto"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class DownloadEvent {
+	    id: number;
+	    download_id: number;
+	    time: number;
+	    type: string;
+	    chunk: number;
+	    message: string;
+	    status_code?: number;
+	    retries?: number;
+	    bytes?: number;
+	    duration?: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new DownloadEvent(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.download_id = source["download_id"];
+	        this.time = source["time"];
+	        this.type = source["type"];
+	        this.chunk = source["chunk"];
+	        this.message = source["message"];
+	        this.status_code = source["status_code"];
+	        this.retries = source["retries"];
+	        this.bytes = source["bytes"];
+	        this.duration = source["duration"];
+	    }
+	}
+	export class ProbeDiagnostics {
+	    url: string;
+	    final_url?: string;
+	    status_code?: number;
+	    protocol: string;
+	    remote_addr?: string;
+	    headers?: Record<string, string>;
+	    error?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ProbeDiagnostics(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.url = source["url"];
+	        this.final_url = source["final_url"];
+	        this.status_code = source["status_code"];
+	        this.protocol = source["protocol"];
+	        this.remote_addr = source["remote_addr"];
+	        this.headers = source["headers"];
+	        this.error = source["error"];
+	    }
+	}
+	export class DownloadDiagnostics {
+	    download_id: number;
+	    url: string;
+	    path: string;
+	    size: number;
+	    state: number;
+	    last_error?: string;
+	    generated_at: number;
+	    probe?: ProbeDiagnostics;
+	    chunks: ChunkThroughput[];
+	    events: DownloadEvent[];
+	
+	    static createFrom(source: any = {}) {
+	        return new DownloadDiagnostics(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.download_id = source["download_id"];
+	        this.url = source["url"];
+	        this.path = source["path"];
+	        this.size = source["size"];
+	        this.state = source["state"];
+	        this.last_error = source["last_error"];
+	        this.generated_at = source["generated_at"];
+	        this.probe = this.convertValues(source["probe"], ProbeDiagnostics);
+	        this.chunks = this.convertValues(source["chunks"], ChunkThroughput);
+	        this.events = this.convertValues(source["events"], DownloadEvent);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	
+	export class DownloadSummary {
+	    id: number;
+	    url: string;
+	    path: string;
+	    size: number;
+	    state: number;
+	    category?: string;
+	    kind?: string;
+	    chunks: number;
+	    completed_chunks: number;
+	    written: number;
+	    created_at: number;
+	    started_at: number;
+	    completed_at: number;
+	    last_error?: string;
+	    bytes_downloaded: number;
+	    average_speed: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new DownloadSummary(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.url = source["url"];
+	        this.path = source["path"];
+	        this.size = source["size"];
+	        this.state = source["state"];
+	        this.category = source["category"];
+	        this.kind = source["kind"];
+	        this.chunks = source["chunks"];
+	        this.completed_chunks = source["completed_chunks"];
+	        this.written = source["written"];
+	        this.created_at = source["created_at"];
+	        this.started_at = source["started_at"];
+	        this.completed_at = source["completed_at"];
+	        this.last_error = source["last_error"];
+	        this.bytes_downloaded = source["bytes_downloaded"];
+	        this.average_speed = source["average_speed"];
+	    }
+	}
+	export class DownloadPage {
+	    total: number;
+	    downloads: DownloadSummary[];
+	
+	    static createFrom(source: any = {}) {
+	        return new DownloadPage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.total = source["total"];
+	        this.downloads = this.convertValues(source["downloads"], DownloadSummary);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	export class ImportResult {
+	    line: number;
+	    url: string;
+	    path: string;
+	    added: boolean;
+	    error?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ImportResult(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.line = source["line"];
+	        this.url = source["url"];
+	        this.path = source["path"];
+	        this.added = source["added"];
+	        this.error = source["error"];
+	    }
+	}
+	export class LogEntry {
+	    time: string;
+	    level: string;
+	    msg: string;
+	    download_id?: number;
+	    chunk?: number;
+	    url?: string;
+	    err?: string;
+	    fields?: Record<string, any>;
+	
+	    static createFrom(source: any = {}) {
+	        return new LogEntry(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.time = source["time"];
+	        this.level = source["level"];
+	        this.msg = source["msg"];
+	        this.download_id = source["download_id"];
+	        this.chunk = source["chunk"];
+	        this.url = source["url"];
+	        this.err = source["err"];
+	        this.fields = source["fields"];
+	    }
+	}
+	export class MediaVariant {
+	    bandwidth: number;
+	    width?: number;
+	    height?: number;
+	    codecs?: string;
+	    mime_type?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new MediaVariant(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.bandwidth = source["bandwidth"];
+	        this.width = source["width"];
+	        this.height = source["height"];
+	        this.codecs = source["codecs"];
+	        this.mime_type = source["mime_type"];
+	    }
+	}
+	
+	
+	
+	export class ProbeResult {
+	    size: number;
+	    file_name: string;
+	    mime_type: string;
+	    accepts_ranges: boolean;
+	    final_url: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ProbeResult(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.size = source["size"];
+	        this.file_name = source["file_name"];
+	        this.mime_type = source["mime_type"];
+	        this.accepts_ranges = source["accepts_ranges"];
+	        this.final_url = source["final_url"];
+	    }
+	}
+	export class SSHSettings {
+	    key_file: string;
+	    agent_socket: string;
+	    known_hosts_file: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new SSHSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.key_file = source["key_file"];
+	        this.agent_socket = source["agent_socket"];
+	        this.known_hosts_file = source["known_hosts_file"];
+	    }
+	}
+	export class Schedule {
+	    enabled: boolean;
+	    windows: ScheduleWindow[];
+	    queue_new: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new Schedule(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.enabled = source["enabled"];
+	        this.windows = this.convertValues(source["windows"], ScheduleWindow);
+	        this.queue_new = source["queue_new"];
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
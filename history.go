@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyVersion is bumped when the export format changes incompatibly
+const historyVersion = 1
+
+// HistoryExport is the JSON document written by ExportHistory
+type HistoryExport struct {
+	Version    int               `json:"version"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Downloads  []HistoryDownload `json:"downloads"`
+}
+
+// HistoryDownload is a download as it is stored in the database
+type HistoryDownload struct {
+	ID              int64          `json:"id"`
+	URL             string         `json:"url"`
+	Path            string         `json:"path"`
+	Size            int64          `json:"size"`
+	Chunks          int            `json:"chunks"`
+	Workers         int            `json:"workers"`
+	State           string         `json:"state"`
+	Mirrors         []string       `json:"mirrors,omitempty"`
+	ChecksumType    string         `json:"checksum_type,omitempty"`
+	Checksum        string         `json:"checksum,omitempty"`
+	PieceLength     int64          `json:"piece_length,omitempty"`
+	PieceType       string         `json:"piece_type,omitempty"`
+	PieceHashes     []string       `json:"piece_hashes,omitempty"`
+	Kind            DownloadKind   `json:"kind,omitempty"`
+	TorrentInfo     []byte         `json:"torrent_info,omitempty"`
+	ConflictPolicy  ConflictPolicy `json:"conflict_policy,omitempty"`
+	Category        string         `json:"category,omitempty"`
+	Scheduled       bool           `json:"scheduled,omitempty"`
+	StartAt         int64          `json:"start_at,omitempty"`
+	CreatedAt       int64          `json:"created_at,omitempty"`
+	StartedAt       int64          `json:"started_at,omitempty"`
+	CompletedAt     int64          `json:"completed_at,omitempty"`
+	LastError       string         `json:"last_error,omitempty"`
+	BytesDownloaded int64          `json:"bytes_downloaded,omitempty"`
+	AverageSpeed    int64          `json:"average_speed,omitempty"`
+	Sequential      bool           `json:"sequential,omitempty"`
+	Auto            bool           `json:"auto,omitempty"`
+	ChunkList       []HistoryChunk `json:"chunk_list"`
+}
+
+type HistoryChunk struct {
+	Index     int    `json:"index"`
+	StartByte int64  `json:"start_byte"`
+	EndByte   int64  `json:"end_byte"`
+	Written   int64  `json:"written"`
+	State     string `json:"state"`
+	URL       string `json:"url,omitempty"`
+	KeyURL    string `json:"key_url,omitempty"`
+	KeyIV     string `json:"key_iv,omitempty"`
+	Whole     bool   `json:"whole,omitempty"`
+}
+
+func parseState(name string) (DownloadState, error) {
+	for _, s := range allStates {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown state %q", name)
+}
+
+// historyDownloads reads every download and its chunks from the database
+func (dm *DownloadManager) historyDownloads() ([]HistoryDownload, error) {
+	rows, err := dm.DB.Query("SELECT " + downloadColumns + " FROM downloads ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var downloads []*Download
+	for rows.Next() {
+		d, err := scanDownload(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		downloads = append(downloads, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	history := make([]HistoryDownload, 0, len(downloads))
+	for _, d := range downloads {
+		if err := dm.loadChunks(d); err != nil {
+			return nil, err
+		}
+		h := HistoryDownload{
+			ID:              d.ID,
+			URL:             d.URL,
+			Path:            d.TargetPath,
+			Size:            d.TotalSize,
+			Chunks:          d.ChunkCount,
+			Workers:         d.WorkersCount,
+			State:           d.State.String(),
+			Mirrors:         d.Mirrors,
+			ChecksumType:    d.ChecksumType,
+			Checksum:        d.Checksum,
+			PieceLength:     d.PieceLength,
+			PieceType:       d.PieceType,
+			PieceHashes:     d.PieceHashes,
+			Kind:            d.Kind,
+			TorrentInfo:     d.TorrentInfo,
+			ConflictPolicy:  d.ConflictPolicy,
+			Category:        d.Category,
+			Scheduled:       d.Scheduled,
+			StartAt:         d.StartAt,
+			CreatedAt:       d.CreatedAt,
+			StartedAt:       d.StartedAt,
+			CompletedAt:     d.CompletedAt,
+			LastError:       d.LastError,
+			BytesDownloaded: d.BytesDownloaded,
+			AverageSpeed:    d.AverageSpeed,
+			Sequential:      d.Sequential,
+			Auto:            d.Auto,
+			ChunkList:       make([]HistoryChunk, 0, len(d.Chunks)),
+		}
+		for _, c := range d.Chunks {
+			h.ChunkList = append(h.ChunkList, HistoryChunk{
+				Index:     c.Index,
+				StartByte: c.StartByte,
+				EndByte:   c.EndByte,
+				Written:   c.Written,
+				State:     c.State.String(),
+				URL:       c.URL,
+				KeyURL:    c.KeyURL,
+				KeyIV:     c.KeyIV,
+				Whole:     c.Whole,
+			})
+		}
+		history = append(history, h)
+	}
+	return history, nil
+}
+
+// ExportHistory writes every download with its chunks to path, as JSON or,
+// one row per download without the chunks, as CSV. An empty format is taken
+// from the file extension.
+func (dm *DownloadManager) ExportHistory(path, format string) error {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+
+	history, err := dm.historyDownloads()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if format == "json" {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(HistoryExport{
+			Version:    historyVersion,
+			ExportedAt: time.Now().UTC(),
+			Downloads:  history,
+		})
+	} else {
+		err = writeHistoryCSV(f, history)
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// the CSV's url, path, checksum_type and checksum columns can be read back
+// by ImportURLs and ImportHistory
+var historyCSVHeader = []string{"id", "url", "path", "size", "state", "category", "checksum_type", "checksum", "chunks", "chunks_completed", "bytes_written", "mirrors",
+	"created_at", "started_at", "completed_at", "last_error", "bytes_downloaded", "average_speed"}
+
+func writeHistoryCSV(f *os.File, history []HistoryDownload) error {
+	w := csv.NewWriter(f)
+	if err := w.Write(historyCSVHeader); err != nil {
+		return err
+	}
+	for _, h := range history {
+		var completed int
+		var written int64
+		for _, c := range h.ChunkList {
+			if c.State == StateCompleted.String() {
+				completed++
+			}
+			written += c.Written
+		}
+		err := w.Write([]string{
+			strconv.FormatInt(h.ID, 10),
+			h.URL,
+			h.Path,
+			strconv.FormatInt(h.Size, 10),
+			h.State,
+			h.Category,
+			h.ChecksumType,
+			h.Checksum,
+			strconv.Itoa(h.Chunks),
+			strconv.Itoa(completed),
+			strconv.FormatInt(written, 10),
+			strings.Join(h.Mirrors, " "),
+			formatTime(h.CreatedAt),
+			formatTime(h.StartedAt),
+			formatTime(h.CompletedAt),
+			h.LastError,
+			strconv.FormatInt(h.BytesDownloaded, 10),
+			strconv.FormatInt(h.AverageSpeed, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// formatTime writes Unix seconds as RFC 3339 for spreadsheets, leaving unset
+// times empty
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// remapPath moves path to the new directory of the longest matching old
+// directory in remap
+func remapPath(path string, remap map[string]string) string {
+	olds := make([]string, 0, len(remap))
+	for old := range remap {
+		olds = append(olds, old)
+	}
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+
+	for _, old := range olds {
+		clean := strings.TrimRight(old, `/\`)
+		if path == clean {
+			return remap[old]
+		}
+		for _, sep := range []string{"/", `\`} {
+			if rest, ok := strings.CutPrefix(path, clean+sep); ok {
+				return filepath.Join(remap[old], filepath.FromSlash(strings.ReplaceAll(rest, `\`, "/")))
+			}
+		}
+	}
+	return path
+}
+
+// ImportHistory recreates the unfinished downloads of an export, JSON or
+// CSV, read from path. Target directories are moved according to remap,
+// old directory to new. Downloads come back paused, keeping the progress of
+// chunks whose part files are found at the new location; finished and
+// cancelled downloads and ones already in the queue are skipped.
+func (dm *DownloadManager) ImportHistory(path string, remap map[string]string) ([]ImportResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(data) {
+		return dm.importHistoryCSV(string(data), remap)
+	}
+
+	var export HistoryExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if export.Version > historyVersion {
+		return nil, fmt.Errorf("export version %d is newer than supported version %d", export.Version, historyVersion)
+	}
+
+	results := make([]ImportResult, 0, len(export.Downloads))
+	for i, h := range export.Downloads {
+		h.Path = remapPath(h.Path, remap)
+		result := ImportResult{Line: i + 1, URL: h.URL, Path: h.Path}
+		if err := dm.importHistoryDownload(h); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Added = true
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// importHistoryCSV re-adds the unfinished downloads of a CSV export like an
+// imported URL list, since it has no chunks to restore
+func (dm *DownloadManager) importHistoryCSV(text string, remap map[string]string) ([]ImportResult, error) {
+	if !isCSVList(text) {
+		return nil, errors.New("not a JSON or CSV export")
+	}
+	entries, err := parseCSVList(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ImportResult
+	for _, entry := range entries {
+		entry.path = remapPath(entry.path, remap)
+		result := ImportResult{Line: entry.line, Path: entry.path}
+		if len(entry.urls) > 0 {
+			result.URL = entry.urls[0]
+		}
+		switch {
+		case entry.err != nil:
+			result.Error = entry.err.Error()
+		case entry.state == StateCompleted.String() || entry.state == StateCancelled.String():
+			result.Error = "download is " + entry.state
+		default:
+			path, err := dm.importEntry(entry, "", 0, 0)
+			result.Path = path
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Added = true
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// importHistoryDownload recreates one exported download, queued if it was
+// queued and paused otherwise. Its target is checked for conflicts like a new
+// download's, and part files only carry over when it keeps its path.
+func (dm *DownloadManager) importHistoryDownload(h HistoryDownload) error {
+	state, err := parseState(h.State)
+	if err != nil {
+		return err
+	}
+	if state == StateCompleted || state == StateCancelled {
+		return fmt.Errorf("download is %s", h.State)
+	}
+	if h.Auto && h.Size <= 0 {
+		return errors.New("auto download has no size")
+	}
+	// auto downloads may be exported before their first chunk was cut
+	if len(h.ChunkList) == 0 && !h.Auto {
+		return errors.New("download has no chunks")
+	}
+
+	dm.Mutex.Lock()
+	_, err = dm.getDownload(h.URL, h.Path)
+	dm.Mutex.Unlock()
+	if err == nil {
+		return errors.New("download is already in the queue")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.Path), 0700); err != nil {
+		return fmt.Errorf("failed to create target directory: %w", err)
+	}
+	if state != StateQueued {
+		state = StatePaused
+	}
+
+	d := &Download{
+		URL:             h.URL,
+		TargetPath:      h.Path,
+		TotalSize:       h.Size,
+		ChunkCount:      len(h.ChunkList),
+		WorkersCount:    min(h.Workers, len(h.ChunkList)),
+		State:           state,
+		Mirrors:         h.Mirrors,
+		ChecksumType:    h.ChecksumType,
+		Checksum:        h.Checksum,
+		PieceLength:     h.PieceLength,
+		PieceType:       h.PieceType,
+		PieceHashes:     h.PieceHashes,
+		Kind:            h.Kind,
+		TorrentInfo:     h.TorrentInfo,
+		ConflictPolicy:  h.ConflictPolicy,
+		Category:        h.Category,
+		Scheduled:       h.Scheduled,
+		StartAt:         h.StartAt,
+		CreatedAt:       h.CreatedAt,
+		StartedAt:       h.StartedAt,
+		LastError:       h.LastError,
+		BytesDownloaded: h.BytesDownloaded,
+		AverageSpeed:    h.AverageSpeed,
+		Sequential:      h.Sequential,
+		Auto:            h.Auto,
+	}
+	if d.Auto {
+		// the worker count was tuned, not bounded by the chunks cut so far
+		d.WorkersCount = h.Workers
+	}
+	d.WorkersCount = max(d.WorkersCount, 1)
+
+	target, outcome, err := dm.ResolveConflict(context.Background(), d, d.TargetPath)
+	if err != nil {
+		return err
+	}
+	switch outcome {
+	case conflictSkip:
+		return fmt.Errorf("%w: %s", ErrTargetExists, target)
+	case conflictExisting:
+		d.State = StateCompleted
+	}
+	d.TargetPath = target
+
+	for _, c := range h.ChunkList {
+		chunk := &ChunkInfo{
+			Index:     c.Index,
+			StartByte: c.StartByte,
+			EndByte:   c.EndByte,
+			State:     StatePaused,
+			URL:       c.URL,
+			KeyURL:    c.KeyURL,
+			KeyIV:     c.KeyIV,
+			// older exports mark chunks fetched whole by an empty range
+			Whole: c.Whole || c.EndByte < c.StartByte,
+		}
+		d.Chunks = append(d.Chunks, chunk)
+		if d.State == StateCompleted {
+			chunk.State = StateCompleted
+			chunk.Written = max(chunk.Size(), 0)
+			d.CompletedChunks++
+			continue
+		}
+
+		// progress only carries over when the part file came along
+		info, err := os.Stat(d.partPath(chunk))
+		if err != nil {
+			continue
+		}
+		chunk.Written = min(c.Written, info.Size())
+		if c.State == StateCompleted.String() && chunk.Written == c.Written {
+			chunk.State = StateCompleted
+			d.CompletedChunks++
+		}
+	}
+	if err := d.Initialize(); err != nil {
+		return err
+	}
+
+	// another download may have been added to the same target meanwhile
+	dm.Mutex.Lock()
+	defer dm.Mutex.Unlock()
+	if taken, err := dm.targetTaken(d, d.TargetPath); err != nil {
+		return err
+	} else if taken {
+		return fmt.Errorf("%w: %s is being downloaded", ErrTargetExists, d.TargetPath)
+	}
+	return dm.saveDownload(d)
+}
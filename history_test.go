@@ -0,0 +1,170 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestManager opens a download manager on a database in a temporary
+// directory, closing it when the test ends
+func newTestManager(t *testing.T) *DownloadManager {
+	t.Helper()
+	dm, err := NewDownloadManager(filepath.Join(t.TempDir(), dbFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := dm.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return dm
+}
+
+func TestHistoryKeepsAutoDownloads(t *testing.T) {
+	dir := t.TempDir()
+	source := newTestManager(t)
+
+	// paused before its first chunk was cut
+	d := &Download{
+		URL:          "http://example.com/file.iso",
+		TargetPath:   filepath.Join(dir, "file.iso"),
+		TotalSize:    10 << 20,
+		WorkersCount: 4,
+		State:        StatePaused,
+		Auto:         true,
+		Sequential:   true,
+	}
+	source.Mutex.Lock()
+	err := source.saveDownload(d)
+	source.Mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export := filepath.Join(dir, "history.json")
+	if err := source.ExportHistory(export, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	target := newTestManager(t)
+	results, err := target.ImportHistory(export, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].Added {
+		t.Fatalf("import results %+v", results)
+	}
+
+	imported, err := target.getDownload(d.URL, d.TargetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imported.Auto || !imported.Sequential {
+		t.Errorf("auto %v, sequential %v after import", imported.Auto, imported.Sequential)
+	}
+	if imported.WorkersCount != 4 {
+		t.Errorf("workers %d after import, want 4", imported.WorkersCount)
+	}
+	if len(imported.Chunks) != 0 {
+		t.Errorf("%d chunks after import, want none", len(imported.Chunks))
+	}
+}
+
+func TestHistoryImportKeepsQueuedAndChecksTarget(t *testing.T) {
+	dir := t.TempDir()
+	source := newTestManager(t)
+
+	queued := &Download{
+		URL:        "http://example.com/queued.iso",
+		TargetPath: filepath.Join(dir, "queued.iso"),
+		TotalSize:  1024,
+		ChunkCount: 1,
+		State:      StateQueued,
+		Chunks:     splitChunks(1024, 1, 0),
+	}
+	clash := &Download{
+		URL:        "http://example.com/other.iso",
+		TargetPath: filepath.Join(dir, "shared.iso"),
+		TotalSize:  1024,
+		ChunkCount: 1,
+		State:      StatePaused,
+		Chunks:     splitChunks(1024, 1, 0),
+	}
+	source.Mutex.Lock()
+	err := source.saveDownload(queued)
+	if err == nil {
+		err = source.saveDownload(clash)
+	}
+	source.Mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := filepath.Join(dir, "history.json")
+	if err := source.ExportHistory(export, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the importing side already downloads another file to shared.iso
+	target := newTestManager(t)
+	existing := &Download{
+		URL:        "http://example.com/shared.iso",
+		TargetPath: clash.TargetPath,
+		TotalSize:  2048,
+		ChunkCount: 1,
+		State:      StatePaused,
+		Chunks:     splitChunks(2048, 1, 0),
+	}
+	target.Mutex.Lock()
+	err = target.saveDownload(existing)
+	target.Mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := target.ImportHistory(export, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Added || !results[1].Added {
+		t.Fatalf("import results %+v", results)
+	}
+
+	imported, err := target.getDownload(queued.URL, queued.TargetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.State != StateQueued {
+		t.Errorf("queued download imported as %s", imported.State)
+	}
+
+	if _, err := target.getDownload(clash.URL, clash.TargetPath); err == nil {
+		t.Fatal("imported download shares its target with an existing one")
+	}
+	renamed, err := target.getDownload(clash.URL, filepath.Join(dir, "shared (1).iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.State != StatePaused {
+		t.Errorf("paused download imported as %s", renamed.State)
+	}
+
+	// skipping leaves the taken target alone
+	if err := target.SetConflictPolicy(ConflictSkip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.DB.Exec("DELETE FROM downloads WHERE id=?", renamed.ID); err != nil {
+		t.Fatal(err)
+	}
+	target.Mutex.Lock()
+	delete(target.Downloads, renamed.ID)
+	target.Mutex.Unlock()
+	results, err = target.ImportHistory(export, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[1].Added || !strings.Contains(results[1].Error, "exists") {
+		t.Fatalf("import results %+v", results)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LogMaxSize is the size, in bytes, at which the log file is rotated
+var LogMaxSize int64 = 5 * 1024 * 1024
+
+// LogBackups is how many rotated log files are kept besides the current one
+var LogBackups = 3
+
+// recentLogLimit caps the entries returned by RecentLogs
+const recentLogLimit = 500
+
+// logger writes to stdout until setupLogging adds the log file
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// logPath is the file the log is written to, empty when it is only printed
+var logPath string
+
+// LogEntry is one record read back from the log file
+type LogEntry struct {
+	Time       string         `json:"time"`
+	Level      string         `json:"level"`
+	Message    string         `json:"msg"`
+	DownloadID int64          `json:"download_id,omitempty"`
+	Chunk      *int           `json:"chunk,omitempty"`
+	URL        string         `json:"url,omitempty"`
+	Error      string         `json:"err,omitempty"`
+	Fields     map[string]any `json:"fields,omitempty"`
+}
+
+// setupLogging writes the log as JSON lines to a rotated file in the logs
+// directory of the data directory, and as text to stdout for development
+func setupLogging(dataDir string) error {
+	dir := filepath.Join(dataDir, "logs")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, "d4c.log")
+	file, err := openRotatingFile(path)
+	if err != nil {
+		return err
+	}
+
+	logger = slog.New(teeHandler{
+		slog.NewTextHandler(os.Stdout, nil),
+		slog.NewJSONHandler(file, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	})
+	logPath = path
+	return nil
+}
+
+// log returns the logger for messages about d
+func (d *Download) log() *slog.Logger {
+	return logger.With("download_id", d.ID, "url", d.URL)
+}
+
+// chunkLog returns the logger for messages about one chunk of d, with the
+// URL the chunk is fetched from
+func (d *Download) chunkLog(chunk *ChunkInfo) *slog.Logger {
+	return logger.With("download_id", d.ID, "chunk", chunk.Index, "url", d.sourceURL(chunk))
+}
+
+// rotatingFile is a log file that is renamed to path.1, shifting older
+// backups along, once writing to it would grow it past LogMaxSize
+type rotatingFile struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	size  int64
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, file: file, size: info.Size()}, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > LogMaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	for i := LogBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if LogBackups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = 0
+	return nil
+}
+
+// teeHandler passes records on to several handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// RecentLogs returns the latest log entries about a download, or about
+// anything when downloadID is 0, oldest first. The last rotated file is read
+// too so a rotation doesn't hide what just happened.
+func RecentLogs(downloadID int64) ([]LogEntry, error) {
+	entries := []LogEntry{}
+	if logPath == "" {
+		return entries, nil
+	}
+
+	for _, path := range []string{logPath + ".1", logPath} {
+		file, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry, ok := parseLogEntry(scanner.Bytes())
+			if !ok || (downloadID != 0 && entry.DownloadID != downloadID) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) > 2*recentLogLimit {
+				entries = append(entries[:0], entries[len(entries)-recentLogLimit:]...)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(entries) > recentLogLimit {
+		entries = entries[len(entries)-recentLogLimit:]
+	}
+	return entries, nil
+}
+
+// parseLogEntry reads one JSON line of the log, keeping attributes other
+// than the well known ones in Fields
+func parseLogEntry(line []byte) (LogEntry, bool) {
+	var record map[string]any
+	if err := json.Unmarshal(line, &record); err != nil {
+		return LogEntry{}, false
+	}
+
+	var entry LogEntry
+	for key, value := range record {
+		switch key {
+		case slog.TimeKey:
+			entry.Time, _ = value.(string)
+		case slog.LevelKey:
+			entry.Level, _ = value.(string)
+		case slog.MessageKey:
+			entry.Message, _ = value.(string)
+		case "download_id":
+			if id, ok := value.(float64); ok {
+				entry.DownloadID = int64(id)
+			}
+		case "chunk":
+			if index, ok := value.(float64); ok {
+				chunk := int(index)
+				entry.Chunk = &chunk
+			}
+		case "url":
+			entry.URL, _ = value.(string)
+		case "err":
+			entry.Error, _ = value.(string)
+		default:
+			if entry.Fields == nil {
+				entry.Fields = map[string]any{}
+			}
+			entry.Fields[key] = value
+		}
+	}
+	return entry, true
+}
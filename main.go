@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"flag"
+	"os"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
@@ -12,11 +16,24 @@ import (
 var assets embed.FS
 
 func main() {
+	dataDirFlag := flag.String("data-dir", "", "directory for the database and logs")
+	portable := flag.Bool("portable", false, "keep the data in a data directory beside the executable")
+	flag.Parse()
+
+	dataDir, err := resolveDataDir(*dataDirFlag, *portable)
+	if err != nil {
+		println("Error:", err.Error())
+		os.Exit(1)
+	}
+	// instances sharing a data directory would share the database, so a
+	// second launch on one brings up the window of the first instead
+	sum := sha256.Sum256([]byte(dataDir))
+
 	// Create an instance of the app structure
-	app := NewApp()
+	app := NewApp(dataDir)
 
 	// Create application with options
-	err := wails.Run(&options.App{
+	err = wails.Run(&options.App{
 		Title:  "d4c",
 		Width:  1024,
 		Height: 768,
@@ -25,6 +42,11 @@ func main() {
 		},
 		BackgroundColour: &options.RGBA{R: 27, G: 38, B: 54, A: 1},
 		OnStartup:        app.startup,
+		OnShutdown:       app.shutdown,
+		SingleInstanceLock: &options.SingleInstanceLock{
+			UniqueId:               "d4c-" + hex.EncodeToString(sum[:8]),
+			OnSecondInstanceLaunch: app.onSecondInstanceLaunch,
+		},
 		Bind: []interface{}{
 			app,
 		},
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MediaVariant describes one rendition of a HLS or DASH stream the user can
+// pick from before downloading
+type MediaVariant struct {
+	Bandwidth int    `json:"bandwidth"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Codecs    string `json:"codecs,omitempty"`
+	MimeType  string `json:"mime_type,omitempty"`
+}
+
+// mediaStream is a variant together with a way to list its segments, which
+// for HLS master playlists means fetching another playlist
+type mediaStream struct {
+	MediaVariant
+	segments func(ctx context.Context, client *http.Client) ([]mediaSegment, error)
+}
+
+// mediaSegment is one file, or byte range of a file, of a stream. End is -1
+// when the whole resource is fetched.
+type mediaSegment struct {
+	URL    string
+	Start  int64
+	End    int64
+	KeyURL string
+	KeyIV  string
+}
+
+// maximum size of a playlist or manifest
+const maxManifestSize = 16 << 20
+
+func fetchManifest(ctx context.Context, client *http.Client, rawURL string) (*url.URL, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching %s: %w", rawURL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("manifest is not available: %v", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxManifestSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	// relative URIs resolve against the final URL after redirects
+	return res.Request.URL, body, nil
+}
+
+// probeMedia lists the variants of the HLS playlist or DASH manifest at rawURL
+func probeMedia(ctx context.Context, client *http.Client, rawURL string) ([]mediaStream, error) {
+	base, body, err := fetchManifest(ctx, client, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("#EXTM3U")):
+		return hlsStreams(base, body)
+	case bytes.Contains(trimmed, []byte("<MPD")):
+		return dashStreams(base, body)
+	default:
+		return nil, errors.New("not a HLS playlist or DASH manifest")
+	}
+}
+
+func ProbeMedia(rawURL string) ([]MediaVariant, error) {
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	streams, err := probeMedia(context.Background(), client, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	variants := make([]MediaVariant, 0, len(streams))
+	for _, s := range streams {
+		variants = append(variants, s.MediaVariant)
+	}
+	return variants, nil
+}
+
+// NewMediaDownload creates a download of the variant at index variant of a
+// HLS or DASH stream. Every segment becomes a chunk and the segments are
+// joined, decrypted where needed, into targetPath.
+func NewMediaDownload(rawURL string, variant int, targetPath string, workers int) (*Download, error) {
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	streams, err := probeMedia(ctx, client, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if variant < 0 || variant >= len(streams) {
+		return nil, fmt.Errorf("variant %d does not exist", variant)
+	}
+
+	segments, err := streams[variant].segments(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("stream has no segments")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create target directory: %v", err)
+	}
+
+	download := &Download{
+		URL:        rawURL,
+		TargetPath: targetPath,
+		State:      StateQueued,
+		Client:     client,
+		Kind:       KindMedia,
+	}
+	for i, s := range segments {
+		chunk := &ChunkInfo{
+			Index:     i,
+			URL:       s.URL,
+			StartByte: s.Start,
+			EndByte:   s.End,
+			Whole:     s.End < 0,
+			KeyURL:    s.KeyURL,
+			KeyIV:     s.KeyIV,
+			State:     StateActive,
+		}
+		if size := chunk.Size(); size > 0 {
+			download.TotalSize += size
+		}
+		download.Chunks = append(download.Chunks, chunk)
+	}
+	download.ChunkCount = len(download.Chunks)
+	download.WorkersCount = min(workers, download.ChunkCount)
+
+	return download, nil
+}
+
+// openPart opens a downloaded chunk for combining, decrypting AES-128
+// encrypted media segments
+func (d *Download) openPart(chunk *ChunkInfo, partPath string) (io.ReadCloser, error) {
+	file, err := os.Open(partPath)
+	if err != nil || chunk.KeyURL == "" {
+		return file, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := d.mediaKey(chunk.KeyURL)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(chunk.KeyIV), "0x"))
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV %q", chunk.KeyIV)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment %d is not a multiple of the block size", chunk.Index)
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	// strip PKCS#7 padding
+	if n := len(data); n > 0 {
+		pad := int(data[n-1])
+		if pad == 0 || pad > aes.BlockSize || pad > n {
+			return nil, fmt.Errorf("invalid padding in segment %d", chunk.Index)
+		}
+		data = data[:n-pad]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// mediaKey fetches an AES-128 key once per download
+func (d *Download) mediaKey(keyURL string) ([]byte, error) {
+	if key, ok := d.mediaKeys[keyURL]; ok {
+		return key, nil
+	}
+
+	res, err := d.Client.Get(keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching key: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key is not available: %v", res.StatusCode)
+	}
+
+	key, err := io.ReadAll(io.LimitReader(res.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("invalid AES-128 key length %d", len(key))
+	}
+
+	if d.mediaKeys == nil {
+		d.mediaKeys = make(map[string][]byte)
+	}
+	d.mediaKeys[keyURL] = key
+	return key, nil
+}
+
+func (dm *DownloadManager) AddMediaDownload(rawURL string, variant int, path string, workers int) error {
+	if restored, err := dm.restoreExisting(rawURL, path); restored || err != nil {
+		return err
+	}
+
+	d, err := NewMediaDownload(rawURL, variant, path, workers)
+	if err != nil {
+		return err
+	}
+	return dm.addNewDownload(d)
+}
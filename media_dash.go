@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Only static (on-demand) manifests with a single period are supported, with
+// segments described by SegmentTemplate, SegmentList or a single BaseURL.
+type dashMPD struct {
+	Type     string       `xml:"type,attr"`
+	Duration string       `xml:"mediaPresentationDuration,attr"`
+	BaseURL  string       `xml:"BaseURL"`
+	Periods  []dashPeriod `xml:"Period"`
+}
+
+type dashPeriod struct {
+	Duration       string              `xml:"duration,attr"`
+	BaseURL        string              `xml:"BaseURL"`
+	AdaptationSets []dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	MimeType        string               `xml:"mimeType,attr"`
+	Codecs          string               `xml:"codecs,attr"`
+	BaseURL         string               `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *dashSegmentList     `xml:"SegmentList"`
+	Representations []dashRepresentation `xml:"Representation"`
+}
+
+type dashRepresentation struct {
+	ID              string               `xml:"id,attr"`
+	Bandwidth       int                  `xml:"bandwidth,attr"`
+	Width           int                  `xml:"width,attr"`
+	Height          int                  `xml:"height,attr"`
+	Codecs          string               `xml:"codecs,attr"`
+	MimeType        string               `xml:"mimeType,attr"`
+	BaseURL         string               `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *dashSegmentList     `xml:"SegmentList"`
+}
+
+type dashSegmentTemplate struct {
+	Media          string         `xml:"media,attr"`
+	Initialization string         `xml:"initialization,attr"`
+	StartNumber    string         `xml:"startNumber,attr"`
+	Timescale      int64          `xml:"timescale,attr"`
+	Duration       int64          `xml:"duration,attr"`
+	Timeline       []dashTimeline `xml:"SegmentTimeline>S"`
+}
+
+type dashTimeline struct {
+	T string `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr"`
+}
+
+type dashSegmentList struct {
+	Initialization *struct {
+		SourceURL string `xml:"sourceURL,attr"`
+		Range     string `xml:"range,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+func dashStreams(base *url.URL, body []byte) ([]mediaStream, error) {
+	var mpd dashMPD
+	if err := xml.Unmarshal(body, &mpd); err != nil {
+		return nil, fmt.Errorf("invalid DASH manifest: %w", err)
+	}
+	if mpd.Type == "dynamic" {
+		return nil, errors.New("live DASH streams are not supported")
+	}
+	if len(mpd.Periods) == 0 {
+		return nil, errors.New("DASH manifest has no periods")
+	}
+
+	period := mpd.Periods[0]
+	duration := parseISODuration(period.Duration)
+	if duration == 0 {
+		duration = parseISODuration(mpd.Duration)
+	}
+
+	periodBase, err := resolveBase(base, mpd.BaseURL, period.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var streams []mediaStream
+	for _, set := range period.AdaptationSets {
+		for _, rep := range set.Representations {
+			repBase, err := resolveBase(periodBase, set.BaseURL, rep.BaseURL)
+			if err != nil {
+				return nil, err
+			}
+
+			variant := MediaVariant{
+				Bandwidth: rep.Bandwidth,
+				Width:     rep.Width,
+				Height:    rep.Height,
+				Codecs:    firstNonEmpty(rep.Codecs, set.Codecs),
+				MimeType:  firstNonEmpty(rep.MimeType, set.MimeType),
+			}
+
+			template := rep.SegmentTemplate
+			if template == nil {
+				template = set.SegmentTemplate
+			}
+			list := rep.SegmentList
+			if list == nil {
+				list = set.SegmentList
+			}
+
+			streams = append(streams, mediaStream{
+				MediaVariant: variant,
+				segments: func(context.Context, *http.Client) ([]mediaSegment, error) {
+					return dashSegments(repBase, rep, template, list, duration)
+				},
+			})
+		}
+	}
+
+	if len(streams) == 0 {
+		return nil, errors.New("DASH manifest has no representations")
+	}
+	return streams, nil
+}
+
+func dashSegments(base *url.URL, rep dashRepresentation, template *dashSegmentTemplate, list *dashSegmentList, duration float64) ([]mediaSegment, error) {
+	switch {
+	case template != nil:
+		return dashTemplateSegments(base, rep, template, duration)
+
+	case list != nil:
+		var segments []mediaSegment
+		if list.Initialization != nil {
+			segment, err := dashSegment(base, list.Initialization.SourceURL, list.Initialization.Range)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+		}
+		for _, s := range list.SegmentURLs {
+			segment, err := dashSegment(base, s.Media, s.MediaRange)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+		}
+		return segments, nil
+
+	default:
+		// a single file, possibly indexed by SegmentBase, fetched whole
+		return []mediaSegment{{URL: base.String(), End: -1}}, nil
+	}
+}
+
+func dashTemplateSegments(base *url.URL, rep dashRepresentation, template *dashSegmentTemplate, duration float64) ([]mediaSegment, error) {
+	var segments []mediaSegment
+	add := func(pattern string, number, time int64) error {
+		segment, err := dashSegment(base, expandDASHTemplate(pattern, rep, number, time), "")
+		if err != nil {
+			return err
+		}
+		segments = append(segments, segment)
+		return nil
+	}
+
+	if template.Initialization != "" {
+		if err := add(template.Initialization, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	timescale := max(template.Timescale, 1)
+	number := int64(1)
+	if template.StartNumber != "" {
+		n, err := strconv.ParseInt(template.StartNumber, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid startNumber %q", template.StartNumber)
+		}
+		number = n
+	}
+
+	if len(template.Timeline) > 0 {
+		var t int64
+		for i, s := range template.Timeline {
+			if s.T != "" {
+				t, _ = strconv.ParseInt(s.T, 10, 64)
+			}
+			if s.D <= 0 {
+				return nil, errors.New("invalid SegmentTimeline entry")
+			}
+
+			repeat := s.R
+			if repeat < 0 {
+				// repeat until the next entry, or the end of the period
+				end := int64(duration * float64(timescale))
+				if i+1 < len(template.Timeline) && template.Timeline[i+1].T != "" {
+					end, _ = strconv.ParseInt(template.Timeline[i+1].T, 10, 64)
+				}
+				repeat = int(math.Ceil(float64(end-t)/float64(s.D))) - 1
+			}
+
+			for range repeat + 1 {
+				if err := add(template.Media, number, t); err != nil {
+					return nil, err
+				}
+				number++
+				t += s.D
+			}
+		}
+		return segments, nil
+	}
+
+	if template.Duration <= 0 || duration <= 0 {
+		return nil, errors.New("cannot determine the number of DASH segments")
+	}
+	count := int64(math.Ceil(duration * float64(timescale) / float64(template.Duration)))
+	for i := range count {
+		if err := add(template.Media, number+i, i*template.Duration); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// dashSegment resolves a segment URL with an optional "first-last" byte range
+func dashSegment(base *url.URL, uri, byteRange string) (mediaSegment, error) {
+	u, err := base.Parse(uri)
+	if err != nil {
+		return mediaSegment{}, fmt.Errorf("invalid segment uri %q: %w", uri, err)
+	}
+	segment := mediaSegment{URL: u.String(), End: -1}
+	if byteRange == "" {
+		return segment, nil
+	}
+
+	first, last, ok := strings.Cut(byteRange, "-")
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if !ok || err1 != nil || err2 != nil || end < start {
+		return mediaSegment{}, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	segment.Start, segment.End = start, end
+	return segment, nil
+}
+
+var dashTemplateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0(\d+)d)?\$|\$\$`)
+
+func expandDASHTemplate(pattern string, rep dashRepresentation, number, time int64) string {
+	return dashTemplateIdentifier.ReplaceAllStringFunc(pattern, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		parts := dashTemplateIdentifier.FindStringSubmatch(match)
+		var value int64
+		switch parts[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			value = number
+		case "Bandwidth":
+			value = int64(rep.Bandwidth)
+		case "Time":
+			value = time
+		}
+
+		if parts[3] != "" {
+			width, _ := strconv.Atoi(parts[3])
+			return fmt.Sprintf("%0*d", width, value)
+		}
+		return strconv.FormatInt(value, 10)
+	})
+}
+
+func resolveBase(base *url.URL, refs ...string) (*url.URL, error) {
+	for _, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BaseURL %q: %w", ref, err)
+		}
+		base = u
+	}
+	return base, nil
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:([\d.]+)D)?(?:T(?:([\d.]+)H)?(?:([\d.]+)M)?(?:([\d.]+)S)?)?$`)
+
+// parseISODuration returns the seconds in an ISO 8601 duration like PT1H2M3.5S
+func parseISODuration(value string) float64 {
+	parts := isoDuration.FindStringSubmatch(strings.TrimSpace(value))
+	if parts == nil {
+		return 0
+	}
+
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if parts[i+1] != "" {
+			n, _ := strconv.ParseFloat(parts[i+1], 64)
+			seconds += n * unit
+		}
+	}
+	return seconds
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
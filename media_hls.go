@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// hlsStreams lists the variants of a master playlist, or the playlist itself
+// when it is already a media playlist
+func hlsStreams(base *url.URL, body []byte) ([]mediaStream, error) {
+	if !bytes.Contains(body, []byte("#EXT-X-STREAM-INF")) {
+		return []mediaStream{{
+			segments: func(context.Context, *http.Client) ([]mediaSegment, error) {
+				return parseHLSMedia(base, body)
+			},
+		}}, nil
+	}
+
+	var streams []mediaStream
+	var attrs map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs = parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+		case line == "" || strings.HasPrefix(line, "#"):
+		case attrs != nil:
+			variantURL, err := base.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid variant uri %q: %w", line, err)
+			}
+
+			variant := MediaVariant{Codecs: attrs["CODECS"]}
+			variant.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+			if w, h, ok := strings.Cut(attrs["RESOLUTION"], "x"); ok {
+				variant.Width, _ = strconv.Atoi(w)
+				variant.Height, _ = strconv.Atoi(h)
+			}
+
+			streams = append(streams, mediaStream{
+				MediaVariant: variant,
+				segments: func(ctx context.Context, client *http.Client) ([]mediaSegment, error) {
+					playlistURL, playlist, err := fetchManifest(ctx, client, variantURL.String())
+					if err != nil {
+						return nil, err
+					}
+					return parseHLSMedia(playlistURL, playlist)
+				},
+			})
+			attrs = nil
+		}
+	}
+	return streams, scanner.Err()
+}
+
+// parseHLSMedia turns a media playlist into segments, including the
+// EXT-X-MAP initialization section of fragmented MP4 streams
+func parseHLSMedia(base *url.URL, body []byte) ([]mediaSegment, error) {
+	var (
+		segments  []mediaSegment
+		sequence  int64
+		keyURL    string
+		keyIV     string
+		byteRange string
+		mapURI    string
+		nextStart = map[string]int64{}
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attrs := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			switch attrs["METHOD"] {
+			case "NONE":
+				keyURL, keyIV = "", ""
+			case "AES-128":
+				u, err := base.Parse(attrs["URI"])
+				if err != nil {
+					return nil, fmt.Errorf("invalid key uri %q: %w", attrs["URI"], err)
+				}
+				keyURL, keyIV = u.String(), attrs["IV"]
+			default:
+				return nil, fmt.Errorf("unsupported encryption method %q", attrs["METHOD"])
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attrs := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			if attrs["URI"] == mapURI {
+				continue
+			}
+			mapURI = attrs["URI"]
+			segment, err := hlsSegment(base, mapURI, attrs["BYTERANGE"], nextStart)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			byteRange = strings.TrimPrefix(line, "#EXT-X-BYTERANGE:")
+
+		case line == "" || strings.HasPrefix(line, "#"):
+
+		default:
+			segment, err := hlsSegment(base, line, byteRange, nextStart)
+			if err != nil {
+				return nil, err
+			}
+			if keyURL != "" {
+				segment.KeyURL = keyURL
+				segment.KeyIV = keyIV
+				if segment.KeyIV == "" {
+					// without an explicit IV the media sequence number is used
+					segment.KeyIV = fmt.Sprintf("%032x", sequence)
+				}
+			}
+			segments = append(segments, segment)
+			byteRange = ""
+			sequence++
+		}
+	}
+	return segments, scanner.Err()
+}
+
+// hlsSegment resolves a segment URI and its optional "length[@offset]" byte
+// range. Without an offset the range continues where the previous range of
+// the same resource ended.
+func hlsSegment(base *url.URL, uri, byteRange string, nextStart map[string]int64) (mediaSegment, error) {
+	u, err := base.Parse(uri)
+	if err != nil {
+		return mediaSegment{}, fmt.Errorf("invalid segment uri %q: %w", uri, err)
+	}
+	segment := mediaSegment{URL: u.String(), End: -1}
+	if byteRange == "" {
+		return segment, nil
+	}
+
+	lengthStr, offsetStr, hasOffset := strings.Cut(byteRange, "@")
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil {
+		return mediaSegment{}, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	segment.Start = nextStart[segment.URL]
+	if hasOffset {
+		if segment.Start, err = strconv.ParseInt(offsetStr, 10, 64); err != nil {
+			return mediaSegment{}, fmt.Errorf("invalid byte range %q", byteRange)
+		}
+	}
+	segment.End = segment.Start + length - 1
+	nextStart[segment.URL] = segment.End + 1
+	return segment, nil
+}
+
+// parseHLSAttributes parses an attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"
+func parseHLSAttributes(list string) map[string]string {
+	attrs := map[string]string{}
+	for list != "" {
+		key, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		attrs[strings.TrimSpace(key)] = value
+		list = rest
+	}
+	return attrs
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestParseHLSAttributes(t *testing.T) {
+	tests := []struct {
+		name, list string
+		want       map[string]string
+	}{
+		{"plain", "BANDWIDTH=1280000,RESOLUTION=1280x720", map[string]string{"BANDWIDTH": "1280000", "RESOLUTION": "1280x720"}},
+		{"quoted comma", `CODECS="avc1.4d401f,mp4a.40.2",BANDWIDTH=1`, map[string]string{"CODECS": "avc1.4d401f,mp4a.40.2", "BANDWIDTH": "1"}},
+		{"quoted last", `METHOD=AES-128,URI="key?a=1"`, map[string]string{"METHOD": "AES-128", "URI": "key?a=1"}},
+		{"unterminated quote", `URI="key`, map[string]string{"URI": "key"}},
+		{"no value", "NONE", map[string]string{}},
+		{"empty", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseHLSAttributes(tt.list)
+			if len(got) != len(tt.want) {
+				t.Fatalf("parsed %q, want %q", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Fatalf("parsed %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHLSMedia(t *testing.T) {
+	base := mustParseURL(t, "http://cdn.example.com/video/index.m3u8")
+	iv := "0x000102030405060708090a0b0c0d0e0f"
+
+	tests := []struct {
+		name     string
+		playlist string
+		want     []mediaSegment
+	}{
+		{"plain segments", `#EXTM3U
+#EXTINF:4,
+seg0.ts
+#EXTINF:4,
+
+http://other.example.com/seg1.ts
+#EXT-X-ENDLIST`, []mediaSegment{
+			{URL: "http://cdn.example.com/video/seg0.ts", End: -1},
+			{URL: "http://other.example.com/seg1.ts", End: -1},
+		}},
+		{"byte ranges continue per resource", `#EXTM3U
+#EXT-X-BYTERANGE:1000@2000
+all.ts
+#EXT-X-BYTERANGE:500
+all.ts
+#EXT-X-BYTERANGE:300
+other.ts
+whole.ts`, []mediaSegment{
+			{URL: "http://cdn.example.com/video/all.ts", Start: 2000, End: 2999},
+			{URL: "http://cdn.example.com/video/all.ts", Start: 3000, End: 3499},
+			{URL: "http://cdn.example.com/video/other.ts", Start: 0, End: 299},
+			{URL: "http://cdn.example.com/video/whole.ts", End: -1},
+		}},
+		{"initialization section once", `#EXTM3U
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+seg0.m4s
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+seg1.m4s`, []mediaSegment{
+			{URL: "http://cdn.example.com/video/init.mp4", Start: 0, End: 719},
+			{URL: "http://cdn.example.com/video/seg0.m4s", End: -1},
+			{URL: "http://cdn.example.com/video/seg1.m4s", End: -1},
+		}},
+		{"keys and sequence IVs", `#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:7
+seg7.ts
+#EXT-X-KEY:METHOD=AES-128,URI="keys/k1"
+seg8.ts
+seg9.ts
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.com/k2",IV=` + iv + `
+seg10.ts
+#EXT-X-KEY:METHOD=NONE
+seg11.ts`, []mediaSegment{
+			{URL: "http://cdn.example.com/video/seg7.ts", End: -1},
+			{URL: "http://cdn.example.com/video/seg8.ts", End: -1, KeyURL: "http://cdn.example.com/video/keys/k1", KeyIV: "00000000000000000000000000000008"},
+			{URL: "http://cdn.example.com/video/seg9.ts", End: -1, KeyURL: "http://cdn.example.com/video/keys/k1", KeyIV: "00000000000000000000000000000009"},
+			{URL: "http://cdn.example.com/video/seg10.ts", End: -1, KeyURL: "https://keys.example.com/k2", KeyIV: iv},
+			{URL: "http://cdn.example.com/video/seg11.ts", End: -1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHLSMedia(base, []byte(tt.playlist))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("segments\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+
+	for name, playlist := range map[string]string{
+		"unsupported encryption": "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"k\"\nseg.ts",
+		"invalid byte range":     "#EXTM3U\n#EXT-X-BYTERANGE:lots\nseg.ts",
+		"invalid byte offset":    "#EXTM3U\n#EXT-X-BYTERANGE:10@x\nseg.ts",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if segments, err := parseHLSMedia(base, []byte(playlist)); err == nil {
+				t.Fatalf("parsed %+v", segments)
+			}
+		})
+	}
+}
+
+func TestProbeHLSMasterPlaylist(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"
+720p/index.m3u8
+
+#EXT-X-STREAM-INF:BANDWIDTH=640000
+low.m3u8
+`)
+	})
+	mux.HandleFunc("/720p/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXTINF:4,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	streams, err := probeMedia(context.Background(), srv.Client(), srv.URL+"/master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var variants []MediaVariant
+	for _, s := range streams {
+		variants = append(variants, s.MediaVariant)
+	}
+	want := []MediaVariant{
+		{Bandwidth: 1280000, Width: 1280, Height: 720, Codecs: "avc1.4d401f,mp4a.40.2"},
+		{Bandwidth: 640000},
+	}
+	if !slices.Equal(variants, want) {
+		t.Fatalf("variants %+v, want %+v", variants, want)
+	}
+
+	// segments resolve against the variant playlist
+	segments, err := streams[0].segments(context.Background(), srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].URL != srv.URL+"/720p/seg0.ts" {
+		t.Fatalf("segments %+v", segments)
+	}
+}
+
+func TestDASHStreams(t *testing.T) {
+	base := mustParseURL(t, "http://cdn.example.com/dash/manifest.mpd")
+	manifest := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT10S">
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet mimeType="video/mp4" codecs="avc1">
+      <SegmentTemplate initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number%05d$.m4s" startNumber="3" timescale="1000" duration="4000"/>
+      <Representation id="hi" bandwidth="2000000" width="1920" height="1080"/>
+      <Representation id="lo" bandwidth="500000" codecs="avc1.42c01e"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <Representation id="a" bandwidth="128000">
+        <SegmentTemplate media="a/$Time$.m4s" timescale="10">
+          <SegmentTimeline>
+            <S t="0" d="40" r="1"/>
+            <S d="20" r="-1"/>
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+    <AdaptationSet mimeType="text/vtt">
+      <Representation id="sub" bandwidth="100">
+        <BaseURL>subs/en.vtt</BaseURL>
+      </Representation>
+    </AdaptationSet>
+    <AdaptationSet>
+      <BaseURL>http://other.example.com/list/</BaseURL>
+      <Representation id="list" bandwidth="1" mimeType="video/mp2t">
+        <SegmentList>
+          <Initialization sourceURL="init.ts" range="0-99"/>
+          <SegmentURL media="all.ts" mediaRange="100-199"/>
+          <SegmentURL media="last.ts"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+	streams, err := dashStreams(base, []byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media := "http://cdn.example.com/dash/media/"
+	tests := []struct {
+		variant  MediaVariant
+		segments []mediaSegment
+	}{
+		{MediaVariant{Bandwidth: 2000000, Width: 1920, Height: 1080, Codecs: "avc1", MimeType: "video/mp4"}, []mediaSegment{
+			{URL: media + "hi/init.mp4", End: -1},
+			{URL: media + "hi/00003.m4s", End: -1},
+			{URL: media + "hi/00004.m4s", End: -1},
+			{URL: media + "hi/00005.m4s", End: -1},
+		}},
+		{MediaVariant{Bandwidth: 500000, Codecs: "avc1.42c01e", MimeType: "video/mp4"}, []mediaSegment{
+			{URL: media + "lo/init.mp4", End: -1},
+			{URL: media + "lo/00003.m4s", End: -1},
+			{URL: media + "lo/00004.m4s", End: -1},
+			{URL: media + "lo/00005.m4s", End: -1},
+		}},
+		{MediaVariant{Bandwidth: 128000, MimeType: "audio/mp4"}, []mediaSegment{
+			{URL: media + "a/0.m4s", End: -1},
+			{URL: media + "a/40.m4s", End: -1},
+			{URL: media + "a/80.m4s", End: -1},
+		}},
+		{MediaVariant{Bandwidth: 100, MimeType: "text/vtt"}, []mediaSegment{
+			{URL: media + "subs/en.vtt", End: -1},
+		}},
+		{MediaVariant{Bandwidth: 1, MimeType: "video/mp2t"}, []mediaSegment{
+			{URL: "http://other.example.com/list/init.ts", Start: 0, End: 99},
+			{URL: "http://other.example.com/list/all.ts", Start: 100, End: 199},
+			{URL: "http://other.example.com/list/last.ts", End: -1},
+		}},
+	}
+	if len(streams) != len(tests) {
+		t.Fatalf("%d streams, want %d", len(streams), len(tests))
+	}
+	for i, tt := range tests {
+		if streams[i].MediaVariant != tt.variant {
+			t.Errorf("stream %d is %+v, want %+v", i, streams[i].MediaVariant, tt.variant)
+		}
+		segments, err := streams[i].segments(context.Background(), nil)
+		if err != nil {
+			t.Errorf("stream %d: %v", i, err)
+			continue
+		}
+		if !slices.Equal(segments, tt.segments) {
+			t.Errorf("stream %d segments\n%+v\nwant\n%+v", i, segments, tt.segments)
+		}
+	}
+}
+
+func TestDASHStreamsRejected(t *testing.T) {
+	base := mustParseURL(t, "http://cdn.example.com/manifest.mpd")
+	for name, manifest := range map[string]string{
+		"not XML":     "<MPD",
+		"live":        `<MPD type="dynamic"><Period/></MPD>`,
+		"no periods":  `<MPD type="static"/>`,
+		"no variants": `<MPD><Period><AdaptationSet/></Period></MPD>`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if streams, err := dashStreams(base, []byte(manifest)); err == nil {
+				t.Fatalf("parsed %d streams", len(streams))
+			}
+		})
+	}
+
+	// these are only found out when listing the segments
+	for name, manifest := range map[string]string{
+		"unknown segment count": `<MPD><Period><AdaptationSet><Representation id="v"><SegmentTemplate media="$Number$.m4s" duration="4"/></Representation></AdaptationSet></Period></MPD>`,
+		"empty timeline entry":  `<MPD><Period><AdaptationSet><Representation id="v"><SegmentTemplate media="$Time$.m4s"><SegmentTimeline><S t="0" d="0"/></SegmentTimeline></SegmentTemplate></Representation></AdaptationSet></Period></MPD>`,
+		"invalid start number":  `<MPD mediaPresentationDuration="PT4S"><Period><AdaptationSet><Representation id="v"><SegmentTemplate media="$Number$.m4s" duration="4" startNumber="one"/></Representation></AdaptationSet></Period></MPD>`,
+		"invalid media range":   `<MPD><Period><AdaptationSet><Representation id="v"><SegmentList><SegmentURL media="a.ts" mediaRange="200-100"/></SegmentList></Representation></AdaptationSet></Period></MPD>`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			streams, err := dashStreams(base, []byte(manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if segments, err := streams[0].segments(context.Background(), nil); err == nil {
+				t.Fatalf("listed %+v", segments)
+			}
+		})
+	}
+}
+
+func TestExpandDASHTemplate(t *testing.T) {
+	rep := dashRepresentation{ID: "video-1", Bandwidth: 800000}
+	tests := []struct {
+		pattern, want string
+	}{
+		{"$RepresentationID$/$Number$.m4s", "video-1/42.m4s"},
+		{"seg-$Number%06d$.m4s", "seg-000042.m4s"},
+		{"$Bandwidth$/$Time$.m4s", "800000/90000.m4s"},
+		{"$Time%010d$", "0000090000"},
+		{"price$$.m4s", "price$.m4s"},
+		{"$Unknown$.m4s", "$Unknown$.m4s"},
+	}
+	for _, tt := range tests {
+		if got := expandDASHTemplate(tt.pattern, rep, 42, 90000); got != tt.want {
+			t.Errorf("expandDASHTemplate(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"PT10S", 10},
+		{"PT1H2M3.5S", 3723.5},
+		{"P1DT1M", 86460},
+		{" PT0.25S ", 0.25},
+		{"PT", 0},
+		{"10S", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parseISODuration(tt.value); got != tt.want {
+			t.Errorf("parseISODuration(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestOpenPartDecryptsWithSequenceIV(t *testing.T) {
+	// segments encrypted with the AES-128 key of NIST SP 800-38A and no IV
+	// in the playlist, so each one's IV is its media sequence number
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	encrypted := map[string]string{
+		"seg7.ts": "505fcb893f1b084fa8c36d6ed85abfcc",
+		"seg8.ts": "417e751ef54925e246b3613320ff3dae7d73fd83fe614fd8c46bfde06dafea9b",
+	}
+	want := map[string]string{"seg7.ts": "first segment", "seg8.ts": "the second segment"}
+
+	base := mustParseURL(t, "http://cdn.example.com/index.m3u8")
+	segments, err := parseHLSMedia(base, []byte("#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:7\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\nseg7.ts\nseg8.ts\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyURL := "http://cdn.example.com/key.bin"
+	d := &Download{
+		TargetPath: filepath.Join(t.TempDir(), "video.ts"),
+		mediaKeys:  map[string][]byte{keyURL: key},
+	}
+
+	for i, s := range segments {
+		name := s.URL[strings.LastIndex(s.URL, "/")+1:]
+		chunk := &ChunkInfo{Index: i, URL: s.URL, KeyURL: s.KeyURL, KeyIV: s.KeyIV, EndByte: -1, Whole: true}
+		data, _ := hex.DecodeString(encrypted[name])
+		if err := os.WriteFile(d.partPath(chunk), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := d.openPart(chunk, d.partPath(chunk))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want[name] {
+			t.Fatalf("%s decrypted to %q, want %q", name, got, want[name])
+		}
+	}
+
+	// a wrong IV leaves garbage behind, which the padding check notices
+	chunk := &ChunkInfo{Index: 9, KeyURL: keyURL, KeyIV: fmt.Sprintf("%032x", 9)}
+	data, _ := hex.DecodeString(encrypted["seg7.ts"])
+	if err := os.WriteFile(d.partPath(chunk), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := d.openPart(chunk, d.partPath(chunk)); err == nil {
+		got, _ := io.ReadAll(r)
+		r.Close()
+		if string(got) == want["seg7.ts"] {
+			t.Fatal("decrypted with the wrong IV")
+		}
+	}
+
+	for name, iv := range map[string]string{"short": "0x0102", "not hex": strings.Repeat("z", 32)} {
+		chunk := &ChunkInfo{Index: 10, KeyURL: keyURL, KeyIV: iv}
+		if err := os.WriteFile(d.partPath(chunk), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.openPart(chunk, d.partPath(chunk)); err == nil {
+			t.Errorf("%s IV accepted", name)
+		}
+	}
+}
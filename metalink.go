@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Metalink documents are decoded by local element names so the same structs
+// read both v3 (http://www.metalinker.org/) and v4 (RFC 5854) files.
+type metalinkDoc struct {
+	XMLName xml.Name       `xml:"metalink"`
+	Files   []metalinkFile `xml:"file"`
+	V3Files []metalinkFile `xml:"files>file"`
+}
+
+type metalinkFile struct {
+	Name     string           `xml:"name,attr"`
+	Size     int64            `xml:"size"`
+	Hashes   []metalinkHash   `xml:"hash"`
+	Pieces   []metalinkPieces `xml:"pieces"`
+	URLs     []metalinkURL    `xml:"url"`
+	V3Hashes []metalinkHash   `xml:"verification>hash"`
+	V3Pieces []metalinkPieces `xml:"verification>pieces"`
+	V3URLs   []metalinkURL    `xml:"resources>url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Length int64          `xml:"length,attr"`
+	Type   string         `xml:"type,attr"`
+	Hashes []metalinkHash `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Priority   int    `xml:"priority,attr"`
+	Preference int    `xml:"preference,attr"`
+	Location   string `xml:"location,attr"`
+	URL        string `xml:",chardata"`
+}
+
+// MetalinkFile is one file of a metalink document, normalized across versions
+type MetalinkFile struct {
+	Name         string
+	Size         int64
+	Mirrors      []string
+	ChecksumType string
+	Checksum     string
+	PieceLength  int64
+	PieceType    string
+	PieceHashes  []string
+}
+
+func parseMetalink(r io.Reader) ([]MetalinkFile, error) {
+	var doc metalinkDoc
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid metalink document: %w", err)
+	}
+
+	var files []MetalinkFile
+	for _, f := range append(doc.Files, doc.V3Files...) {
+		file := MetalinkFile{
+			Name: strings.TrimSpace(f.Name),
+			Size: f.Size,
+		}
+
+		for _, h := range append(f.Hashes, f.V3Hashes...) {
+			if hashRank(h.Type) > hashRank(file.ChecksumType) {
+				file.ChecksumType = h.Type
+				file.Checksum = strings.TrimSpace(h.Value)
+			}
+		}
+
+		for _, p := range append(f.Pieces, f.V3Pieces...) {
+			if p.Length <= 0 || hashRank(p.Type) <= hashRank(file.PieceType) {
+				continue
+			}
+			file.PieceLength = p.Length
+			file.PieceType = p.Type
+			file.PieceHashes = file.PieceHashes[:0]
+			for _, h := range p.Hashes {
+				file.PieceHashes = append(file.PieceHashes, strings.TrimSpace(h.Value))
+			}
+		}
+
+		file.Mirrors = metalinkMirrors(f)
+		if file.Name == "" || len(file.Mirrors) == 0 {
+			continue
+		}
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("metalink document has no downloadable files")
+	}
+	return files, nil
+}
+
+// metalinkMirrors orders the usable URLs of a file best first. v4 ranks by
+// ascending priority, v3 by descending preference.
+func metalinkMirrors(f metalinkFile) []string {
+	urls := append([]metalinkURL{}, f.URLs...)
+	for _, u := range f.V3URLs {
+		// map v3 preference (100 is best) onto v4 priority (1 is best)
+		u.Priority = 101 - u.Preference
+		urls = append(urls, u)
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		return metalinkPriority(urls[i]) < metalinkPriority(urls[j])
+	})
+
+	var mirrors []string
+	for _, u := range urls {
+		raw := strings.TrimSpace(u.URL)
+		if isSupportedURL(raw) {
+			mirrors = append(mirrors, raw)
+		}
+	}
+	return mirrors
+}
+
+func metalinkPriority(u metalinkURL) int {
+	if u.Priority <= 0 {
+		// URLs without a priority are preferred least
+		return 1 << 20
+	}
+	return u.Priority
+}
+
+// openMetalink reads a metalink document from a URL of any supported
+// protocol or a local file
+func openMetalink(source string) (io.ReadCloser, error) {
+	if !isSupportedURL(source) {
+		return os.Open(source)
+	}
+
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	proto, err := protocolFor(source, client)
+	if err != nil {
+		return nil, err
+	}
+	r, err := proto.OpenRange(context.Background(), source, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching metalink: %w", err)
+	}
+	return r, nil
+}
+
+// AddMetalink creates a download for every file described by the metalink
+// document at source, saving the files into dir
+func (dm *DownloadManager) AddMetalink(source, dir string, chunks, workers int) error {
+	r, err := openMetalink(source)
+	if err != nil {
+		return err
+	}
+	files, err := parseMetalink(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, file := range files {
+		if err := dm.addMetalinkFile(file, dir, chunks, workers); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (dm *DownloadManager) addMetalinkFile(file MetalinkFile, dir string, chunks, workers int) error {
+	target, err := safeJoin(dir, file.Name)
+	if err != nil {
+		return err
+	}
+
+	if restored, err := dm.restoreExisting(file.Mirrors[0], target); restored || err != nil {
+		return err
+	}
+
+	client, err := newHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	// without a size in the document, the first mirror is asked for it
+	size := file.Size
+	ranged := true
+	if size <= 0 {
+		probe, err := probeURL(context.Background(), file.Mirrors[0], client)
+		if err != nil {
+			return err
+		}
+		size, ranged = probe.Size, probe.AcceptsRanges
+	}
+	if size < 0 || !ranged {
+		chunks = 1
+	}
+
+	// piece hashes can only be checked when no piece straddles two chunks
+	var align int64
+	if len(file.PieceHashes) > 0 && size > 0 {
+		align = file.PieceLength
+	}
+
+	d, err := newSizedDownload(client, file.Mirrors[0], target, size, chunks, workers, align)
+	if err != nil {
+		return err
+	}
+	d.Mirrors = file.Mirrors
+	d.ChecksumType = file.ChecksumType
+	d.Checksum = file.Checksum
+	if align > 0 {
+		d.PieceLength = file.PieceLength
+		d.PieceType = file.PieceType
+		d.PieceHashes = file.PieceHashes
+	}
+
+	return dm.addNewDownload(d)
+}
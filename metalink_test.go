@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseMetalink(t *testing.T) {
+	v4 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name=" data.iso ">
+    <size>65536</size>
+    <hash type="md5">d41d8cd98f00b204e9800998ecf8427e</hash>
+    <hash type="sha-256"> e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855 </hash>
+    <pieces length="1024" type="sha-1">
+      <hash>aa</hash>
+    </pieces>
+    <pieces length="32768" type="sha-256">
+      <hash> p0 </hash>
+      <hash>p1</hash>
+    </pieces>
+    <url priority="2">http://two.example.com/data.iso</url>
+    <url>http://unranked.example.com/data.iso</url>
+    <url priority="1" location="de">ftp://one.example.com/data.iso</url>
+    <url priority="1">mailto:nobody@example.com</url>
+  </file>
+  <file name="nowhere.bin">
+    <url>mailto:nobody@example.com</url>
+  </file>
+</metalink>`
+
+	v3 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="old.tar.gz">
+      <size>2048</size>
+      <verification>
+        <hash type="sha1">da39a3ee5e6b4b0d3255bfef95601890afd80709</hash>
+        <pieces length="1024" type="sha1">
+          <hash piece="0">h0</hash>
+          <hash piece="1">h1</hash>
+        </pieces>
+      </verification>
+      <resources>
+        <url type="http" preference="10">http://low.example.com/old.tar.gz</url>
+        <url type="http" preference="90">http://high.example.com/old.tar.gz</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+	tests := []struct {
+		name string
+		doc  string
+		want []MetalinkFile
+	}{
+		{"v4 mirrors, hashes and pieces", v4, []MetalinkFile{{
+			Name: "data.iso",
+			Size: 65536,
+			Mirrors: []string{
+				"ftp://one.example.com/data.iso",
+				"http://two.example.com/data.iso",
+				"http://unranked.example.com/data.iso",
+			},
+			ChecksumType: "sha-256",
+			Checksum:     "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			PieceLength:  32768,
+			PieceType:    "sha-256",
+			PieceHashes:  []string{"p0", "p1"},
+		}}},
+		{"v3 resources and verification", v3, []MetalinkFile{{
+			Name:         "old.tar.gz",
+			Size:         2048,
+			Mirrors:      []string{"http://high.example.com/old.tar.gz", "http://low.example.com/old.tar.gz"},
+			ChecksumType: "sha1",
+			Checksum:     "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			PieceLength:  1024,
+			PieceType:    "sha1",
+			PieceHashes:  []string{"h0", "h1"},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := parseMetalink(strings.NewReader(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(tt.want) {
+				t.Fatalf("%d files, want %d: %+v", len(files), len(tt.want), files)
+			}
+			for i, got := range files {
+				want := tt.want[i]
+				if got.Name != want.Name || got.Size != want.Size || got.ChecksumType != want.ChecksumType ||
+					got.Checksum != want.Checksum || got.PieceLength != want.PieceLength || got.PieceType != want.PieceType {
+					t.Errorf("file %d is %+v, want %+v", i, got, want)
+				}
+				if !slices.Equal(got.Mirrors, want.Mirrors) {
+					t.Errorf("file %d mirrors %q, want %q", i, got.Mirrors, want.Mirrors)
+				}
+				if !slices.Equal(got.PieceHashes, want.PieceHashes) {
+					t.Errorf("file %d piece hashes %q, want %q", i, got.PieceHashes, want.PieceHashes)
+				}
+			}
+		})
+	}
+
+	for name, doc := range map[string]string{
+		"not XML":        "metalink",
+		"other document": `<rss><file name="a"><url>http://example.com/a</url></file></rss>`,
+		"no usable file": `<metalink><file name="a"><url>mailto:a@example.com</url></file><file><url>http://example.com/b</url></file></metalink>`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if files, err := parseMetalink(strings.NewReader(doc)); err == nil {
+				t.Fatalf("parsed %+v", files)
+			}
+		})
+	}
+}
+
+func TestVerifyChunkRejectsCorruptPiece(t *testing.T) {
+	data := randomData(t, 10*1024)
+	const pieceLength = 4096
+
+	d := &Download{TargetPath: filepath.Join(t.TempDir(), "file.bin"), PieceLength: pieceLength, PieceType: "sha-256"}
+	for offset := 0; offset < len(data); offset += pieceLength {
+		sum := sha256.Sum256(data[offset:min(offset+pieceLength, len(data))])
+		d.PieceHashes = append(d.PieceHashes, hex.EncodeToString(sum[:]))
+	}
+	// the second chunk holds the second and the short last piece
+	chunk := &ChunkInfo{Index: 1, StartByte: pieceLength, EndByte: int64(len(data)) - 1}
+	part := data[pieceLength:]
+
+	if err := os.WriteFile(d.partPath(chunk), part, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyChunk(chunk); err != nil {
+		t.Fatalf("intact chunk rejected: %v", err)
+	}
+
+	corrupt := bytes.Clone(part)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := os.WriteFile(d.partPath(chunk), corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyChunk(chunk); err == nil || !strings.Contains(err.Error(), "piece 2") {
+		t.Fatalf("corrupt last piece not rejected: %v", err)
+	}
+
+	if err := os.WriteFile(d.partPath(chunk), part[:pieceLength+10], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyChunk(chunk); err == nil {
+		t.Fatal("truncated chunk accepted")
+	}
+}
+
+func TestMetalinkRetriesCorruptPieceFromNextMirror(t *testing.T) {
+	data := randomData(t, 64*1024)
+	const pieceLength = 16 * 1024
+
+	// the preferred mirror serves a flipped byte in the first piece
+	bad := bytes.Clone(data)
+	bad[100] ^= 0xff
+	var badRequests atomic.Int32
+	badSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badRequests.Add(1)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(bad))
+	}))
+	t.Cleanup(badSrv.Close)
+	goodSrv := newThrottledServer(t, data, 1<<20, 1<<20)
+
+	var pieces strings.Builder
+	for offset := 0; offset < len(data); offset += pieceLength {
+		sum := sha256.Sum256(data[offset : offset+pieceLength])
+		fmt.Fprintf(&pieces, "<hash>%x</hash>", sum)
+	}
+	doc := fmt.Sprintf(`<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+<file name="file.bin">
+  <size>%d</size>
+  <pieces length="%d" type="sha-256">%s</pieces>
+  <url priority="1">%s/file.bin</url>
+  <url priority="2">%s/file.bin</url>
+</file>
+</metalink>`, len(data), pieceLength, pieces.String(), badSrv.URL, goodSrv.URL)
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "file.meta4")
+	if err := os.WriteFile(source, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dm := newTestManager(t)
+	if err := dm.AddMetalink(source, dir, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "file.bin")
+	d, err := dm.getDownload(badSrv.URL+"/file.bin", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, StateCompleted, 10*time.Second)
+
+	if badRequests.Load() == 0 {
+		t.Fatal("the corrupt mirror was never asked")
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the original")
+	}
+}
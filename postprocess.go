@@ -0,0 +1,550 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// PostStep is one step of the pipeline run on a download once its file is
+// complete. Steps run in order and stop at the first failure.
+type PostStep struct {
+	// Type is one of extract, move, chmod or command
+	Type string `json:"type"`
+	// Dir is where extract unpacks to and where move moves the file to. Extract
+	// defaults to a folder named after the archive next to it, move to the
+	// directory of the download's category.
+	Dir string `json:"dir,omitempty"`
+	// Mode is the octal permission chmod applies, e.g. "0644"
+	Mode string `json:"mode,omitempty"`
+	// Command runs with Args followed by the download's path
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
+
+const (
+	PostStepExtract = "extract"
+	PostStepMove    = "move"
+	PostStepChmod   = "chmod"
+	PostStepCommand = "command"
+)
+
+type PostStepStatus string
+
+const (
+	PostStepPending   PostStepStatus = "pending"
+	PostStepRunning   PostStepStatus = "running"
+	PostStepSucceeded PostStepStatus = "succeeded"
+	PostStepFailed    PostStepStatus = "failed"
+	PostStepSkipped   PostStepStatus = "skipped"
+)
+
+// PostStepResult is the persisted outcome of a step for one download
+type PostStepResult struct {
+	ID         int64          `json:"id"`
+	DownloadID int64          `json:"downloadId"`
+	Index      int            `json:"index"`
+	Step       PostStep       `json:"step"`
+	Status     PostStepStatus `json:"status"`
+	Output     string         `json:"output"`
+}
+
+// CommandTimeout bounds how long a post-processing command may run
+var CommandTimeout = 10 * time.Minute
+
+// maxStepOutput limits the output kept for a step
+const maxStepOutput = 64 * 1024
+
+func (s PostStep) validate() error {
+	switch s.Type {
+	case PostStepExtract, PostStepMove:
+	case PostStepChmod:
+		if _, err := strconv.ParseUint(s.Mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid mode %q", s.Mode)
+		}
+	case PostStepCommand:
+		if s.Command == "" {
+			return errors.New("command step needs a command")
+		}
+	default:
+		return fmt.Errorf("unknown step type %q", s.Type)
+	}
+	return nil
+}
+
+// PostProcessing returns the configured pipeline
+func (dm *DownloadManager) PostProcessing() ([]PostStep, error) {
+	value, err := dm.Setting("post_processing", "")
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var steps []PostStep
+	if err := json.Unmarshal([]byte(value), &steps); err != nil {
+		return nil, fmt.Errorf("decoding post-processing steps: %w", err)
+	}
+	return steps, nil
+}
+
+func (dm *DownloadManager) SetPostProcessing(steps []PostStep) error {
+	for i, step := range steps {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	data, err := json.Marshal(steps)
+	if err != nil {
+		return err
+	}
+	return dm.SetSetting("post_processing", string(data))
+}
+
+func (dm *DownloadManager) loadPostSteps(d *Download) error {
+	rows, err := dm.DB.Query("SELECT id,step_index,step,status,output FROM post_steps WHERE download_id = ? ORDER BY step_index", d.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var results []*PostStepResult
+	for rows.Next() {
+		result := &PostStepResult{DownloadID: d.ID}
+		var step string
+		if err := rows.Scan(&result.ID, &result.Index, &step, &result.Status, &result.Output); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(step), &result.Step); err != nil {
+			return fmt.Errorf("decoding post-processing step of download %d: %w", d.ID, err)
+		}
+		results = append(results, result)
+	}
+	d.PostSteps = results
+	return rows.Err()
+}
+
+func (dm *DownloadManager) savePostStep(result *PostStepResult) error {
+	if result.ID != 0 {
+		_, err := dm.DB.Exec("UPDATE post_steps SET status=?,output=? WHERE id=?", result.Status, result.Output, result.ID)
+		return err
+	}
+
+	step, err := json.Marshal(result.Step)
+	if err != nil {
+		return err
+	}
+	res, err := dm.DB.Exec("INSERT INTO post_steps (download_id,step_index,step,status,output) VALUES (?,?,?,?,?)",
+		result.DownloadID, result.Index, string(step), result.Status, result.Output)
+	if err != nil {
+		return err
+	}
+	result.ID, err = res.LastInsertId()
+	return err
+}
+
+func (dm *DownloadManager) notifyPostStep(result *PostStepResult) {
+	if err := dm.savePostStep(result); err != nil {
+		logger.Error("failed to save post-processing step", "download_id", result.DownloadID, "err", err)
+	}
+	if dm.appCtx != nil {
+		runtime.EventsEmit(dm.appCtx, "postProcessUpdate", *result)
+	}
+}
+
+// runPostProcessing runs the configured pipeline on a completed download,
+// replacing the results of any earlier run
+func (dm *DownloadManager) runPostProcessing(d *Download) {
+	steps, err := dm.PostProcessing()
+	if err != nil {
+		d.log().Error("failed to load post-processing steps", "err", err)
+		return
+	}
+	if len(steps) == 0 {
+		return
+	}
+
+	if _, err := dm.DB.Exec("DELETE FROM post_steps WHERE download_id = ?", d.ID); err != nil {
+		d.log().Error("failed to clear post-processing steps", "err", err)
+	}
+
+	results := make([]*PostStepResult, len(steps))
+	for i, step := range steps {
+		results[i] = &PostStepResult{DownloadID: d.ID, Index: i, Step: step, Status: PostStepPending}
+		dm.notifyPostStep(results[i])
+	}
+	d.Mutex.Lock()
+	d.PostSteps = results
+	d.Mutex.Unlock()
+
+	// results are shown to the frontend while they change
+	report := func(result *PostStepResult, status PostStepStatus, output string) {
+		d.Mutex.Lock()
+		result.Status = status
+		result.Output = output
+		d.Mutex.Unlock()
+		dm.notifyPostStep(result)
+	}
+
+	failed := false
+	for _, result := range results {
+		if failed {
+			report(result, PostStepSkipped, "")
+			continue
+		}
+
+		report(result, PostStepRunning, "")
+
+		output, err := dm.runPostStep(d, result.Step)
+		switch {
+		case errors.Is(err, errStepNotApplicable):
+			report(result, PostStepSkipped, truncateOutput(output))
+		case err != nil:
+			report(result, PostStepFailed, truncateOutput(strings.TrimSpace(output+"\n"+err.Error())))
+			failed = true
+		default:
+			report(result, PostStepSucceeded, truncateOutput(output))
+		}
+	}
+}
+
+var errStepNotApplicable = errors.New("step does not apply")
+
+// policyFor returns the conflict policy d was added with, or the global one
+func (dm *DownloadManager) policyFor(d *Download) (ConflictPolicy, error) {
+	d.Mutex.Lock()
+	policy := d.ConflictPolicy
+	d.Mutex.Unlock()
+	if policy != "" {
+		return policy, nil
+	}
+	return dm.ConflictPolicy()
+}
+
+// categoryDir returns the directory of d's category, where a move step
+// without a directory moves it
+func (dm *DownloadManager) categoryDir(d *Download) (string, error) {
+	d.Mutex.Lock()
+	name := d.Category
+	d.Mutex.Unlock()
+
+	categories, err := dm.Categories()
+	if err != nil {
+		return "", err
+	}
+	for _, c := range categories {
+		if c.Name == name && name != "" && c.Dir != "" {
+			return c.Dir, nil
+		}
+	}
+	return "", fmt.Errorf("%w: download has no category directory", errStepNotApplicable)
+}
+
+func (dm *DownloadManager) runPostStep(d *Download, step PostStep) (string, error) {
+	// an earlier move step changed the path under the lock
+	d.Mutex.Lock()
+	targetPath := d.TargetPath
+	d.Mutex.Unlock()
+
+	switch step.Type {
+	case PostStepExtract:
+		dir := step.Dir
+		if dir == "" {
+			dir = strings.TrimSuffix(targetPath, archiveExt(targetPath))
+		}
+		policy, err := dm.policyFor(d)
+		if err != nil {
+			return "", err
+		}
+		count, err := extractArchive(targetPath, dir, policy)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("extracted %d files to %s", count, dir), nil
+
+	case PostStepMove:
+		dir := step.Dir
+		if dir == "" {
+			var err error
+			if dir, err = dm.categoryDir(d); err != nil {
+				return "", err
+			}
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+		target := filepath.Join(dir, filepath.Base(targetPath))
+		if filepath.Clean(target) == filepath.Clean(targetPath) {
+			return "already in " + dir, nil
+		}
+
+		target, outcome, err := dm.ResolveConflict(context.Background(), d, target)
+		if err != nil {
+			return "", err
+		}
+		switch outcome {
+		case conflictSkip:
+			return fmt.Sprintf("%s exists, left at %s", target, targetPath), errStepNotApplicable
+		case conflictExisting:
+			// the same file is already there
+			if err := os.Remove(targetPath); err != nil {
+				return "", err
+			}
+		default:
+			if err := moveFile(targetPath, target); err != nil {
+				return "", err
+			}
+		}
+		d.Mutex.Lock()
+		d.TargetPath = target
+		d.Mutex.Unlock()
+		if err := dm.UpdateDownloadPath(d.ID, target); err != nil {
+			return "", err
+		}
+		return "moved to " + target, nil
+
+	case PostStepChmod:
+		mode, err := strconv.ParseUint(step.Mode, 8, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid mode %q", step.Mode)
+		}
+		if err := os.Chmod(targetPath, os.FileMode(mode)); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("mode set to %s", os.FileMode(mode)), nil
+
+	case PostStepCommand:
+		ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+		defer cancel()
+
+		args := append(append([]string{}, step.Args...), targetPath)
+		cmd := exec.CommandContext(ctx, step.Command, args...)
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := cmd.Run()
+		return output.String(), err
+
+	default:
+		return "", fmt.Errorf("unknown step type %q", step.Type)
+	}
+}
+
+func truncateOutput(output string) string {
+	if len(output) <= maxStepOutput {
+		return output
+	}
+	return output[:maxStepOutput] + "\n[output truncated]"
+}
+
+// moveFile renames, falling back to copying across filesystems
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cannot move directory %s across filesystems", from)
+	}
+
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	src.Close()
+	return os.Remove(from)
+}
+
+// archiveExt returns the archive extension of path, or "" for other files
+func archiveExt(path string) string {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar.xz", ".txz", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return path[len(path)-len(ext):]
+		}
+	}
+	return ""
+}
+
+// extractArchive unpacks a zip or (compressed) tar archive into dir,
+// returning the number of files written. Entries escaping dir are rejected,
+// and existing files are handled by policy.
+func extractArchive(archivePath, dir string, policy ConflictPolicy) (int, error) {
+	switch strings.ToLower(archiveExt(archivePath)) {
+	case ".zip":
+		return extractZip(archivePath, dir, policy)
+	case ".tar":
+		return extractTar(archivePath, dir, policy, func(r io.Reader) (io.Reader, error) { return r, nil })
+	case ".tar.gz", ".tgz":
+		return extractTar(archivePath, dir, policy, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) })
+	case ".tar.xz", ".txz":
+		return extractTar(archivePath, dir, policy, func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) })
+	default:
+		return 0, errStepNotApplicable
+	}
+}
+
+func extractZip(archivePath, dir string, policy ConflictPolicy) (int, error) {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	count := 0
+	for _, file := range archive.File {
+		if path.Clean(file.Name) == "." {
+			continue
+		}
+		target, err := safeJoin(dir, file.Name)
+		if err != nil {
+			return count, err
+		}
+
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return count, err
+			}
+			continue
+		}
+		if !file.Mode().IsRegular() {
+			// symlinks could point outside dir
+			continue
+		}
+
+		target, write := extractTarget(target, int64(file.UncompressedSize64), policy)
+		if !write {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return count, err
+		}
+		err = writeExtracted(target, r, file.Mode().Perm())
+		r.Close()
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func extractTar(archivePath, dir string, policy ConflictPolicy, decompress func(io.Reader) (io.Reader, error)) (int, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return 0, err
+	}
+
+	archive := tar.NewReader(r)
+	count := 0
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if path.Clean(header.Name) == "." {
+			continue
+		}
+		target, err := safeJoin(dir, header.Name)
+		if err != nil {
+			return count, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return count, err
+			}
+		case tar.TypeReg:
+			target, write := extractTarget(target, header.Size, policy)
+			if !write {
+				continue
+			}
+			if err := writeExtracted(target, archive, header.FileInfo().Mode().Perm()); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+// extractTarget applies policy to a file of size about to be extracted to
+// target, returning where to write it or false to leave the existing file.
+// Nobody is asked about each file, so ask renames like the default.
+func extractTarget(target string, size int64, policy ConflictPolicy) (string, bool) {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return target, true
+	}
+	switch policy {
+	case ConflictOverwrite:
+		if info.Mode().IsRegular() {
+			return target, true
+		}
+	case ConflictSkip:
+		return "", false
+	case ConflictResume:
+		if info.Mode().IsRegular() && info.Size() == size {
+			return "", false
+		}
+	}
+	return renamedPath(target, nil), true
+}
+
+func writeExtracted(target string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveEntry is a file, directory or symlink written into a test archive
+type archiveEntry struct {
+	name, body, link string
+	dir              bool
+}
+
+func writeZip(t *testing.T, path string, entries []archiveEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		switch {
+		case e.dir:
+			header.SetMode(os.ModeDir | 0755)
+		case e.link != "":
+			header.SetMode(os.ModeSymlink | 0777)
+			body = e.link
+		default:
+			header.SetMode(0644)
+		}
+		entry, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, path string, entries []archiveEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := tar.NewWriter(f)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case e.dir:
+			header.Typeflag, header.Mode, header.Size = tar.TypeDir, 0755, 0
+		case e.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.link, 0
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := w.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractStaysInsideDir(t *testing.T) {
+	writers := map[string]func(*testing.T, string, []archiveEntry){
+		"archive.zip": writeZip,
+		"archive.tar": writeTar,
+	}
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		// wantErr rejects the archive, files lists what is extracted
+		wantErr bool
+		files   map[string]string
+	}{
+		{
+			name:    "parent directory",
+			entries: []archiveEntry{{name: "ok.txt", body: "ok"}, {name: "../evil.txt", body: "evil"}},
+			wantErr: true,
+		},
+		{
+			name:    "parent directory inside a path",
+			entries: []archiveEntry{{name: "sub/../../evil.txt", body: "evil"}},
+			wantErr: true,
+		},
+		{
+			name:    "absolute path",
+			entries: []archiveEntry{{name: "/evil.txt", body: "evil"}},
+			wantErr: true,
+		},
+		{
+			name: "symlink out of the directory",
+			entries: []archiveEntry{
+				{name: "link", link: ".."},
+				{name: "link/evil.txt", body: "evil"},
+				{name: "ok.txt", body: "ok"},
+			},
+			// the link is skipped, so the file lands in a real directory
+			files: map[string]string{"link/evil.txt": "evil", "ok.txt": "ok"},
+		},
+		{
+			name: "symlink to an absolute path",
+			entries: []archiveEntry{
+				{name: "etc", link: "/etc"},
+				{name: "sub", dir: true},
+				{name: "sub/ok.txt", body: "ok"},
+			},
+			files: map[string]string{"sub/ok.txt": "ok"},
+		},
+	}
+
+	for archiveName, write := range writers {
+		for _, tt := range tests {
+			t.Run(archiveName+"/"+tt.name, func(t *testing.T) {
+				root := t.TempDir()
+				archive := filepath.Join(root, archiveName)
+				write(t, archive, tt.entries)
+				dir := filepath.Join(root, "out")
+
+				count, err := extractArchive(archive, dir, ConflictRename)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("extracted an entry escaping the directory")
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := os.Lstat(filepath.Join(root, "evil.txt")); err == nil {
+					t.Fatal("a file was written outside the directory")
+				}
+				if tt.wantErr {
+					return
+				}
+				if count != len(tt.files) {
+					t.Fatalf("extracted %d files, want %d", count, len(tt.files))
+				}
+				for name, body := range tt.files {
+					info, err := os.Lstat(filepath.Join(dir, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !info.Mode().IsRegular() {
+						t.Fatalf("%s is %v, want a regular file", name, info.Mode())
+					}
+					if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != body {
+						t.Fatalf("%s holds %q, want %q", name, got, body)
+					}
+				}
+				for _, e := range tt.entries {
+					if e.link == "" {
+						continue
+					}
+					if info, err := os.Lstat(filepath.Join(dir, e.name)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+						t.Fatalf("symlink %s was extracted", e.name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestExtractConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy ConflictPolicy
+		want   map[string]string
+	}{
+		{ConflictOverwrite, map[string]string{"file.txt": "new"}},
+		{ConflictSkip, map[string]string{"file.txt": "old"}},
+		{ConflictRename, map[string]string{"file.txt": "old", "file (1).txt": "new"}},
+		{ConflictAsk, map[string]string{"file.txt": "old", "file (1).txt": "new"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			root := t.TempDir()
+			archive := filepath.Join(root, "archive.zip")
+			writeZip(t, archive, []archiveEntry{{name: "file.txt", body: "new"}})
+			dir := filepath.Join(root, "out")
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("old"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := extractArchive(archive, dir, tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			for name, body := range tt.want {
+				if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != body {
+					t.Fatalf("%s holds %q, want %q", name, got, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveStepAppliesConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy ConflictPolicy
+		// want is where the download ends up, and what the existing file holds
+		want, existing string
+	}{
+		{ConflictSkip, "source", "old"},
+		{ConflictRename, "file (1).bin", "old"},
+		{ConflictOverwrite, "file.bin", "new"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dm := newTestManager(t)
+			root := t.TempDir()
+			source := filepath.Join(root, "file.bin")
+			if err := os.WriteFile(source, []byte("new"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Join(root, "moved")
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "file.bin"), []byte("old"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			d := &Download{URL: "http://example.com/file.bin", TargetPath: source, State: StateCompleted, ConflictPolicy: tt.policy}
+			dm.Mutex.Lock()
+			err := dm.saveDownload(d)
+			dm.Mutex.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = dm.runPostStep(d, PostStep{Type: PostStepMove, Dir: dir})
+			if tt.policy == ConflictSkip && err == nil {
+				t.Fatal("moved over an existing file with the skip policy")
+			}
+			if tt.policy != ConflictSkip && err != nil {
+				t.Fatal(err)
+			}
+
+			want := source
+			if tt.want != "source" {
+				want = filepath.Join(dir, tt.want)
+			}
+			if got := d.snapshot().TargetPath; got != want {
+				t.Fatalf("download is at %s, want %s", got, want)
+			}
+			if got, _ := os.ReadFile(want); string(got) != "new" {
+				t.Fatalf("download holds %q", got)
+			}
+			if got, _ := os.ReadFile(filepath.Join(dir, "file.bin")); string(got) != tt.existing {
+				t.Fatalf("existing file holds %q, want %q", got, tt.existing)
+			}
+		})
+	}
+}
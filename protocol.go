@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// Protocol fetches byte ranges of a remote file so the chunked engine can
+// download it over any transport, not just HTTP.
+type Protocol interface {
+	// Probe looks up the remote file without downloading it.
+	Probe(ctx context.Context, rawURL string) (*ProbeResult, error)
+	// OpenRange streams the bytes start..end (inclusive) of the remote file,
+	// or everything from start on when end is negative.
+	OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error)
+}
+
+type ProbeResult struct {
+	Size int64 `json:"size"`
+	// FileName is the sanitized name suggested by the server, or taken from
+	// the URL the request ended up at
+	FileName      string `json:"file_name"`
+	MimeType      string `json:"mime_type"`
+	AcceptsRanges bool   `json:"accepts_ranges"`
+	// FinalURL is the URL after following redirects
+	FinalURL string `json:"final_url"`
+}
+
+// protocolFactory creates a protocol for a download. HTTP protocols share the
+// download's client so connections are reused between chunks.
+type protocolFactory func(client *http.Client) Protocol
+
+var protocols = map[string]protocolFactory{}
+
+func registerProtocol(factory protocolFactory, schemes ...string) {
+	for _, scheme := range schemes {
+		protocols[scheme] = factory
+	}
+}
+
+func protocolFor(rawURL string, client *http.Client) (Protocol, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	factory, ok := protocols[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %q", u.Scheme)
+	}
+	return factory(client), nil
+}
+
+// probeURL probes a remote file and fills in whatever its protocol couldn't
+// tell: the file name from the URL and the MIME type from the extension
+func probeURL(ctx context.Context, rawURL string, client *http.Client) (*ProbeResult, error) {
+	proto, err := protocolFor(rawURL, client)
+	if err != nil {
+		return nil, err
+	}
+
+	probe, err := proto.Probe(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if probe.FinalURL == "" {
+		probe.FinalURL = rawURL
+	}
+	if probe.FileName == "" {
+		probe.FileName = urlFileName(probe.FinalURL)
+	}
+	probe.FileName = sanitizeFileName(probe.FileName)
+	if probe.MimeType == "" {
+		probe.MimeType = mime.TypeByExtension(path.Ext(probe.FileName))
+	}
+	if probe.MimeType == "" {
+		probe.MimeType = "application/octet-stream"
+	}
+	return probe, nil
+}
+
+func isSupportedURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	_, ok := protocols[u.Scheme]
+	return ok
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpProtocol downloads over FTP and FTPS. ftps URLs use implicit TLS,
+// except on port 21 where, as with ftpes URLs, the connection is upgraded
+// with AUTH TLS. Every range opens its own control connection so chunks
+// transfer in parallel, each resuming at its offset with REST. Transfers
+// always use passive mode.
+type ftpProtocol struct{}
+
+var FTPTimeout = 30 * time.Second
+
+// ftpRootCAs verifies FTPS servers, nil using the system's certificates
+var ftpRootCAs *x509.CertPool
+
+func init() {
+	registerProtocol(func(*http.Client) Protocol {
+		return &ftpProtocol{}
+	}, "ftp", "ftps", "ftpes")
+}
+
+// ftpPath returns the path of the file a URL names. As in RFC 1738 it is
+// relative to the login directory, which servers may chroot to, unless it
+// starts with an encoded slash ("ftp://host/%2Fpub/file").
+func ftpPath(u *url.URL) string {
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+func (p *ftpProtocol) connect(ctx context.Context, u *url.URL) (*ftp.ServerConn, error) {
+	host := u.Hostname()
+	port := u.Port()
+	options := []ftp.DialOption{
+		ftp.DialWithContext(ctx),
+		ftp.DialWithTimeout(FTPTimeout),
+		ftp.DialWithShutTimeout(FTPTimeout),
+	}
+
+	config := &tls.Config{ServerName: host, RootCAs: ftpRootCAs}
+	switch {
+	case u.Scheme == "ftpes" || (u.Scheme == "ftps" && port == "21"):
+		if port == "" {
+			port = "21"
+		}
+		options = append(options, ftp.DialWithExplicitTLS(config))
+	case u.Scheme == "ftps":
+		if port == "" {
+			port = "990"
+		}
+		options = append(options, ftp.DialWithTLS(config))
+	case port == "":
+		port = "21"
+	}
+
+	conn, err := ftp.Dial(net.JoinHostPort(host, port), options...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", u.Host, err)
+	}
+
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, fmt.Errorf("error logging in to %s: %w", u.Host, err)
+	}
+	return conn, nil
+}
+
+func (p *ftpProtocol) Probe(ctx context.Context, rawURL string) (*ProbeResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.connect(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Quit()
+
+	size, err := conn.FileSize(ftpPath(u))
+	if err != nil {
+		return nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	return &ProbeResult{Size: size, AcceptsRanges: true}, nil
+}
+
+func (p *ftpProtocol) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.connect(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := conn.RetrFrom(ftpPath(u), uint64(start))
+	if err != nil {
+		conn.Quit()
+		return nil, fmt.Errorf("error retrieving %s: %w", ftpPath(u), err)
+	}
+
+	// unblock a pending read when the download is paused or cancelled
+	stop := context.AfterFunc(ctx, func() {
+		res.SetDeadline(time.Now())
+	})
+
+	var reader io.Reader = res
+	if end >= 0 {
+		reader = io.LimitReader(res, end-start+1)
+	}
+
+	return &ftpRangeReader{
+		Reader: reader,
+		conn:   conn,
+		res:    res,
+		stop:   stop,
+	}, nil
+}
+
+// ftpRangeReader stops reading at the end of the range, since RETR always
+// sends the rest of the file, and closes the control connection with it.
+type ftpRangeReader struct {
+	io.Reader
+	conn *ftp.ServerConn
+	res  *ftp.Response
+	stop func() bool
+}
+
+func (r *ftpRangeReader) Close() error {
+	r.stop()
+	// aborting the transfer early makes the server reply with an error
+	// status, which is expected here
+	r.res.Close()
+	return r.conn.Quit()
+}
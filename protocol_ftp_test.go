@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFTPServer serves files from memory over passive FTP. Paths are
+// resolved against the login directory, as servers chrooting users do.
+type testFTPServer struct {
+	t        *testing.T
+	listener net.Listener
+	files    map[string][]byte
+	home     string
+	// tls upgrades connections on AUTH TLS when set
+	tls *tls.Config
+
+	mutex    sync.Mutex
+	commands []string
+}
+
+func newTestFTPServer(t *testing.T, files map[string][]byte) *testFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testFTPServer{t: t, listener: listener, files: files, home: "/home/user"}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+// withTLS accepts AUTH TLS, with a certificate the FTP protocol trusts for
+// the length of the test
+func (s *testFTPServer) withTLS() {
+	https := httptest.NewTLSServer(nil)
+	s.t.Cleanup(https.Close)
+	s.tls = &tls.Config{Certificates: https.TLS.Certificates}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(https.Certificate())
+	roots := ftpRootCAs
+	ftpRootCAs = pool
+	s.t.Cleanup(func() { ftpRootCAs = roots })
+}
+
+func (s *testFTPServer) url(scheme, path string) string {
+	return fmt.Sprintf("%s://user:secret@%s%s", scheme, s.listener.Addr(), path)
+}
+
+// saw reports whether a command starting with prefix was received
+func (s *testFTPServer) saw(prefix string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, cmd := range s.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *testFTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testFTPServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var (
+		data      net.Listener
+		offset    int64
+		protected bool
+	)
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+
+	reply("220 ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg, _ := strings.Cut(line, " ")
+		s.mutex.Lock()
+		s.commands = append(s.commands, line)
+		s.mutex.Unlock()
+
+		switch strings.ToUpper(cmd) {
+		case "AUTH":
+			if s.tls == nil {
+				reply("502 no TLS")
+				continue
+			}
+			reply("234 upgrading")
+			conn = tls.Server(conn, s.tls)
+			r = bufio.NewReader(conn)
+		case "USER":
+			reply("331 password please")
+		case "PASS":
+			if arg != "secret" {
+				reply("530 wrong password")
+				continue
+			}
+			reply("230 logged in")
+		case "TYPE", "PBSZ":
+			reply("200 ok")
+		case "PROT":
+			protected = arg == "P"
+			reply("200 ok")
+		case "EPSV":
+			if data != nil {
+				data.Close()
+			}
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 no data port")
+				continue
+			}
+			reply("229 passive (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "SIZE":
+			file, ok := s.file(arg)
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(file))
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			file, ok := s.file(arg)
+			if !ok || data == nil {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 sending")
+			dataConn, err := data.Accept()
+			if err != nil {
+				return
+			}
+			if protected {
+				dataConn = tls.Server(dataConn, s.tls)
+			}
+			// the client hangs up once it has its range
+			_, err = dataConn.Write(file[offset:])
+			dataConn.Close()
+			offset = 0
+			if err != nil {
+				reply("426 transfer aborted")
+			} else {
+				reply("226 done")
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// file resolves a path the way a server with the user's home as working
+// directory does
+func (s *testFTPServer) file(name string) ([]byte, bool) {
+	if !strings.HasPrefix(name, "/") {
+		name = path.Join(s.home, name)
+	}
+	file, ok := s.files[name]
+	return file, ok
+}
+
+func readRange(t *testing.T, p Protocol, rawURL string, start, end int64) []byte {
+	t.Helper()
+	r, err := p.OpenRange(context.Background(), rawURL, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestFTPPathsAreRelativeToLogin(t *testing.T) {
+	home := randomData(t, 64*1024)
+	pub := randomData(t, 1024)
+	srv := newTestFTPServer(t, map[string][]byte{
+		"/home/user/dir/file.bin": home,
+		"/pub/file.bin":           pub,
+	})
+	p := &ftpProtocol{}
+
+	probe, err := p.Probe(context.Background(), srv.url("ftp", "/dir/file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Size != int64(len(home)) || !probe.AcceptsRanges {
+		t.Fatalf("probed size %d, ranges %v", probe.Size, probe.AcceptsRanges)
+	}
+	if got := readRange(t, p, srv.url("ftp", "/dir/file.bin"), 1000, 1999); !bytes.Equal(got, home[1000:2000]) {
+		t.Fatal("range differs from the file")
+	}
+
+	// an encoded slash starts from the root
+	if got := readRange(t, p, srv.url("ftp", "/%2Fpub/file.bin"), 0, -1); !bytes.Equal(got, pub) {
+		t.Fatal("absolute path read the wrong file")
+	}
+	if _, err := p.Probe(context.Background(), srv.url("ftp", "/file.bin")); err == nil {
+		t.Fatal("probed a file outside the login directory")
+	}
+}
+
+func TestFTPExplicitTLS(t *testing.T) {
+	data := randomData(t, 32*1024)
+	srv := newTestFTPServer(t, map[string][]byte{"/home/user/file.bin": data})
+	srv.withTLS()
+	p := &ftpProtocol{}
+
+	if got := readRange(t, p, srv.url("ftpes", "/file.bin"), 100, 8191); !bytes.Equal(got, data[100:8192]) {
+		t.Fatal("range differs from the file")
+	}
+	if !srv.saw("AUTH TLS") || !srv.saw("PROT P") {
+		t.Fatal("connection wasn't upgraded to TLS")
+	}
+}
+
+func TestFTPDownload(t *testing.T) {
+	data := randomData(t, 1<<20)
+	srv := newTestFTPServer(t, map[string][]byte{"/home/user/file.bin": data})
+	dm := newTestManager(t)
+
+	target := filepath.Join(t.TempDir(), "file.bin")
+	rawURL := srv.url("ftp", "/file.bin")
+	if err := dm.AddDownload(rawURL, target, 4, 4); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dm.getDownload(rawURL, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, StateCompleted, 30*time.Second)
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the served one")
+	}
+}
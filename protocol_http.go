@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type httpProtocol struct {
+	client *http.Client
+}
+
+func init() {
+	registerProtocol(func(client *http.Client) Protocol {
+		return &httpProtocol{client: client}
+	}, "http", "https")
+}
+
+func (p *httpProtocol) Probe(ctx context.Context, rawURL string) (*ProbeResult, error) {
+	res, err := p.probeRequest(ctx, http.MethodHead, rawURL)
+	if err == nil && (res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented) {
+		// some servers only answer GET, ask for a single byte instead
+		res.Body.Close()
+		res, err = p.probeRequest(ctx, http.MethodGet, rawURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	defer res.Body.Close()
+
+	probe := &ProbeResult{
+		Size:          res.ContentLength,
+		FileName:      contentDispositionName(res.Header.Get("Content-Disposition")),
+		AcceptsRanges: res.Header.Get("Accept-Ranges") == "bytes",
+		FinalURL:      res.Request.URL.String(),
+	}
+	if mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil {
+		probe.MimeType = mediaType
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/1234
+		probe.AcceptsRanges = true
+		probe.Size = -1
+		if _, total, ok := strings.Cut(res.Header.Get("Content-Range"), "/"); ok {
+			if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+				probe.Size = size
+			}
+		}
+	default:
+		return nil, fmt.Errorf("download is not available: %v", res.StatusCode)
+	}
+
+	return probe, nil
+}
+
+func (p *httpProtocol) probeRequest(ctx context.Context, method, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	return p.client.Do(req)
+}
+
+func (p *httpProtocol) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if end >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	} else if start > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	req.Close = true
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// a server ignoring the range answers 200 with the whole file, which
+	// only does when that is what was asked for
+	whole := start == 0 && (end < 0 || res.ContentLength == end+1)
+	if res.StatusCode != http.StatusPartialContent && (res.StatusCode != http.StatusOK || !whole) {
+		res.Body.Close()
+		return nil, &StatusError{StatusCode: res.StatusCode}
+	}
+	return res.Body, nil
+}
+
+// StatusError is returned for a response that doesn't carry the requested
+// range, keeping the status for diagnostics
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.StatusCode)
+}
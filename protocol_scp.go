@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpProtocol downloads by running scp in source mode over the SSH
+// connections sftp:// shares, for hosts without an SFTP subsystem. scp
+// only sends a file from its start, so the file is fetched whole and a
+// resumed range skips the bytes before it.
+type scpProtocol struct{}
+
+func init() {
+	registerProtocol(func(*http.Client) Protocol {
+		return &scpProtocol{}
+	}, "scp")
+}
+
+// scpTransfer is a file being sent by a remote scp, read up to its contents
+type scpTransfer struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	size    int64
+}
+
+// startSCP asks the remote scp for path and reads the header announcing it
+func startSCP(conn *sshConnection, path string) (*scpTransfer, error) {
+	session, err := conn.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("error starting ssh session: %w", err)
+	}
+	t := &scpTransfer{session: session}
+	if t.stdin, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	t.stdout = bufio.NewReader(stdout)
+	if err := session.Start("scp -f " + shellQuote(path)); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("error running scp: %w", err)
+	}
+
+	if err := t.readHeader(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// readHeader acknowledges the start of the transfer and parses the
+// "C<mode> <size> <name>" line that follows
+func (t *scpTransfer) readHeader() error {
+	if err := t.ack(); err != nil {
+		return err
+	}
+	line, err := t.stdout.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading scp header: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	switch {
+	case line == "":
+		return errors.New("empty scp header")
+	case line[0] == 1 || line[0] == 2:
+		return fmt.Errorf("scp: %s", line[1:])
+	case line[0] == 'D':
+		return errors.New("scp source is a directory")
+	case line[0] != 'C':
+		return fmt.Errorf("unexpected scp header %q", line)
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed scp header %q", line)
+	}
+	if t.size, err = strconv.ParseInt(fields[1], 10, 64); err != nil || t.size < 0 {
+		return fmt.Errorf("malformed scp size %q", fields[1])
+	}
+	return t.ack()
+}
+
+// ack tells the remote scp to go on
+func (t *scpTransfer) ack() error {
+	_, err := t.stdin.Write([]byte{0})
+	return err
+}
+
+// shellQuote quotes s for the remote shell running scp
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (p *scpProtocol) Probe(ctx context.Context, rawURL string) (*ProbeResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := acquireSSH(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.release()
+
+	t, err := startSCP(conn, sftpPath(u))
+	if err != nil {
+		return nil, err
+	}
+	t.session.Close()
+	return &ProbeResult{Size: t.size}, nil
+}
+
+func (p *scpProtocol) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := acquireSSH(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	t, err := startSCP(conn, sftpPath(u))
+	if err != nil {
+		conn.release()
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		t.session.Close()
+	})
+	r := &scpRangeReader{ctx: ctx, transfer: t, conn: conn, stop: stop}
+
+	if start > t.size {
+		r.Close()
+		return nil, fmt.Errorf("range starts at %d past the end of the %d byte file", start, t.size)
+	}
+	if _, err := io.CopyN(io.Discard, t.stdout, start); err != nil {
+		r.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("error skipping to %d: %w", start, err)
+	}
+	r.remaining = t.size - start
+	if end >= 0 {
+		r.remaining = min(r.remaining, end-start+1)
+	}
+	return r, nil
+}
+
+type scpRangeReader struct {
+	ctx       context.Context
+	transfer  *scpTransfer
+	conn      *sshConnection
+	stop      func() bool
+	remaining int64
+}
+
+func (r *scpRangeReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.transfer.stdout.Read(p)
+	r.remaining -= int64(n)
+	switch {
+	case r.ctx.Err() != nil && err != nil:
+		err = r.ctx.Err()
+	case err == io.EOF && r.remaining > 0:
+		err = io.ErrUnexpectedEOF
+	case err == io.EOF:
+		err = nil
+	}
+	return n, err
+}
+
+// Close ends the transfer, whether or not the whole file was read
+func (r *scpRangeReader) Close() error {
+	r.stop()
+	err := r.transfer.session.Close()
+	r.conn.release()
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHSettings configures authentication for sftp:// and scp:// downloads.
+// Host keys are always checked against KnownHostsFile.
+type SSHSettings struct {
+	KeyFile        string `json:"key_file"`
+	AgentSocket    string `json:"agent_socket"`
+	KnownHostsFile string `json:"known_hosts_file"`
+}
+
+var SSHTimeout = 30 * time.Second
+
+var (
+	sshSettingsMutex sync.RWMutex
+	sshSettings      = defaultSSHSettings()
+)
+
+func defaultSSHSettings() SSHSettings {
+	settings := SSHSettings{
+		AgentSocket: os.Getenv("SSH_AUTH_SOCK"),
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		settings.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return settings
+}
+
+func currentSSHSettings() SSHSettings {
+	sshSettingsMutex.RLock()
+	defer sshSettingsMutex.RUnlock()
+	return sshSettings
+}
+
+func applySSHSettings(settings SSHSettings) {
+	sshSettingsMutex.Lock()
+	defer sshSettingsMutex.Unlock()
+	sshSettings = settings
+}
+
+// LoadSSHSettings applies the stored SSH settings, keeping the defaults for
+// anything that was never configured
+func (dm *DownloadManager) LoadSSHSettings() error {
+	settings := defaultSSHSettings()
+	var err error
+	if settings.KeyFile, err = dm.Setting("ssh_key_file", settings.KeyFile); err != nil {
+		return err
+	}
+	if settings.AgentSocket, err = dm.Setting("ssh_agent_socket", settings.AgentSocket); err != nil {
+		return err
+	}
+	if settings.KnownHostsFile, err = dm.Setting("ssh_known_hosts_file", settings.KnownHostsFile); err != nil {
+		return err
+	}
+	applySSHSettings(settings)
+	return nil
+}
+
+func (dm *DownloadManager) SaveSSHSettings(settings SSHSettings) error {
+	if err := dm.SetSetting("ssh_key_file", settings.KeyFile); err != nil {
+		return err
+	}
+	if err := dm.SetSetting("ssh_agent_socket", settings.AgentSocket); err != nil {
+		return err
+	}
+	if err := dm.SetSetting("ssh_known_hosts_file", settings.KnownHostsFile); err != nil {
+		return err
+	}
+	applySSHSettings(settings)
+	return nil
+}
+
+// sftpProtocol downloads over SFTP. The ranges of a download share one SSH
+// connection, as do other downloads from the same account, and each reads
+// with ReadAt on an SFTP session of its own so chunks transfer in parallel.
+type sftpProtocol struct{}
+
+// SSHIdleTimeout is how long an unused SSH connection is kept for the next
+// range
+var SSHIdleTimeout = 30 * time.Second
+
+// SFTPSessions bounds the SFTP sessions opened on one SSH connection. Each
+// serves one range at a time; ranges beyond it wait for a session to free up.
+var SFTPSessions = 8
+
+func init() {
+	registerProtocol(func(*http.Client) Protocol {
+		return &sftpProtocol{}
+	}, "sftp")
+}
+
+// sshConnection is an SSH connection shared by the ranges read from one
+// account, with the SFTP sessions opened on it
+type sshConnection struct {
+	key string
+	// ready is closed once dialling finished, setting client or err
+	ready  chan struct{}
+	client *ssh.Client
+	err    error
+	refs   int
+	idle   *time.Timer
+	// slots holds a token for each session in use and sessions the idle
+	// ones, together bounding the sessions open to SFTPSessions
+	slots    chan struct{}
+	sessions chan *sftp.Client
+}
+
+var (
+	sshConnsMutex sync.Mutex
+	sshConns      = map[string]*sshConnection{}
+)
+
+// acquireSSH returns the connection for u's account, dialling it when there
+// is none. Each call must be paired with release. The dial belongs to no
+// caller, so one giving up doesn't fail the others waiting for it.
+func acquireSSH(ctx context.Context, u *url.URL) (*sshConnection, error) {
+	key := u.User.String() + "@" + sshAddr(u)
+
+	sshConnsMutex.Lock()
+	c, ok := sshConns[key]
+	if !ok {
+		c = &sshConnection{
+			key:      key,
+			ready:    make(chan struct{}),
+			slots:    make(chan struct{}, SFTPSessions),
+			sessions: make(chan *sftp.Client, SFTPSessions),
+		}
+		sshConns[key] = c
+		go c.dial(u)
+	}
+	c.refs++
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	sshConnsMutex.Unlock()
+
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		c.release()
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		c.release()
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// dial connects c, giving up after SSHTimeout
+func (c *sshConnection) dial(u *url.URL) {
+	ctx, cancel := context.WithTimeout(context.Background(), SSHTimeout)
+	defer cancel()
+	client, err := dialSSH(ctx, u)
+
+	sshConnsMutex.Lock()
+	c.client, c.err = client, err
+	if err != nil && sshConns[c.key] == c {
+		delete(sshConns, c.key)
+	}
+	if err == nil && c.refs == 0 {
+		// everyone waiting gave up while dialling
+		c.closeWhenIdle()
+	}
+	sshConnsMutex.Unlock()
+	close(c.ready)
+
+	if err == nil {
+		// a dropped connection is dialled again by the next range
+		go func() {
+			client.Wait()
+			sshConnsMutex.Lock()
+			if sshConns[c.key] == c {
+				delete(sshConns, c.key)
+			}
+			sshConnsMutex.Unlock()
+		}()
+	}
+}
+
+// release gives up a reference, closing the connection once it went unused
+// for SSHIdleTimeout
+func (c *sshConnection) release() {
+	sshConnsMutex.Lock()
+	defer sshConnsMutex.Unlock()
+
+	c.refs--
+	if c.refs > 0 || c.client == nil {
+		return
+	}
+	c.closeWhenIdle()
+}
+
+// closeWhenIdle closes c after SSHIdleTimeout unless it is acquired again.
+// The caller holds sshConnsMutex.
+func (c *sshConnection) closeWhenIdle() {
+	c.idle = time.AfterFunc(SSHIdleTimeout, func() {
+		sshConnsMutex.Lock()
+		if c.refs > 0 {
+			sshConnsMutex.Unlock()
+			return
+		}
+		if sshConns[c.key] == c {
+			delete(sshConns, c.key)
+		}
+		sshConnsMutex.Unlock()
+		// with no references every session is back in the pool
+		for len(c.sessions) > 0 {
+			(<-c.sessions).Close()
+		}
+		c.client.Close()
+	})
+}
+
+// session takes an idle SFTP session or opens one, waiting while
+// SFTPSessions are in use. The session must be given back with putSession
+// or dropSession.
+func (c *sshConnection) session(ctx context.Context) (*sftp.Client, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case session := <-c.sessions:
+		return session, nil
+	default:
+	}
+	session, err := sftp.NewClient(c.client)
+	if err != nil {
+		<-c.slots
+		return nil, fmt.Errorf("error starting sftp session: %w", err)
+	}
+	return session, nil
+}
+
+// putSession returns a working session to the pool
+func (c *sshConnection) putSession(session *sftp.Client) {
+	c.sessions <- session
+	<-c.slots
+}
+
+// dropSession closes a session that failed, making room for a new one
+func (c *sshConnection) dropSession(session *sftp.Client) {
+	session.Close()
+	<-c.slots
+}
+
+func sshAddr(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "22")
+	}
+	return u.Host
+}
+
+func dialSSH(ctx context.Context, u *url.URL) (*ssh.Client, error) {
+	settings := currentSSHSettings()
+	if settings.KnownHostsFile == "" {
+		return nil, errors.New("no known_hosts file configured")
+	}
+	hostKeyCallback, err := knownhosts.New(settings.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading known_hosts: %w", err)
+	}
+
+	auth, agentConn, err := sshAuthMethods(settings, u)
+	if err != nil {
+		return nil, err
+	}
+	if agentConn != nil {
+		// the agent is only needed during the handshake
+		defer agentConn.Close()
+	}
+
+	username := u.User.Username()
+	if username == "" {
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+	}
+
+	addr := sshAddr(u)
+	dialer := net.Dialer{Timeout: SSHTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", u.Host, err)
+	}
+
+	// the handshake gives up with ctx, or after SSHTimeout
+	deadline := time.Now().Add(SSHTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         SSHTimeout,
+	})
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("error establishing ssh session with %s: %w", u.Host, err)
+	}
+	if !stop() {
+		sshConn.Close()
+		return nil, fmt.Errorf("error establishing ssh session with %s: %w", u.Host, ctx.Err())
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// sshAuthMethods prefers the configured key file, then the agent, and falls
+// back to a password given in the URL. The agent connection, if any, must be
+// closed by the caller once the handshake is done.
+func sshAuthMethods(settings SSHSettings, u *url.URL) ([]ssh.AuthMethod, net.Conn, error) {
+	var methods []ssh.AuthMethod
+
+	if settings.KeyFile != "" {
+		key, err := os.ReadFile(settings.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading ssh key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing ssh key: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	var agentConn net.Conn
+	if settings.AgentSocket != "" {
+		conn, err := net.Dial("unix", settings.AgentSocket)
+		if err == nil {
+			agentConn = conn
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no ssh key, agent or password available")
+	}
+	return methods, agentConn, nil
+}
+
+// sftpPath maps the URL path onto the remote path. A leading /~/ is relative
+// to the login directory.
+func sftpPath(u *url.URL) string {
+	if strings.HasPrefix(u.Path, "/~/") {
+		return strings.TrimPrefix(u.Path, "/~/")
+	}
+	return u.Path
+}
+
+func (p *sftpProtocol) Probe(ctx context.Context, rawURL string) (*ProbeResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := acquireSSH(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.release()
+	session, err := conn.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := session.Stat(sftpPath(u))
+	if err != nil {
+		var status *sftp.StatusError
+		if errors.As(err, &status) {
+			conn.putSession(session)
+		} else {
+			conn.dropSession(session)
+		}
+		return nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	conn.putSession(session)
+	return &ProbeResult{Size: info.Size(), AcceptsRanges: true}, nil
+}
+
+func (p *sftpProtocol) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := acquireSSH(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.session(ctx)
+	if err != nil {
+		conn.release()
+		return nil, err
+	}
+
+	file, err := session.Open(sftpPath(u))
+	if err != nil {
+		var status *sftp.StatusError
+		if errors.As(err, &status) {
+			conn.putSession(session)
+		} else {
+			conn.dropSession(session)
+		}
+		conn.release()
+		return nil, fmt.Errorf("error opening %s: %w", u.Path, err)
+	}
+
+	// a paused or cancelled download only closes its file, failing the
+	// reads still waiting and leaving the session to the next range
+	stop := context.AfterFunc(ctx, func() {
+		file.Close()
+	})
+
+	length := end - start + 1
+	if end < 0 {
+		// io.SectionReader stops at the first error, so EOF still ends the read
+		length = math.MaxInt64 - start
+	}
+
+	return &sftpRangeReader{
+		SectionReader: io.NewSectionReader(file, start, length),
+		ctx:           ctx,
+		file:          file,
+		conn:          conn,
+		session:       session,
+		stop:          stop,
+	}, nil
+}
+
+type sftpRangeReader struct {
+	*io.SectionReader
+	ctx     context.Context
+	file    *sftp.File
+	conn    *sshConnection
+	session *sftp.Client
+	stop    func() bool
+	// failed is set when a read failed for another reason than the range
+	// ending or ctx, leaving the session in doubt
+	failed bool
+}
+
+func (r *sftpRangeReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.SectionReader.Read(p)
+	if err != nil && err != io.EOF && r.ctx.Err() == nil {
+		r.failed = true
+	}
+	return n, err
+}
+
+func (r *sftpRangeReader) Close() error {
+	var err error
+	if r.stop() {
+		err = r.file.Close()
+	}
+	if r.failed {
+		r.conn.dropSession(r.session)
+	} else {
+		r.conn.putSession(r.session)
+	}
+	r.conn.release()
+	return err
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer serves SFTP and scp from the local filesystem to one client
+// key, counting the SSH connections it accepted and the SFTP sessions opened
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	accepted atomic.Int32
+	sessions atomic.Int32
+}
+
+// newTestSSHServer starts a server and points the SSH settings at a key and
+// known_hosts file matching it for the length of the test
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	dir := t.TempDir()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPublic, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s := &testSSHServer{listener: listener, config: config}
+	go s.serve()
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, idle := currentSSHSettings(), SSHIdleTimeout
+	applySSHSettings(SSHSettings{KeyFile: keyFile, KnownHostsFile: knownHosts})
+	SSHIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		applySSHSettings(settings)
+		SSHIdleTimeout = idle
+	})
+	return s
+}
+
+func (s *testSSHServer) url(scheme, path string) string {
+	return scheme + "://tester@" + s.listener.Addr().String() + (&url.URL{Path: path}).EscapedPath()
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.accepted.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *testSSHServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				if req.Type == "exec" {
+					path, ok := strings.CutPrefix(string(req.Payload[4:]), "scp -f ")
+					req.Reply(ok, nil)
+					if ok {
+						go scpSource(channel, path)
+					}
+					continue
+				}
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				s.sessions.Add(1)
+				server, err := sftp.NewServer(channel, sftp.ReadOnly())
+				if err != nil {
+					channel.Close()
+					return
+				}
+				go func() {
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// scpSource sends the file at the quoted path the way scp -f does
+func scpSource(channel ssh.Channel, quoted string) {
+	defer channel.Close()
+	status := func(code uint32) {
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{code}))
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(channel, ack); err != nil {
+		return
+	}
+
+	path := strings.ReplaceAll(strings.Trim(quoted, "'"), `'\''`, "'")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(channel, "\x01scp: %s: No such file or directory\n", path)
+		status(1)
+		return
+	}
+	fmt.Fprintf(channel, "C0644 %d %s\n", len(data), filepath.Base(path))
+	if _, err := io.ReadFull(channel, ack); err != nil {
+		return
+	}
+	// the client hangs up once it has its range
+	if _, err := channel.Write(data); err != nil {
+		return
+	}
+	channel.Write([]byte{0})
+	io.ReadFull(channel, ack)
+	status(0)
+}
+
+func TestSFTPDownloadSharesConnection(t *testing.T) {
+	// the manager loads the stored SSH settings, which the server replaces
+	dm := newTestManager(t)
+	srv := newTestSSHServer(t)
+	data := randomData(t, 2<<20)
+	source := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(source, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := SFTPSessions
+	SFTPSessions = 3
+	t.Cleanup(func() { SFTPSessions = sessions })
+
+	target := filepath.Join(t.TempDir(), "file.bin")
+	rawURL := srv.url("sftp", source)
+	if err := dm.AddDownload(rawURL, target, 8, 4); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dm.getDownload(rawURL, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, StateCompleted, 30*time.Second)
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the served one")
+	}
+	// probing and all eight chunks went over one connection, the four
+	// workers reading in parallel on as many sessions as allowed
+	if n := srv.accepted.Load(); n != 1 {
+		t.Fatalf("%d SSH connections, want 1", n)
+	}
+	if n := srv.sessions.Load(); n < 2 || n > 3 {
+		t.Fatalf("%d SFTP sessions, want 2 or 3", n)
+	}
+}
+
+func TestSSHDialOutlivesCaller(t *testing.T) {
+	srv := newTestSSHServer(t)
+	u, err := url.Parse(srv.url("sftp", "/file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the caller starting the dial gives up at once
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := acquireSSH(ctx, u); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled caller got %v", err)
+	}
+
+	// another one waiting for the same dial still gets the connection
+	conn, err := acquireSSH(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.release()
+	if n := srv.accepted.Load(); n != 1 {
+		t.Fatalf("%d SSH connections, want 1", n)
+	}
+}
+
+func TestSCPDownload(t *testing.T) {
+	dm := newTestManager(t)
+	srv := newTestSSHServer(t)
+	data := randomData(t, 1<<20)
+	source := filepath.Join(t.TempDir(), "it's a file.bin")
+	if err := os.WriteFile(source, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &scpProtocol{}
+
+	probe, err := p.Probe(context.Background(), srv.url("scp", source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Size != int64(len(data)) || probe.AcceptsRanges {
+		t.Fatalf("probed size %d, ranges %v", probe.Size, probe.AcceptsRanges)
+	}
+	// a resumed range skips what came before it
+	if got := readRange(t, p, srv.url("scp", source), 1000, 1999); !bytes.Equal(got, data[1000:2000]) {
+		t.Fatal("range differs from the file")
+	}
+	if _, err := p.Probe(context.Background(), srv.url("scp", source+".missing")); err == nil {
+		t.Fatal("probed a missing file")
+	}
+
+	// without ranges the file comes in one chunk
+	target := filepath.Join(t.TempDir(), "file.bin")
+	rawURL := srv.url("scp", source)
+	if err := dm.AddDownload(rawURL, target, 8, 4); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dm.getDownload(rawURL, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, StateCompleted, 30*time.Second)
+	if n := d.snapshot().ChunkCount; n != 1 {
+		t.Fatalf("%d chunks, want 1", n)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the served one")
+	}
+}
+
+func TestSFTPHandshakeStopsWithContext(t *testing.T) {
+	newTestSSHServer(t)
+
+	// a server that accepts but never speaks SSH
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = (&sftpProtocol{}).Probe(ctx, "sftp://tester@"+listener.Addr().String()+"/file.bin")
+	if err == nil {
+		t.Fatal("probed a server that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("handshake took %v after the context ended", elapsed)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultQueryLimit = 50
+	maxQueryLimit     = 1000
+)
+
+// DownloadFilter selects a page of downloads for QueryDownloads. Zero values
+// don't filter.
+type DownloadFilter struct {
+	// States are DownloadState values
+	States   []int  `json:"states"`
+	Category string `json:"category"`
+	// Search matches part of the URL or path, case insensitively
+	Search string `json:"search"`
+	// CreatedAfter and CreatedBefore bound the creation time, in Unix seconds
+	CreatedAfter  int64 `json:"created_after"`
+	CreatedBefore int64 `json:"created_before"`
+	// SortBy is one of the keys of downloadSortColumns, created_at when empty
+	SortBy   string `json:"sort_by"`
+	SortDesc bool   `json:"sort_desc"`
+	Offset   int    `json:"offset"`
+	Limit    int    `json:"limit"`
+}
+
+// DownloadSummary is a download without its chunks, for lists
+type DownloadSummary struct {
+	ID              int64         `json:"id"`
+	URL             string        `json:"url"`
+	Path            string        `json:"path"`
+	Size            int64         `json:"size"`
+	State           DownloadState `json:"state"`
+	Category        string        `json:"category,omitempty"`
+	Kind            DownloadKind  `json:"kind,omitempty"`
+	Chunks          int           `json:"chunks"`
+	CompletedChunks int           `json:"completed_chunks"`
+	Written         int64         `json:"written"`
+	CreatedAt       int64         `json:"created_at"`
+	StartedAt       int64         `json:"started_at"`
+	CompletedAt     int64         `json:"completed_at"`
+	LastError       string        `json:"last_error,omitempty"`
+	BytesDownloaded int64         `json:"bytes_downloaded"`
+	AverageSpeed    int64         `json:"average_speed"`
+}
+
+// DownloadPage is one page of a query and the number of matches in total
+type DownloadPage struct {
+	Total     int               `json:"total"`
+	Downloads []DownloadSummary `json:"downloads"`
+}
+
+// downloadSortColumns maps sort keys to the columns they order by, which
+// also keeps user input out of the ORDER BY clause
+var downloadSortColumns = map[string]string{
+	"id":            "d.id",
+	"url":           "d.url",
+	"path":          "d.path",
+	"size":          "d.size",
+	"state":         "d.state",
+	"category":      "d.category",
+	"created_at":    "d.created_at",
+	"started_at":    "d.started_at",
+	"completed_at":  "d.completed_at",
+	"average_speed": "d.average_speed",
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// where builds the WHERE clause of the filter and its arguments
+func (f DownloadFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+
+	if len(f.States) > 0 {
+		conds = append(conds, "d.state IN (?"+strings.Repeat(",?", len(f.States)-1)+")")
+		for _, s := range f.States {
+			args = append(args, s)
+		}
+	}
+	if f.Category != "" {
+		conds = append(conds, "d.category = ?")
+		args = append(args, f.Category)
+	}
+	if search := strings.TrimSpace(f.Search); search != "" {
+		pattern := "%" + likeEscaper.Replace(search) + "%"
+		conds = append(conds, `(d.url LIKE ? ESCAPE '\' OR d.path LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	if f.CreatedAfter > 0 {
+		conds = append(conds, "d.created_at >= ?")
+		args = append(args, f.CreatedAfter)
+	}
+	if f.CreatedBefore > 0 {
+		conds = append(conds, "d.created_at < ?")
+		args = append(args, f.CreatedBefore)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// QueryDownloads returns the page of downloads matching filter, sorted and
+// paginated by the database
+func (dm *DownloadManager) QueryDownloads(filter DownloadFilter) (*DownloadPage, error) {
+	sortColumn := "d.created_at"
+	if filter.SortBy != "" {
+		var ok bool
+		if sortColumn, ok = downloadSortColumns[filter.SortBy]; !ok {
+			return nil, fmt.Errorf("unknown sort key %q", filter.SortBy)
+		}
+	}
+	order := "ASC"
+	if filter.SortDesc {
+		order = "DESC"
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	limit = min(limit, maxQueryLimit)
+	offset := max(filter.Offset, 0)
+
+	where, args := filter.where()
+
+	page := &DownloadPage{Downloads: []DownloadSummary{}}
+	if err := dm.DB.QueryRow("SELECT COUNT(*) FROM downloads d"+where, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	// the id breaks ties so pages don't overlap
+	query := `SELECT d.id,d.url,d.path,d.size,d.state,d.category,d.kind,d.chunks,
+		d.created_at,d.started_at,d.completed_at,d.last_error,d.bytes_downloaded,d.average_speed,
+		(SELECT COUNT(*) FROM chunks c WHERE c.download_id = d.id AND c.state = ?),
+		(SELECT COALESCE(SUM(c.written), 0) FROM chunks c WHERE c.download_id = d.id)
+		FROM downloads d` + where +
+		fmt.Sprintf(" ORDER BY %s %s, d.id %s LIMIT ? OFFSET ?", sortColumn, order, order)
+	queryArgs := append([]any{StateCompleted}, args...)
+	queryArgs = append(queryArgs, limit, offset)
+
+	rows, err := dm.DB.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s DownloadSummary
+		if err := rows.Scan(&s.ID, &s.URL, &s.Path, &s.Size, &s.State, &s.Category, &s.Kind, &s.Chunks,
+			&s.CreatedAt, &s.StartedAt, &s.CompletedAt, &s.LastError, &s.BytesDownloaded, &s.AverageSpeed,
+			&s.CompletedChunks, &s.Written); err != nil {
+			return nil, err
+		}
+		page.Downloads = append(page.Downloads, s)
+	}
+	return page, rows.Err()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// ScheduleCheckInterval is how often the schedule and start times are checked
+var ScheduleCheckInterval = 30 * time.Second
+
+// Schedule limits scheduled downloads to time windows. Outside every window
+// they are paused, and they are resumed once one opens.
+type Schedule struct {
+	Enabled bool             `json:"enabled"`
+	Windows []ScheduleWindow `json:"windows"`
+	// QueueNew puts every download added while the schedule is enabled in
+	// the scheduled queue
+	QueueNew bool `json:"queue_new"`
+}
+
+// ScheduleWindow opens at Start and closes at Stop, both "15:04" in local
+// time, on the given days. A Stop before Start closes the window the next
+// day, so 23:00 to 06:00 on Friday runs into Saturday morning.
+type ScheduleWindow struct {
+	// Days are weekdays, 0 for Sunday; no days means every day
+	Days  []int  `json:"days"`
+	Start string `json:"start"`
+	Stop  string `json:"stop"`
+}
+
+// ScheduleEvent tells the frontend a window opened or closed and which
+// downloads were resumed or paused because of it
+type ScheduleEvent struct {
+	Open        bool    `json:"open"`
+	DownloadIDs []int64 `json:"downloadIds"`
+}
+
+// parseClock returns the offset of a "15:04" time from midnight
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w ScheduleWindow) validate() error {
+	for _, day := range w.Days {
+		if day < 0 || day > 6 {
+			return fmt.Errorf("invalid weekday %d", day)
+		}
+	}
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return err
+	}
+	stop, err := parseClock(w.Stop)
+	if err != nil {
+		return err
+	}
+	if start == stop {
+		return fmt.Errorf("window %s to %s is empty", w.Start, w.Stop)
+	}
+	return nil
+}
+
+// openAt reports whether the window is open at t
+func (w ScheduleWindow) openAt(t time.Time) bool {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+	stop, err := parseClock(w.Stop)
+	if err != nil {
+		return false
+	}
+	if stop <= start {
+		stop += 24 * time.Hour
+	}
+
+	// a window that started yesterday may still be open
+	for _, offset := range []int{0, -1} {
+		day := t.AddDate(0, 0, offset)
+		midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, t.Location())
+		if len(w.Days) > 0 && !slices.Contains(w.Days, int(midnight.Weekday())) {
+			continue
+		}
+		// adding clock offsets to midnight keeps DST shifts out of the way
+		opens := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), 0, int(start/time.Minute), 0, 0, t.Location())
+		closes := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), 0, int(stop/time.Minute), 0, 0, t.Location())
+		if !t.Before(opens) && t.Before(closes) {
+			return true
+		}
+	}
+	return false
+}
+
+// openAt reports whether scheduled downloads may run at t
+func (s Schedule) openAt(t time.Time) bool {
+	if !s.Enabled {
+		return true
+	}
+	for _, w := range s.Windows {
+		if w.openAt(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dm *DownloadManager) Schedule() (Schedule, error) {
+	value, err := dm.Setting("schedule", "")
+	if err != nil || value == "" {
+		return Schedule{}, err
+	}
+	var schedule Schedule
+	if err := json.Unmarshal([]byte(value), &schedule); err != nil {
+		return Schedule{}, fmt.Errorf("decoding schedule: %w", err)
+	}
+	return schedule, nil
+}
+
+// SetSchedule stores the schedule and applies it right away
+func (dm *DownloadManager) SetSchedule(schedule Schedule) error {
+	for i, w := range schedule.Windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+	}
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	if err := dm.SetSetting("schedule", string(data)); err != nil {
+		return err
+	}
+	dm.checkSchedule()
+	return nil
+}
+
+// ScheduleDownload puts a download in or out of the scheduled queue and sets
+// the time, in Unix seconds, it starts at; 0 for none. A download waiting for
+// either is queued until then.
+func (dm *DownloadManager) ScheduleDownload(id int64, scheduled bool, startAt int64) error {
+	dm.Mutex.Lock()
+	d, ok := dm.Downloads[id]
+	dm.Mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("download with ID %d not found", id)
+	}
+
+	if _, err := dm.DB.Exec("UPDATE downloads SET scheduled=?,start_at=? WHERE id=?", scheduled, startAt, id); err != nil {
+		return err
+	}
+
+	d.Mutex.Lock()
+	d.Scheduled = scheduled
+	d.StartAt = startAt
+	d.Mutex.Unlock()
+
+	wait, err := dm.shouldWait(d)
+	if err != nil {
+		return err
+	}
+	d.Mutex.Lock()
+	state := d.State
+	d.Mutex.Unlock()
+
+	switch {
+	case wait && state == StateActive:
+		return dm.queueDownload(id)
+	case !wait && (state == StateQueued || state == StatePaused) && startAt > 0:
+		// the start time already passed
+		return dm.startScheduled(d)
+	case !wait && state == StateQueued:
+		// nothing holds it back anymore, and nothing else would start it
+		return dm.ResumeDownload(id)
+	}
+	return nil
+}
+
+// shouldWait reports whether d is held back by its start time or, when
+// scheduled, by the schedule being closed
+func (dm *DownloadManager) shouldWait(d *Download) (bool, error) {
+	d.Mutex.Lock()
+	startAt, scheduled := d.StartAt, d.Scheduled
+	d.Mutex.Unlock()
+
+	if startAt > time.Now().Unix() {
+		return true, nil
+	}
+	if !scheduled {
+		return false, nil
+	}
+	schedule, err := dm.Schedule()
+	if err != nil {
+		return false, err
+	}
+	return !schedule.openAt(time.Now()), nil
+}
+
+// holdIfWaiting leaves a new or restored download queued instead of starting
+// it when it has to wait for its start time or the schedule, reporting
+// whether it does
+func (dm *DownloadManager) holdIfWaiting(d *Download) bool {
+	wait, err := dm.shouldWait(d)
+	if err != nil {
+		d.log().Error("failed to check schedule", "err", err)
+		return false
+	}
+	if !wait {
+		return false
+	}
+
+	if err := dm.Transition(d, StateQueued); err != nil {
+		d.log().Error("failed to queue download", "err", err)
+		return false
+	}
+	return true
+}
+
+// queueDownload stops a running download to wait for the schedule. Unlike a
+// paused one, it is started again when the schedule opens.
+func (dm *DownloadManager) queueDownload(id int64) error {
+	d, err := dm.download(id)
+	if err != nil {
+		return err
+	}
+	return dm.control(d, func() error { return dm.Transition(d, StateQueued) })
+}
+
+// startScheduled resumes a download that waited for its start time or the
+// schedule, clearing a start time that passed. A scheduled download whose
+// window is closed is queued instead, for the window opening to start it.
+func (dm *DownloadManager) startScheduled(d *Download) error {
+	d.Mutex.Lock()
+	startAt := d.StartAt
+	d.Mutex.Unlock()
+
+	if startAt > 0 && startAt <= time.Now().Unix() {
+		if _, err := dm.DB.Exec("UPDATE downloads SET start_at=0 WHERE id=?", d.ID); err != nil {
+			return err
+		}
+		d.Mutex.Lock()
+		d.StartAt = 0
+		d.Mutex.Unlock()
+	}
+
+	wait, err := dm.shouldWait(d)
+	if err != nil {
+		return err
+	}
+	if wait {
+		d.Mutex.Lock()
+		state := d.State
+		d.Mutex.Unlock()
+		if state == StateQueued {
+			return nil
+		}
+		return dm.queueDownload(d.ID)
+	}
+	return dm.ResumeDownload(d.ID)
+}
+
+// runScheduler applies the schedule and start times until ctx is done
+func (dm *DownloadManager) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(ScheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		dm.checkSchedule()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkSchedule starts downloads whose start time came, and resumes or
+// pauses the scheduled queue when a window opened or closed since the last
+// check. The last seen state is stored, so a window that opened or closed
+// while the app wasn't running is acted on at the next start. Checks run one
+// at a time, so each change of the stored state is acted on exactly once.
+func (dm *DownloadManager) checkSchedule() {
+	dm.scheduleMutex.Lock()
+	defer dm.scheduleMutex.Unlock()
+
+	schedule, err := dm.Schedule()
+	if err != nil {
+		logger.Error("failed to read schedule", "err", err)
+		return
+	}
+	now := time.Now()
+	open := schedule.openAt(now)
+
+	var due, scheduled []*Download
+	dm.Mutex.Lock()
+	for _, d := range dm.Downloads {
+		d.Mutex.Lock()
+		if d.StartAt > 0 && d.StartAt <= now.Unix() {
+			due = append(due, d)
+		} else if d.Scheduled && d.StartAt == 0 {
+			scheduled = append(scheduled, d)
+		}
+		d.Mutex.Unlock()
+	}
+	dm.Mutex.Unlock()
+
+	for _, d := range due {
+		d.Mutex.Lock()
+		state := d.State
+		d.Mutex.Unlock()
+		if state != StateQueued && state != StatePaused {
+			continue
+		}
+		d.log().Info("start time reached")
+		if err := dm.startScheduled(d); err != nil {
+			d.log().Error("failed to start scheduled download", "err", err)
+		}
+	}
+
+	last, err := dm.Setting("schedule_open", "")
+	if err != nil {
+		logger.Error("failed to read schedule state", "err", err)
+		return
+	}
+	if last == strconv.FormatBool(open) {
+		return
+	}
+	if err := dm.SetSetting("schedule_open", strconv.FormatBool(open)); err != nil {
+		logger.Error("failed to store schedule state", "err", err)
+		return
+	}
+
+	var changed []int64
+	for _, d := range scheduled {
+		d.Mutex.Lock()
+		state := d.State
+		d.Mutex.Unlock()
+
+		switch {
+		case open && state == StateQueued:
+			err = dm.ResumeDownload(d.ID)
+		case !open && state == StateActive:
+			err = dm.queueDownload(d.ID)
+		default:
+			continue
+		}
+		if err != nil {
+			d.log().Error("failed to apply schedule", "err", err)
+			continue
+		}
+		changed = append(changed, d.ID)
+	}
+
+	if len(changed) > 0 {
+		logger.Info("download schedule changed", "open", open, "downloads", len(changed))
+	}
+	if dm.appCtx != nil {
+		runtime.EventsEmit(dm.appCtx, "scheduleWindow", ScheduleEvent{
+			Open:        open,
+			DownloadIDs: changed,
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowOpenAt(t *testing.T) {
+	// 5 January 2024 was a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	office := ScheduleWindow{Start: "09:00", Stop: "17:00"}
+	fridayNight := ScheduleWindow{Days: []int{5}, Start: "23:00", Stop: "06:00"}
+	weekend := ScheduleWindow{Days: []int{6, 0}, Start: "22:00", Stop: "02:00"}
+	mondays := ScheduleWindow{Days: []int{1}, Start: "00:00", Stop: "23:59"}
+
+	tests := []struct {
+		name   string
+		window ScheduleWindow
+		t      time.Time
+		want   bool
+	}{
+		{"before opening", office, at(5, 8, 59), false},
+		{"at opening", office, at(5, 9, 0), true},
+		{"during", office, at(5, 12, 30), true},
+		{"at closing", office, at(5, 17, 0), false},
+		{"every day without days", office, at(7, 10, 0), true},
+
+		{"before a night window", fridayNight, at(5, 22, 59), false},
+		{"night window opened", fridayNight, at(5, 23, 30), true},
+		{"past midnight into the next day", fridayNight, at(6, 5, 59), true},
+		{"closed the next morning", fridayNight, at(6, 6, 0), false},
+		{"not on the next evening", fridayNight, at(6, 23, 30), false},
+		{"not on another weekday", fridayNight, at(4, 23, 30), false},
+		{"not after another weekday's night", fridayNight, at(5, 1, 0), false},
+
+		{"saturday night", weekend, at(6, 23, 0), true},
+		{"sunday morning after saturday", weekend, at(7, 1, 59), true},
+		{"sunday night", weekend, at(7, 22, 0), true},
+		{"monday morning after sunday", weekend, at(8, 1, 0), true},
+		{"monday night", weekend, at(8, 22, 0), false},
+		{"saturday morning after friday", weekend, at(6, 1, 0), false},
+
+		{"monday all day", mondays, at(8, 0, 0), true},
+		{"sunday before monday", mondays, at(7, 23, 59), false},
+		{"last minute of monday", mondays, at(8, 23, 59), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.openAt(tt.t); got != tt.want {
+				t.Fatalf("open at %s = %v, want %v", tt.t.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleOpenAt(t *testing.T) {
+	now := time.Date(2024, time.January, 5, 12, 0, 0, 0, time.UTC)
+	morning := ScheduleWindow{Start: "06:00", Stop: "10:00"}
+	noon := ScheduleWindow{Start: "11:00", Stop: "13:00"}
+
+	if !(Schedule{Windows: []ScheduleWindow{morning}}).openAt(now) {
+		t.Error("a disabled schedule holds downloads back")
+	}
+	if (Schedule{Enabled: true}).openAt(now) {
+		t.Error("a schedule without windows is open")
+	}
+	if (Schedule{Enabled: true, Windows: []ScheduleWindow{morning}}).openAt(now) {
+		t.Error("open outside its only window")
+	}
+	if !(Schedule{Enabled: true, Windows: []ScheduleWindow{morning, noon}}).openAt(now) {
+		t.Error("closed inside its second window")
+	}
+}
+
+func TestStartTimeWaitsForScheduleWindow(t *testing.T) {
+	dm := newTestManager(t)
+
+	// the only window opens in two hours
+	now := time.Now()
+	window := ScheduleWindow{Start: now.Add(2 * time.Hour).Format("15:04"), Stop: now.Add(3 * time.Hour).Format("15:04")}
+	if err := dm.SetSchedule(Schedule{Enabled: true, Windows: []ScheduleWindow{window}}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Download{
+		URL:        "http://example.com/file.bin",
+		TargetPath: filepath.Join(t.TempDir(), "file.bin"),
+		TotalSize:  1024,
+		State:      StatePaused,
+		Scheduled:  true,
+		StartAt:    now.Add(-time.Minute).Unix(),
+	}
+	d.Chunks = splitChunks(d.TotalSize, 1, 0)
+	d.ChunkCount = 1
+	dm.Mutex.Lock()
+	err := dm.saveDownload(d)
+	dm.Mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dm.checkSchedule()
+
+	s := d.snapshot()
+	if s.State != StateQueued {
+		t.Fatalf("download is %s after its start time with the window closed, want %s", s.State, StateQueued)
+	}
+	if s.StartAt != 0 {
+		t.Fatalf("start time %d was kept", s.StartAt)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Setting returns the stored value for key, or def when it was never set
+func (dm *DownloadManager) Setting(key, def string) (string, error) {
+	var value string
+	err := dm.DB.QueryRow("SELECT value FROM settings WHERE key=?", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return def, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func (dm *DownloadManager) SetSetting(key, value string) error {
+	_, err := dm.DB.Exec("INSERT INTO settings (key,value) VALUES (?,?) ON CONFLICT(key) DO UPDATE SET value=excluded.value", key, value)
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// allStates lists every DownloadState in the order of their values
+var allStates = []DownloadState{
+	StateActive, StatePaused, StateCancelled, StateCompleted,
+	StateQueued, StateProbing, StateVerifying, StateCombining, StateFailed,
+}
+
+// transitions lists the states a download may move to from each state.
+// Completed and cancelled downloads stay that way.
+var transitions = map[DownloadState][]DownloadState{
+	StateQueued:    {StateProbing, StateActive, StatePaused, StateCompleted, StateCancelled},
+	StateProbing:   {StateActive, StatePaused, StateFailed, StateCancelled},
+	StateActive:    {StateProbing, StateQueued, StatePaused, StateCombining, StateCompleted, StateFailed, StateCancelled},
+	StatePaused:    {StateQueued, StateActive, StateCancelled},
+	StateCombining: {StateVerifying, StateCompleted, StateFailed, StateCancelled},
+	StateVerifying: {StateCompleted, StateFailed, StateCancelled},
+	StateFailed:    {StateQueued, StateActive, StateCancelled},
+}
+
+// ErrInvalidTransition matches every TransitionError
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// TransitionError rejects a request that doesn't fit the download's state,
+// such as pausing a completed download
+type TransitionError struct {
+	DownloadID int64
+	From, To   DownloadState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("download %d is %s and can't become %s", e.DownloadID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+func canTransition(from, to DownloadState) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// chunkState returns the state unfinished chunks take when their download
+// moves to state, and false when they keep theirs
+func chunkState(state DownloadState) (DownloadState, bool) {
+	switch state {
+	case StateActive:
+		return StateActive, true
+	case StatePaused, StateQueued, StateFailed:
+		return StatePaused, true
+	case StateCancelled:
+		return StateCancelled, true
+	}
+	return 0, false
+}
+
+// applyState moves d and its unfinished chunks to state in memory. The
+// caller holds d.Mutex.
+func (d *Download) applyState(state DownloadState) {
+	d.State = state
+	d.signalProgress()
+	if cs, ok := chunkState(state); ok {
+		for _, chunk := range d.Chunks {
+			if chunk.State != StateCompleted {
+				chunk.State = cs
+			}
+		}
+	}
+}
+
+// writeState stores state for d, and for its unfinished chunks the state
+// they take along with their progress
+func writeState(tx *sql.Tx, d *Download, state DownloadState) error {
+	if _, err := tx.Exec("UPDATE downloads SET state=? WHERE id=?", state, d.ID); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("%s -> %s", d.State, state)
+	if state == StateFailed && d.LastError != "" {
+		message += ": " + d.LastError
+	}
+	if err := insertEvent(tx, &DownloadEvent{DownloadID: d.ID, Type: EventState, Chunk: -1, Message: message}); err != nil {
+		return err
+	}
+
+	cs, ok := chunkState(state)
+	if !ok {
+		return nil
+	}
+	for _, chunk := range d.Chunks {
+		if chunk.State != StateCompleted {
+			if _, err := tx.Exec("UPDATE chunks SET state=?,written=? WHERE id=?", cs, chunk.Written, chunk.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Transition moves d to state if its current state allows it, persisting the
+// change before it shows in memory and then notifying the frontend. Moving
+// to the current state does nothing. Downloads not saved yet only change in
+// memory.
+func (dm *DownloadManager) Transition(d *Download, to DownloadState) error {
+	d.Mutex.Lock()
+	from := d.State
+	if from == to {
+		d.Mutex.Unlock()
+		return nil
+	}
+	if !canTransition(from, to) {
+		d.Mutex.Unlock()
+		return &TransitionError{DownloadID: d.ID, From: from, To: to}
+	}
+
+	if d.ID != 0 {
+		if err := dm.persistState(d, to); err != nil {
+			d.Mutex.Unlock()
+			return fmt.Errorf("storing state of download %d: %w", d.ID, err)
+		}
+	}
+	d.applyState(to)
+	d.Mutex.Unlock()
+
+	if d.ID != 0 {
+		dm.NotifyDownloadUpdate(d.ID, to)
+	}
+	return nil
+}
+
+func (dm *DownloadManager) persistState(d *Download, state DownloadState) (err error) {
+	tx, err := dm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = writeState(tx, d, state); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// streamPoll is how long a stream read waits before checking the download
+// again when no progress is signalled, as when the finished file is being
+// moved into place
+var streamPoll = 500 * time.Millisecond
+
+// streamServer serves downloads over HTTP on the loopback interface while
+// they download. The token in each URL keeps other local users out.
+type streamServer struct {
+	addr  string
+	token string
+}
+
+// SetSequential turns sequential mode on or off for a download. Sequential
+// downloads hand their chunks to workers in order, starting from the range
+// a stream is waiting for, so the file can be watched while it downloads.
+func (dm *DownloadManager) SetSequential(id int64, sequential bool) error {
+	d, err := dm.download(id)
+	if err != nil {
+		return err
+	}
+	if _, err := dm.DB.Exec("UPDATE downloads SET sequential=? WHERE id=?", sequential, id); err != nil {
+		return err
+	}
+
+	d.Mutex.Lock()
+	d.Sequential = sequential
+	d.signalSeek()
+	d.Mutex.Unlock()
+	return nil
+}
+
+// StreamURL returns the local URL a player can open a download at while it
+// downloads, starting the stream server on first use
+func (dm *DownloadManager) StreamURL(id int64) (string, error) {
+	d, err := dm.download(id)
+	if err != nil {
+		return "", err
+	}
+	if !d.streamable() {
+		return "", fmt.Errorf("download %d can't be streamed", id)
+	}
+
+	dm.Mutex.Lock()
+	defer dm.Mutex.Unlock()
+	if dm.stream == nil {
+		if dm.stream, err = dm.serveStreams(); err != nil {
+			return "", fmt.Errorf("starting stream server: %w", err)
+		}
+	}
+
+	d.Mutex.Lock()
+	name := filepath.Base(d.TargetPath)
+	d.Mutex.Unlock()
+	return fmt.Sprintf("http://%s/stream/%d/%s?token=%s", dm.stream.addr, id, url.PathEscape(name), dm.stream.token), nil
+}
+
+// serveStreams starts the stream server. The caller holds dm.Mutex.
+func (dm *DownloadManager) serveStreams() (*streamServer, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &streamServer{addr: listener.Addr().String(), token: hex.EncodeToString(token)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stream/{id}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		dm.serveStream(s, w, r)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("stream server stopped", "err", err)
+		}
+	}()
+	if dm.appCtx != nil {
+		go func() {
+			<-dm.appCtx.Done()
+			server.Close()
+		}()
+	}
+	logger.Info("stream server listening", "addr", s.addr)
+	return s, nil
+}
+
+func (dm *DownloadManager) serveStream(s *streamServer, w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(s.token)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := dm.download(id)
+	if err != nil || !d.streamable() {
+		http.NotFound(w, r)
+		return
+	}
+
+	reader := &streamReader{ctx: r.Context(), d: d, size: d.TotalSize}
+	defer reader.Close()
+	d.log().Debug("streaming download", "range", r.Header.Get("Range"))
+	http.ServeContent(w, r, r.PathValue("name"), time.Time{}, reader)
+}
+
+// streamable reports whether d's chunks are byte ranges of a file of known
+// size, which a stream can read from as they are written
+func (d *Download) streamable() bool {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	return d.Kind == KindFile && d.TotalSize > 0 && d.State != StateCancelled
+}
+
+// signalProgress wakes the streams waiting for more of d. The caller holds
+// d.Mutex.
+func (d *Download) signalProgress() {
+	if d.progress != nil {
+		close(d.progress)
+		d.progress = nil
+	}
+}
+
+// signalSeek has the running feeder pick its next chunk again, as a stream
+// now waits elsewhere or sequential mode changed. The caller holds d.Mutex.
+func (d *Download) signalSeek() {
+	if d.seek != nil {
+		select {
+		case d.seek <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nextChunk returns the index in pending, which is in chunk order, of the
+// chunk to hand out next: in sequential mode the first one not ending
+// before the offset a stream waits for, otherwise simply the first
+func (d *Download) nextChunk(pending []*ChunkInfo) int {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	if !d.Sequential {
+		return 0
+	}
+	for i, chunk := range pending {
+		if chunk.EndByte >= d.streamAt {
+			return i
+		}
+	}
+	return 0
+}
+
+// streamReader reads a download as far as it is written, blocking reads of
+// bytes not yet downloaded until they are
+type streamReader struct {
+	ctx    context.Context
+	d      *Download
+	size   int64
+	offset int64
+	// target is the finished file, once the download completed
+	target *os.File
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	for {
+		n, err := r.readAvailable(p)
+		if n > 0 || (err != nil && !errors.Is(err, fs.ErrNotExist)) {
+			r.offset += int64(n)
+			return n, err
+		}
+
+		// wait for the bytes to be written, or the part just combined into
+		// the target to appear there
+		d := r.d
+		d.Mutex.Lock()
+		if d.progress == nil {
+			d.progress = make(chan struct{})
+		}
+		progress := d.progress
+		if d.streamAt != r.offset {
+			d.streamAt = r.offset
+			d.signalSeek()
+		}
+		d.Mutex.Unlock()
+
+		select {
+		case <-progress:
+		case <-time.After(streamPoll):
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// readAvailable reads what is already written at the offset, from the
+// finished file or the part holding it. It reads nothing when those bytes
+// are yet to be downloaded.
+func (r *streamReader) readAvailable(p []byte) (int, error) {
+	d := r.d
+	d.Mutex.Lock()
+	state, target := d.State, d.TargetPath
+	var part string
+	var partOffset int64
+	if state != StateCompleted {
+		for _, chunk := range d.Chunks {
+			if r.offset < chunk.StartByte || r.offset > chunk.EndByte {
+				continue
+			}
+			available := chunk.StartByte + chunk.Written - r.offset
+			if available > 0 {
+				part = d.partPath(chunk)
+				partOffset = r.offset - chunk.StartByte
+				if int64(len(p)) > available {
+					p = p[:available]
+				}
+			}
+			break
+		}
+	}
+	d.Mutex.Unlock()
+
+	switch {
+	case state == StateCancelled:
+		return 0, fmt.Errorf("download %d was cancelled", d.ID)
+	case state == StateCompleted:
+		if r.target == nil {
+			file, err := os.Open(target)
+			if err != nil {
+				return 0, err
+			}
+			r.target = file
+		}
+		return readFull(r.target, p, r.offset)
+	case part != "":
+		file, err := os.Open(part)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		return readFull(file, p, partOffset)
+	}
+	return 0, nil
+}
+
+// readFull reads p at offset, treating a short read at the end of the file
+// as success
+func readFull(file *os.File, p []byte, offset int64) (int, error) {
+	n, err := file.ReadAt(p, offset)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *streamReader) Close() error {
+	if r.target != nil {
+		return r.target.Close()
+	}
+	return nil
+}
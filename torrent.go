@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// torrentInfo is the parsed info dictionary of a torrent. Its pieces are
+// addressed as one contiguous byte stream, which the chunk engine downloads
+// like a single file before combineChunks splits it into the torrent's files.
+type torrentInfo struct {
+	Name        string
+	PieceLength int64
+	Pieces      [][sha1.Size]byte
+	Length      int64
+	Files       []torrentFile
+	InfoHash    [sha1.Size]byte
+	Raw         []byte
+}
+
+type torrentFile struct {
+	Path   []string
+	Length int64
+}
+
+// MagnetTimeout bounds how long fetching the metadata of a magnet link takes
+var MagnetTimeout = 2 * time.Minute
+
+// TorrentFetchTimeout bounds how long downloading a .torrent file takes
+var TorrentFetchTimeout = time.Minute
+
+func parseTorrentInfo(raw []byte) (*torrentInfo, error) {
+	v, _, err := bdecode(raw)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("torrent info is not a dictionary")
+	}
+
+	info := &torrentInfo{
+		Name:        bencodeString(dict, "name"),
+		PieceLength: bencodeInt(dict, "piece length"),
+		Length:      bencodeInt(dict, "length"),
+		InfoHash:    sha1.Sum(raw),
+		Raw:         raw,
+	}
+	if info.Name == "" || info.PieceLength <= 0 {
+		return nil, errors.New("torrent info is missing its name or piece length")
+	}
+	if _, err := safeJoin(".", info.Name); err != nil {
+		return nil, err
+	}
+
+	if files, ok := dict["files"].([]any); ok {
+		info.Length = 0
+		for _, f := range files {
+			file, ok := f.(map[string]any)
+			if !ok {
+				return nil, errors.New("invalid file entry in torrent")
+			}
+			entry := torrentFile{Length: bencodeInt(file, "length")}
+			parts, _ := file["path"].([]any)
+			for _, p := range parts {
+				part, _ := p.(string)
+				entry.Path = append(entry.Path, part)
+			}
+			if _, err := safeJoin(".", filepath.Join(entry.Path...)); err != nil || len(entry.Path) == 0 || entry.Length < 0 {
+				return nil, fmt.Errorf("invalid file path %q in torrent", entry.Path)
+			}
+			info.Files = append(info.Files, entry)
+			info.Length += entry.Length
+		}
+	}
+
+	pieces := bencodeString(dict, "pieces")
+	if len(pieces)%sha1.Size != 0 {
+		return nil, errors.New("invalid piece hashes in torrent")
+	}
+	for i := 0; i < len(pieces); i += sha1.Size {
+		var h [sha1.Size]byte
+		copy(h[:], pieces[i:])
+		info.Pieces = append(info.Pieces, h)
+	}
+	if int64(len(info.Pieces)) != (info.Length+info.PieceLength-1)/info.PieceLength {
+		return nil, errors.New("torrent piece count does not match its length")
+	}
+	return info, nil
+}
+
+// parseTorrentFile reads a .torrent file, returning its info and trackers
+func parseTorrentFile(data []byte) (*torrentInfo, []string, error) {
+	dict, raw, err := bdecodeRaw(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid torrent file: %w", err)
+	}
+	if raw["info"] == nil {
+		return nil, nil, errors.New("torrent file has no info dictionary")
+	}
+
+	info, err := parseTorrentInfo(raw["info"])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var trackers []string
+	if tiers, ok := dict["announce-list"].([]any); ok {
+		for _, tier := range tiers {
+			list, _ := tier.([]any)
+			for _, t := range list {
+				if s, ok := t.(string); ok {
+					trackers = append(trackers, s)
+				}
+			}
+		}
+	}
+	if announce := bencodeString(dict, "announce"); announce != "" && len(trackers) == 0 {
+		trackers = append(trackers, announce)
+	}
+	return info, trackers, nil
+}
+
+// parseMagnet extracts the info hash, display name and trackers of a magnet link
+func parseMagnet(uri string) ([sha1.Size]byte, string, []string, error) {
+	var hash [sha1.Size]byte
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "magnet" {
+		return hash, "", nil, fmt.Errorf("invalid magnet link %q", uri)
+	}
+
+	query := u.Query()
+	found := false
+	for _, xt := range query["xt"] {
+		encoded, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+
+		var decoded []byte
+		switch len(encoded) {
+		case 40:
+			decoded, err = hex.DecodeString(encoded)
+		case 32:
+			decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		default:
+			err = errors.New("unexpected length")
+		}
+		if err != nil {
+			return hash, "", nil, fmt.Errorf("invalid info hash %q: %w", encoded, err)
+		}
+		copy(hash[:], decoded)
+		found = true
+		break
+	}
+	if !found {
+		return hash, "", nil, errors.New("magnet link has no BitTorrent info hash")
+	}
+	return hash, query.Get("dn"), query["tr"], nil
+}
+
+func magnetURI(hash [sha1.Size]byte, name string, trackers []string) string {
+	query := url.Values{}
+	query.Set("dn", name)
+	query["tr"] = trackers
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(hash[:]) + "&" + query.Encode()
+}
+
+// loadTorrent resolves a magnet link, a .torrent URL or a local .torrent file
+func loadTorrent(ctx context.Context, source string) (*torrentInfo, []string, error) {
+	if strings.HasPrefix(source, "magnet:") {
+		hash, _, trackers, err := parseMagnet(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(trackers) == 0 {
+			return nil, nil, errors.New("magnet link has no trackers, DHT is not supported")
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, MagnetTimeout)
+		defer cancel()
+		info, err := fetchTorrentMetadata(ctx, hash, trackers)
+		return info, trackers, err
+	}
+
+	var data []byte
+	if u, err := url.Parse(source); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		client, err := newHTTPClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, TorrentFetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error fetching torrent: %w", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("torrent is not available: %v", res.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(res.Body, maxManifestSize)); err != nil {
+			return nil, nil, err
+		}
+	} else if data, err = os.ReadFile(source); err != nil {
+		return nil, nil, err
+	}
+	return parseTorrentFile(data)
+}
+
+// AddTorrent downloads a torrent given as a magnet link, a .torrent URL or a
+// local .torrent file into dir. Pieces are grouped into chunks, so progress,
+// pause, resume and cancel work exactly as for any other download.
+func (dm *DownloadManager) AddTorrent(source, dir string, chunks, workers int) error {
+	info, trackers, err := loadTorrent(context.Background(), source)
+	if err != nil {
+		return err
+	}
+	if len(trackers) == 0 {
+		return errors.New("torrent has no trackers, DHT is not supported")
+	}
+
+	// a relative directory, "." for a magnet added without a path, is
+	// taken from the torrent's category or the default directory
+	if !filepath.IsAbs(dir) {
+		base := defaultDownloadDir()
+		if category, err := dm.categoryFor("", info.Name, ""); err != nil {
+			return err
+		} else if category != nil && category.Dir != "" {
+			base = category.Dir
+		}
+		dir = filepath.Join(base, dir)
+	}
+
+	target, err := safeJoin(dir, info.Name)
+	if err != nil {
+		return err
+	}
+	uri := magnetURI(info.InfoHash, info.Name, trackers)
+
+	if restored, err := dm.restoreExisting(uri, target); restored || err != nil {
+		return err
+	}
+
+	client, err := newHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	d, err := newSizedDownload(client, uri, target, info.Length, chunks, workers, info.PieceLength)
+	if err != nil {
+		return err
+	}
+	d.Kind = KindTorrent
+	d.TorrentInfo = info.Raw
+	d.PieceLength = info.PieceLength
+	d.PieceType = "sha-1"
+	for _, h := range info.Pieces {
+		d.PieceHashes = append(d.PieceHashes, hex.EncodeToString(h[:]))
+	}
+
+	return dm.addNewDownload(d)
+}
+
+// createTarget creates the destination combineChunks writes into. Torrents
+// with several files get a writer that spreads the stream over them.
+func (d *Download) createTarget(path string) (io.WriteCloser, error) {
+	if d.Kind != KindTorrent {
+		return os.Create(path)
+	}
+
+	info, err := parseTorrentInfo(d.TorrentInfo)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Files) == 0 {
+		return os.Create(path)
+	}
+	return &torrentFilesWriter{dir: path, files: info.Files}, nil
+}
+
+type torrentFilesWriter struct {
+	dir       string
+	files     []torrentFile
+	current   *os.File
+	remaining int64
+	// created lists the files made so far
+	created []string
+}
+
+func (w *torrentFilesWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		for w.current == nil || w.remaining == 0 {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.current.Write(p[:min(int64(len(p)), w.remaining)])
+		written += n
+		w.remaining -= int64(n)
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// next closes the current file and creates the following one
+func (w *torrentFilesWriter) next() error {
+	if w.current != nil {
+		if err := w.current.Close(); err != nil {
+			return err
+		}
+		w.current = nil
+	}
+	if len(w.files) == 0 {
+		return errors.New("torrent data is longer than its files")
+	}
+
+	file := w.files[0]
+	w.files = w.files[1:]
+	path := filepath.Join(append([]string{w.dir}, file.Path...)...)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w.current, w.remaining = f, file.Length
+	w.created = append(w.created, path)
+	return nil
+}
+
+// remove closes the current file and deletes every file created, without
+// making the ones still to come
+func (w *torrentFilesWriter) remove() error {
+	if w.current != nil {
+		w.current.Close()
+		w.current = nil
+	}
+	var errs []error
+	for _, path := range w.created {
+		errs = append(errs, os.Remove(path))
+	}
+	return errors.Join(errs...)
+}
+
+// removeTarget closes and deletes a target createTarget made at path
+func removeTarget(target io.WriteCloser, path string) error {
+	if w, ok := target.(*torrentFilesWriter); ok {
+		return w.remove()
+	}
+	target.Close()
+	return os.Remove(path)
+}
+
+func (w *torrentFilesWriter) Close() error {
+	// create any trailing empty files
+	for len(w.files) > 0 {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if w.current != nil {
+		return w.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Bencoded values decode to int64, string, []any and map[string]any.
+type bencodeDecoder struct {
+	data []byte
+	pos  int
+	// raw holds the encoded form of every value of the top level dictionary,
+	// needed to compute a torrent's info hash
+	raw map[string][]byte
+}
+
+// bdecode decodes the first value in data and returns it together with the
+// number of bytes it took up, since ut_metadata messages append raw data
+// after the bencoded dictionary.
+func bdecode(data []byte) (any, int, error) {
+	d := &bencodeDecoder{data: data, raw: map[string][]byte{}}
+	v, err := d.value(0)
+	return v, d.pos, err
+}
+
+// bdecodeRaw decodes a dictionary and returns the raw bytes of its values
+func bdecodeRaw(data []byte) (map[string]any, map[string][]byte, error) {
+	d := &bencodeDecoder{data: data, raw: map[string][]byte{}}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		return nil, nil, errors.New("bencode: expected a dictionary")
+	}
+	return dict, d.raw, nil
+}
+
+var errBencodeEOF = errors.New("bencode: unexpected end of data")
+
+func (d *bencodeDecoder) value(depth int) (any, error) {
+	if d.pos >= len(d.data) {
+		return nil, errBencodeEOF
+	}
+	if depth > 64 {
+		return nil, errors.New("bencode: nesting too deep")
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, errBencodeEOF
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bencode: invalid integer: %w", err)
+		}
+		d.pos += end + 1
+		return n, nil
+
+	case c == 'l':
+		d.pos++
+		list := []any{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errBencodeEOF
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+
+	case c == 'd':
+		d.pos++
+		dict := map[string]any{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errBencodeEOF
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, errors.New("bencode: dictionary key is not a string")
+			}
+			start := d.pos
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if depth == 0 {
+				d.raw[k] = d.data[start:d.pos]
+			}
+			dict[k] = v
+		}
+
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(d.data[d.pos:], ':')
+		if colon < 0 {
+			return nil, errBencodeEOF
+		}
+		n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+		if err != nil || n < 0 {
+			return nil, errors.New("bencode: invalid string length")
+		}
+		start := d.pos + colon + 1
+		// compared this way round so a huge length can't overflow
+		if n > len(d.data)-start {
+			return nil, errBencodeEOF
+		}
+		d.pos = start + n
+		return string(d.data[start:d.pos]), nil
+
+	default:
+		return nil, fmt.Errorf("bencode: unexpected byte %q", c)
+	}
+}
+
+func bencode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencodeTo(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bencodeTo(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := bencodeTo(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, k := range keys {
+			if err := bencodeTo(buf, k); err != nil {
+				return err
+			}
+			if err := bencodeTo(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil
+}
+
+func bencodeInt(dict map[string]any, key string) int64 {
+	n, _ := dict[key].(int64)
+	return n
+}
+
+func bencodeString(dict map[string]any, key string) string {
+	s, _ := dict[key].(string)
+	return s
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestBdecodeRejectsBadLengths(t *testing.T) {
+	huge := strconv.Itoa(int(^uint(0) >> 1))
+	tests := map[string]string{
+		"truncated string":       "10:abc",
+		"truncated in list":      "l4:spam3:eg",
+		"truncated in dict":      "d3:key5:va",
+		"huge length":            huge + ":x",
+		"huge length in dict":    "d3:key" + huge + ":x",
+		"length overflowing int": "99999999999999999999999:x",
+		"negative length":        "-1:x",
+		"missing colon":          "5abc",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if v, _, err := bdecode([]byte(data)); err == nil {
+				t.Fatalf("decoded %q to %v, want an error", data, v)
+			}
+		})
+	}
+}
+
+func TestBdecodeTruncatedIsEOF(t *testing.T) {
+	_, _, err := bdecode([]byte("10:abc"))
+	if !errors.Is(err, errBencodeEOF) {
+		t.Fatalf("got %v, want %v", err, errBencodeEOF)
+	}
+}
+
+func TestBencodeRoundTrip(t *testing.T) {
+	value := map[string]any{
+		"name":   "file.iso",
+		"length": int64(1024),
+		"list":   []any{int64(1), "two"},
+	}
+	data, err := bencode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("d6:lengthi1024e4:listli1e3:twoe4:name8:file.isoe")
+	if !bytes.Equal(data, want) {
+		t.Fatalf("encoded %q, want %q", data, want)
+	}
+
+	decoded, n, err := bdecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Fatalf("consumed %d of %d bytes", n, len(data))
+	}
+	dict := decoded.(map[string]any)
+	if bencodeString(dict, "name") != "file.iso" || bencodeInt(dict, "length") != 1024 {
+		t.Fatalf("decoded %v", dict)
+	}
+}
+
+func TestBencodeUnsupportedType(t *testing.T) {
+	if _, err := bencode(map[string]any{"x": 1.5}); err == nil {
+		t.Fatal("encoded a float, want an error")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// PeerTimeout bounds connecting to a peer and waiting for any single message
+var PeerTimeout = 30 * time.Second
+
+const (
+	msgChoke         = 0
+	msgUnchoke       = 1
+	msgInterested    = 2
+	msgHave          = 4
+	msgBitfield      = 5
+	msgRequest       = 6
+	msgPiece         = 7
+	msgExtended      = 20
+	extHandshake     = 0
+	utMetadataID     = 1 // the id we ask peers to use for ut_metadata messages
+	blockSize        = 16 * 1024
+	maxBacklog       = 8
+	maxMessageLength = 2 * 1024 * 1024
+)
+
+type peerMessage struct {
+	ID      byte
+	Payload []byte
+}
+
+// peerConn is a connection to a single peer speaking the peer wire protocol
+// (BEP 3) with the extension protocol (BEP 10) for fetching metadata
+type peerConn struct {
+	addr     string
+	conn     net.Conn
+	bitfield []byte
+	choked   bool
+
+	// set from the peer's extension handshake
+	utMetadata   int64
+	metadataSize int64
+}
+
+func dialPeer(ctx context.Context, addr string, infoHash, peerID [sha1.Size]byte) (*peerConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, PeerTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &peerConn{addr: addr, conn: conn, choked: true}
+
+	stop := p.watch(ctx)
+	defer stop()
+
+	var handshake bytes.Buffer
+	handshake.WriteByte(19)
+	handshake.WriteString("BitTorrent protocol")
+	reserved := make([]byte, 8)
+	reserved[5] |= 0x10 // extension protocol
+	handshake.Write(reserved)
+	handshake.Write(infoHash[:])
+	handshake.Write(peerID[:])
+	if _, err := conn.Write(handshake.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	res := make([]byte, 68)
+	if _, err := io.ReadFull(conn, res); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res[0] != 19 || string(res[1:20]) != "BitTorrent protocol" || !bytes.Equal(res[28:48], infoHash[:]) {
+		conn.Close()
+		return nil, errors.New("invalid handshake")
+	}
+
+	if res[25]&0x10 != 0 {
+		ext, err := bencode(map[string]any{"m": map[string]any{"ut_metadata": utMetadataID}})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := p.send(msgExtended, append([]byte{extHandshake}, ext...)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// watch closes the connection once ctx is done, interrupting blocked reads
+// and writes. A peer is never reused after the operation it served was
+// cancelled.
+func (p *peerConn) watch(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		p.conn.Close()
+	})
+}
+
+func (p *peerConn) Close() error {
+	return p.conn.Close()
+}
+
+func (p *peerConn) send(id byte, payload []byte) error {
+	msg := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(msg, uint32(1+len(payload)))
+	msg[4] = id
+	copy(msg[5:], payload)
+
+	p.conn.SetWriteDeadline(time.Now().Add(PeerTimeout))
+	_, err := p.conn.Write(msg)
+	return err
+}
+
+// read returns the next message, skipping keep-alives and keeping track of
+// the peer's choke state, pieces and extensions
+func (p *peerConn) read() (*peerMessage, error) {
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(PeerTimeout))
+
+		var length uint32
+		if err := binary.Read(p.conn, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			continue
+		}
+		if length > maxMessageLength {
+			return nil, fmt.Errorf("message of %d bytes is too long", length)
+		}
+
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(p.conn, buf); err != nil {
+			return nil, err
+		}
+		msg := &peerMessage{ID: buf[0], Payload: buf[1:]}
+
+		switch msg.ID {
+		case msgChoke:
+			p.choked = true
+		case msgUnchoke:
+			p.choked = false
+		case msgBitfield:
+			p.bitfield = msg.Payload
+		case msgHave:
+			if len(msg.Payload) == 4 {
+				p.setPiece(int(binary.BigEndian.Uint32(msg.Payload)))
+			}
+		case msgExtended:
+			if len(msg.Payload) > 0 && msg.Payload[0] == extHandshake {
+				if v, _, err := bdecode(msg.Payload[1:]); err == nil {
+					dict, _ := v.(map[string]any)
+					m, _ := dict["m"].(map[string]any)
+					p.utMetadata = bencodeInt(m, "ut_metadata")
+					p.metadataSize = bencodeInt(dict, "metadata_size")
+				}
+			}
+		}
+		return msg, nil
+	}
+}
+
+func (p *peerConn) hasPiece(index int) bool {
+	i := index / 8
+	return i < len(p.bitfield) && p.bitfield[i]>>(7-index%8)&1 != 0
+}
+
+func (p *peerConn) setPiece(index int) {
+	i := index / 8
+	if i >= len(p.bitfield) {
+		p.bitfield = append(p.bitfield, make([]byte, i-len(p.bitfield)+1)...)
+	}
+	p.bitfield[i] |= 1 << (7 - index%8)
+}
+
+// unchoke declares interest and waits until the peer lets us request pieces
+func (p *peerConn) unchoke(ctx context.Context) error {
+	stop := p.watch(ctx)
+	defer stop()
+
+	if err := p.send(msgInterested, nil); err != nil {
+		return err
+	}
+	for p.choked {
+		if _, err := p.read(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadPiece requests a piece block by block, keeping a few requests in
+// flight. The caller verifies the piece's hash.
+func (p *peerConn) downloadPiece(ctx context.Context, index int, length int64) ([]byte, error) {
+	stop := p.watch(ctx)
+	defer stop()
+
+	data := make([]byte, length)
+	blocks := int((length + blockSize - 1) / blockSize)
+	received := make([]bool, blocks)
+	pending := map[int]bool{}
+	done := 0
+
+	for done < blocks {
+		for block := 0; !p.choked && len(pending) < maxBacklog && block < blocks; block++ {
+			if received[block] || pending[block] {
+				continue
+			}
+			begin := int64(block) * blockSize
+			req := make([]byte, 12)
+			binary.BigEndian.PutUint32(req[0:], uint32(index))
+			binary.BigEndian.PutUint32(req[4:], uint32(begin))
+			binary.BigEndian.PutUint32(req[8:], uint32(min(blockSize, length-begin)))
+			if err := p.send(msgRequest, req); err != nil {
+				return nil, err
+			}
+			pending[block] = true
+		}
+
+		msg, err := p.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		switch msg.ID {
+		case msgChoke:
+			// requests are dropped while choked, ask again once unchoked
+			clear(pending)
+		case msgPiece:
+			if len(msg.Payload) < 8 || int(binary.BigEndian.Uint32(msg.Payload)) != index {
+				continue
+			}
+			begin := int64(binary.BigEndian.Uint32(msg.Payload[4:]))
+			block := int(begin / blockSize)
+			if begin%blockSize != 0 || block >= blocks || received[block] {
+				continue
+			}
+			end := min(begin+blockSize, length)
+			if len(msg.Payload[8:]) != int(end-begin) {
+				return nil, errors.New("peer sent a block of the wrong size")
+			}
+			copy(data[begin:end], msg.Payload[8:])
+			received[block] = true
+			delete(pending, block)
+			done++
+		}
+	}
+	return data, nil
+}
+
+// fetchMetadata downloads the info dictionary from a peer using the
+// ut_metadata extension (BEP 9)
+func (p *peerConn) fetchMetadata(ctx context.Context, infoHash [sha1.Size]byte) ([]byte, error) {
+	stop := p.watch(ctx)
+	defer stop()
+
+	for p.utMetadata == 0 {
+		if _, err := p.read(); err != nil {
+			return nil, err
+		}
+	}
+	if p.metadataSize <= 0 || p.metadataSize > maxManifestSize {
+		return nil, fmt.Errorf("peer reported invalid metadata size %d", p.metadataSize)
+	}
+
+	metadata := make([]byte, p.metadataSize)
+	pieces := int((p.metadataSize + blockSize - 1) / blockSize)
+	for piece := range pieces {
+		req, err := bencode(map[string]any{"msg_type": 0, "piece": piece})
+		if err != nil {
+			return nil, err
+		}
+		if err := p.send(msgExtended, append([]byte{byte(p.utMetadata)}, req...)); err != nil {
+			return nil, err
+		}
+
+		for {
+			msg, err := p.read()
+			if err != nil {
+				return nil, err
+			}
+			if msg.ID != msgExtended || len(msg.Payload) == 0 || msg.Payload[0] != utMetadataID {
+				continue
+			}
+
+			v, n, err := bdecode(msg.Payload[1:])
+			if err != nil {
+				return nil, err
+			}
+			dict, _ := v.(map[string]any)
+			if bencodeInt(dict, "piece") != int64(piece) {
+				continue
+			}
+			if bencodeInt(dict, "msg_type") != 1 {
+				return nil, errors.New("peer rejected metadata request")
+			}
+
+			begin := int64(piece) * blockSize
+			end := min(begin+blockSize, p.metadataSize)
+			if len(msg.Payload[1+n:]) != int(end-begin) {
+				return nil, errors.New("peer sent a metadata piece of the wrong size")
+			}
+			copy(metadata[begin:end], msg.Payload[1+n:])
+			break
+		}
+	}
+
+	if sha1.Sum(metadata) != infoHash {
+		return nil, errors.New("metadata does not match the info hash")
+	}
+	return metadata, nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPeers caps the connections a swarm keeps open
+	maxPeers = 40
+	// maxPieceAttempts is how many peers a piece is requested from before
+	// its chunk fails and is retried by the worker
+	maxPieceAttempts   = 5
+	reannounceInterval = 30 * time.Second
+)
+
+// swarm shares the peers of one torrent between the chunks of its download.
+// Every chunk worker borrows a peer for each piece it fetches, so peers are
+// used by one piece request at a time.
+type swarm struct {
+	info     *torrentInfo
+	trackers []string
+	peerID   [sha1.Size]byte
+
+	mutex        sync.Mutex
+	refs         int
+	idle         []*peerConn
+	conns        int
+	candidates   []string
+	known        map[string]bool
+	lastAnnounce time.Time
+}
+
+var (
+	swarmsMutex sync.Mutex
+	swarms      = map[[sha1.Size]byte]*swarm{}
+)
+
+func newPeerID() [sha1.Size]byte {
+	var id [sha1.Size]byte
+	copy(id[:], "-DC0001-")
+	rand.Read(id[8:])
+	return id
+}
+
+// acquireSwarm returns the swarm of a torrent, creating it on first use.
+// Each call must be paired with release.
+func acquireSwarm(info *torrentInfo, trackers []string) *swarm {
+	swarmsMutex.Lock()
+	defer swarmsMutex.Unlock()
+
+	s, ok := swarms[info.InfoHash]
+	if !ok {
+		s = &swarm{
+			info:     info,
+			trackers: trackers,
+			peerID:   newPeerID(),
+			known:    map[string]bool{},
+		}
+		swarms[info.InfoHash] = s
+	}
+	s.refs++
+	return s
+}
+
+// release disconnects from every peer once the last download using the
+// swarm stopped
+func (s *swarm) release() {
+	swarmsMutex.Lock()
+	defer swarmsMutex.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	delete(swarms, s.info.InfoHash)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, p := range s.idle {
+		p.Close()
+	}
+	s.idle = nil
+}
+
+func activeSwarm(infoHash [sha1.Size]byte) *swarm {
+	swarmsMutex.Lock()
+	defer swarmsMutex.Unlock()
+	return swarms[infoHash]
+}
+
+func (s *swarm) pieceLength(index int) int64 {
+	start := int64(index) * s.info.PieceLength
+	return min(s.info.PieceLength, s.info.Length-start)
+}
+
+// fetchPiece downloads and verifies a piece, moving on to another peer when
+// one fails or sends corrupt data
+func (s *swarm) fetchPiece(ctx context.Context, index int) ([]byte, error) {
+	var lastErr error
+	for range maxPieceAttempts {
+		p, err := s.peerFor(ctx, index)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := p.downloadPiece(ctx, index, s.pieceLength(index))
+		if err == nil && sha1.Sum(data) == s.info.Pieces[index] {
+			s.putPeer(p)
+			return data, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("piece %d from %s failed verification", index, p.addr)
+		}
+		s.dropPeer(p)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// peerFor borrows a connected, unchoked peer that has the piece, connecting
+// to new peers and asking the trackers for more when none is available
+func (s *swarm) peerFor(ctx context.Context, index int) (*peerConn, error) {
+	for {
+		s.mutex.Lock()
+		for i, p := range s.idle {
+			if p.hasPiece(index) {
+				s.idle = append(s.idle[:i], s.idle[i+1:]...)
+				s.mutex.Unlock()
+				return p, nil
+			}
+		}
+
+		var addr string
+		if len(s.candidates) > 0 && s.conns < maxPeers {
+			addr = s.candidates[0]
+			s.candidates = s.candidates[1:]
+			s.conns++
+		}
+		announce := addr == "" && time.Since(s.lastAnnounce) >= reannounceInterval
+		if announce {
+			s.lastAnnounce = time.Now()
+		}
+		s.mutex.Unlock()
+
+		switch {
+		case addr != "":
+			p, err := s.connect(ctx, addr)
+			if err != nil {
+				s.mutex.Lock()
+				s.conns--
+				s.mutex.Unlock()
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+			if p.hasPiece(index) {
+				return p, nil
+			}
+			s.putPeer(p)
+
+		case announce:
+			if err := s.announce(ctx); err != nil {
+				logger.Warn("torrent announce failed", "info_hash", hex.EncodeToString(s.info.InfoHash[:]), "err", err)
+			}
+
+		default:
+			// wait for a busy peer to become free or the next announce
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func (s *swarm) connect(ctx context.Context, addr string) (*peerConn, error) {
+	p, err := dialPeer(ctx, addr, s.info.InfoHash, s.peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, PeerTimeout)
+	defer cancel()
+	if err := p.unchoke(ctx); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *swarm) announce(ctx context.Context) error {
+	peers, err := announceAll(ctx, s.trackers, s.info.InfoHash, s.peerID, s.info.Length)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, addr := range peers {
+		if !s.known[addr] {
+			s.known[addr] = true
+			s.candidates = append(s.candidates, addr)
+		}
+	}
+	return nil
+}
+
+// putPeer returns a borrowed peer to the pool
+func (s *swarm) putPeer(p *peerConn) {
+	swarmsMutex.Lock()
+	active := s.refs > 0
+	swarmsMutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !active {
+		p.Close()
+		s.conns--
+		return
+	}
+	s.idle = append(s.idle, p)
+}
+
+// dropPeer disconnects a failed peer, it may be tried again after the next
+// announce
+func (s *swarm) dropPeer(p *peerConn) {
+	p.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conns--
+	delete(s.known, p.addr)
+}
+
+// pieceReader streams a byte range of a torrent piece by piece
+type pieceReader struct {
+	ctx   context.Context
+	swarm *swarm
+	pos   int64
+	end   int64
+	buf   []byte
+}
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.pos > r.end {
+			return 0, io.EOF
+		}
+		index := int(r.pos / r.swarm.info.PieceLength)
+		data, err := r.swarm.fetchPiece(r.ctx, index)
+		if err != nil {
+			return 0, err
+		}
+		pieceStart := int64(index) * r.swarm.info.PieceLength
+		r.buf = data[r.pos-pieceStart : min(int64(len(data)), r.end-pieceStart+1)]
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *pieceReader) Close() error {
+	return nil
+}
+
+// torrentProtocol serves magnet: URLs of torrent downloads. Ranges are read
+// from the swarm the download joined when it started.
+type torrentProtocol struct{}
+
+func init() {
+	registerProtocol(func(*http.Client) Protocol { return torrentProtocol{} }, "magnet")
+}
+
+func (torrentProtocol) Probe(ctx context.Context, rawURL string) (*ProbeResult, error) {
+	info, _, err := loadTorrent(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &ProbeResult{Size: info.Length, FileName: info.Name, AcceptsRanges: true}, nil
+}
+
+func (torrentProtocol) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	hash, _, _, err := parseMagnet(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := activeSwarm(hash)
+	if s == nil {
+		return nil, errors.New("torrent is not active")
+	}
+	if end < 0 {
+		end = s.info.Length - 1
+	}
+	return &pieceReader{ctx: ctx, swarm: s, pos: start, end: end}, nil
+}
+
+// joinSwarm connects a torrent download to its swarm for the duration of Start
+func (d *Download) joinSwarm() (func(), error) {
+	info, err := parseTorrentInfo(d.TorrentInfo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent metadata: %w", err)
+	}
+	_, _, trackers, err := parseMagnet(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	s := acquireSwarm(info, trackers)
+	return s.release, nil
+}
+
+// fetchTorrentMetadata resolves a magnet link by downloading the info
+// dictionary from the first peer that has it
+func fetchTorrentMetadata(ctx context.Context, infoHash [sha1.Size]byte, trackers []string) (*torrentInfo, error) {
+	peerID := newPeerID()
+	peers, err := announceAll(ctx, trackers, infoHash, peerID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan *torrentInfo)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, addr := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+
+			p, err := dialPeer(ctx, addr, infoHash, peerID)
+			if err != nil {
+				return
+			}
+			defer p.Close()
+
+			raw, err := p.fetchMetadata(ctx, infoHash)
+			if err != nil {
+				return
+			}
+			info, err := parseTorrentInfo(raw)
+			if err != nil {
+				return
+			}
+			select {
+			case results <- info:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if info, ok := <-results; ok {
+		return info, nil
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("timed out fetching torrent metadata: %w", ctx.Err())
+	}
+	return nil, errors.New("no peer provided the torrent metadata")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCombineFailsWhenTrailingTorrentFileFails(t *testing.T) {
+	raw, err := bencode(map[string]any{
+		"name":         "set",
+		"piece length": int64(16),
+		"pieces":       strings.Repeat("\x00", 20),
+		"files": []any{
+			map[string]any{"path": []any{"data.txt"}, "length": int64(5)},
+			map[string]any{"path": []any{"blocked", "empty.txt"}, "length": int64(0)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "set")
+	d := &Download{Kind: KindTorrent, TorrentInfo: raw, TargetPath: dir, TotalSize: 5, Chunks: splitChunks(5, 1, 0)}
+	if err := os.WriteFile(d.partPath(d.Chunks[0]), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the empty file's directory can't be created
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blocked"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.combineChunks(context.Background(), dir); err == nil {
+		t.Fatal("combined without creating every file")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "data.txt")); string(got) != "hello" {
+		t.Fatalf("data.txt holds %q", got)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TrackerTimeout bounds a single announce to a tracker
+var TrackerTimeout = 15 * time.Second
+
+// port reported to trackers; d4c only leeches and doesn't accept connections
+const announcePort = 6881
+
+// announceAll asks every tracker for peers concurrently and merges the results
+func announceAll(ctx context.Context, trackers []string, infoHash, peerID [sha1.Size]byte, left int64) ([]string, error) {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		seen  = map[string]bool{}
+		peers []string
+		errs  []error
+	)
+
+	for _, tracker := range trackers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, TrackerTimeout)
+			defer cancel()
+
+			found, err := announce(ctx, tracker, infoHash, peerID, left)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", tracker, err))
+				return
+			}
+			for _, p := range found {
+				if !seen[p] {
+					seen[p] = true
+					peers = append(peers, p)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers found: %w", errors.Join(errs...))
+	}
+	return peers, nil
+}
+
+func announce(ctx context.Context, tracker string, infoHash, peerID [sha1.Size]byte, left int64) ([]string, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, u, infoHash, peerID, left)
+	case "udp":
+		return announceUDP(ctx, u, infoHash, peerID, left)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+func announceHTTP(ctx context.Context, u *url.URL, infoHash, peerID [sha1.Size]byte, left int64) ([]string, error) {
+	query := u.Query()
+	query.Set("info_hash", string(infoHash[:]))
+	query.Set("peer_id", string(peerID[:]))
+	query.Set("port", strconv.Itoa(announcePort))
+	query.Set("uploaded", "0")
+	query.Set("downloaded", "0")
+	query.Set("left", strconv.FormatInt(left, 10))
+	query.Set("compact", "1")
+	query.Set("event", "started")
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	v, _, err := bdecode(body)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid tracker response")
+	}
+	if reason := bencodeString(dict, "failure reason"); reason != "" {
+		return nil, errors.New(reason)
+	}
+
+	var peers []string
+	switch p := dict["peers"].(type) {
+	case string:
+		peers = compactPeers([]byte(p), net.IPv4len)
+	case []any:
+		for _, entry := range p {
+			peer, _ := entry.(map[string]any)
+			ip := bencodeString(peer, "ip")
+			port := bencodeInt(peer, "port")
+			if ip != "" && port > 0 {
+				peers = append(peers, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+			}
+		}
+	}
+	if p6, ok := dict["peers6"].(string); ok {
+		peers = append(peers, compactPeers([]byte(p6), net.IPv6len)...)
+	}
+	return peers, nil
+}
+
+// compactPeers decodes peers packed as address followed by a 2 byte port
+func compactPeers(data []byte, ipLen int) []string {
+	var peers []string
+	for i := 0; i+ipLen+2 <= len(data); i += ipLen + 2 {
+		ip := net.IP(data[i : i+ipLen])
+		port := binary.BigEndian.Uint16(data[i+ipLen:])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peers
+}
+
+// announceUDP implements the UDP tracker protocol (BEP 15)
+func announceUDP(ctx context.Context, u *url.URL, infoHash, peerID [sha1.Size]byte, left int64) ([]string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// connect
+	var txID [4]byte
+	rand.Read(txID[:])
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:], 0x41727101980)
+	binary.BigEndian.PutUint32(req[8:], 0)
+	copy(req[12:], txID[:])
+
+	res, err := udpRoundTrip(conn, req, txID, 0, 16)
+	if err != nil {
+		return nil, err
+	}
+	connectionID := binary.BigEndian.Uint64(res[8:])
+
+	// announce
+	rand.Read(txID[:])
+	req = make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:], connectionID)
+	binary.BigEndian.PutUint32(req[8:], 1)
+	copy(req[12:], txID[:])
+	copy(req[16:], infoHash[:])
+	copy(req[36:], peerID[:])
+	binary.BigEndian.PutUint64(req[64:], uint64(left))
+	binary.BigEndian.PutUint32(req[80:], 2) // event: started
+	binary.BigEndian.PutUint32(req[92:], 0xFFFFFFFF)
+	binary.BigEndian.PutUint16(req[96:], announcePort)
+
+	res, err = udpRoundTrip(conn, req, txID, 1, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	ipLen := net.IPv4len
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && net.ParseIP(host).To4() == nil {
+		ipLen = net.IPv6len
+	}
+	return compactPeers(res[20:], ipLen), nil
+}
+
+func udpRoundTrip(conn net.Conn, req []byte, txID [4]byte, action uint32, minLen int) ([]byte, error) {
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		res := buf[:n]
+		if n < 8 || [4]byte(res[4:8]) != txID {
+			continue
+		}
+		if got := binary.BigEndian.Uint32(res); got == 3 {
+			return nil, fmt.Errorf("tracker error: %s", res[8:])
+		} else if got != action || n < minLen {
+			return nil, errors.New("invalid tracker response")
+		}
+		return res, nil
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ImportConcurrency is how many imported URLs are probed at once
+var ImportConcurrency = 4
+
+// ImportResult reports what became of one download in an imported list
+type ImportResult struct {
+	Line  int    `json:"line"`
+	URL   string `json:"url"`
+	Path  string `json:"path"`
+	Added bool   `json:"added"`
+	Error string `json:"error,omitempty"`
+}
+
+// importEntry is one download read from a URL list
+type importEntry struct {
+	line         int
+	urls         []string
+	path         string
+	checksumType string
+	checksum     string
+	chunks       int
+	workers      int
+	// state is read from exported history, to skip finished downloads
+	state string
+	err   error
+}
+
+// ImportURLs adds a download for every entry of a URL list, given as its
+// text or as the path of a file holding it. Plain lists with one URL per
+// line, aria2 input files and CSV files with a url column and optional path
+// and checksum columns are understood. Entries are probed and added in
+// parallel, and the result of each is reported in the order of the list.
+func (dm *DownloadManager) ImportURLs(source, dir string, chunks, workers int) ([]ImportResult, error) {
+	text := source
+	if info, err := os.Stat(source); err == nil && info.Mode().IsRegular() {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	var entries []*importEntry
+	var err error
+	if isCSVList(text) {
+		entries, err = parseCSVList(text)
+	} else {
+		entries, err = parseAria2List(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no URLs found")
+	}
+
+	// a line repeating an earlier one would race it to add the same
+	// download, so only the first is added
+	seen := map[[2]string]int{}
+	for _, entry := range entries {
+		if entry.err != nil {
+			continue
+		}
+		key := [2]string{entry.urls[0], importPath(entry, dir)}
+		if line, ok := seen[key]; ok {
+			entry.err = fmt.Errorf("duplicate of line %d", line)
+			continue
+		}
+		seen[key] = entry.line
+	}
+
+	results := make([]ImportResult, len(entries))
+	sem := make(chan struct{}, max(ImportConcurrency, 1))
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		result := &results[i]
+		result.Line = entry.line
+		if len(entry.urls) > 0 {
+			result.URL = entry.urls[0]
+		}
+		if entry.err != nil {
+			result.Error = entry.err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			path, err := dm.importEntry(entry, dir, chunks, workers)
+			result.Path = path
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.Added = true
+		}()
+	}
+	wg.Wait()
+
+	added := 0
+	for _, r := range results {
+		if r.Added {
+			added++
+		}
+	}
+	logger.Info("imported URLs", "added", added, "entries", len(results))
+	return results, nil
+}
+
+// importEntry adds the download of one entry, returning the path it is saved
+// to
+func (dm *DownloadManager) importEntry(entry *importEntry, dir string, chunks, workers int) (string, error) {
+	if entry.chunks > 0 {
+		chunks = entry.chunks
+	}
+	if entry.workers > 0 {
+		workers = entry.workers
+	}
+
+	path := importPath(entry, dir)
+	rawURL := entry.urls[0]
+	if strings.HasPrefix(rawURL, "magnet:") {
+		return path, dm.AddTorrent(rawURL, filepath.Dir(path), chunks, workers)
+	}
+	if restored, err := dm.restoreExisting(rawURL, path); restored || err != nil {
+		return path, err
+	}
+
+	d, err := dm.newCategorizedDownload(rawURL, path, chunks, workers)
+	if err != nil {
+		return path, err
+	}
+	if restored, err := dm.restoreCategorized(rawURL, path, d); restored || err != nil {
+		return d.TargetPath, err
+	}
+	if len(entry.urls) > 1 {
+		d.Mirrors = entry.urls
+	}
+	d.ChecksumType = entry.checksumType
+	d.Checksum = entry.checksum
+
+	err = dm.addNewDownload(d)
+	return d.TargetPath, err
+}
+
+// importPath returns the path an entry is saved to, relative paths being
+// taken from dir. Without a file name the server names the file inside the
+// directory.
+func importPath(entry *importEntry, dir string) string {
+	path := entry.path
+	switch {
+	case path == "" && dir != "":
+		path = dir + string(filepath.Separator)
+	case path != "" && !filepath.IsAbs(path) && dir != "":
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
+
+// parseAria2List reads plain URL lists and aria2 input files. In the latter
+// the URLs of one file are separated by tabs and followed by option lines
+// starting with whitespace; dir, out, checksum, split and
+// max-connection-per-server are used, the rest ignored.
+func parseAria2List(text string) ([]*importEntry, error) {
+	var entries []*importEntry
+	var current *importEntry
+	var optDir, optOut string
+
+	finish := func() {
+		if current == nil {
+			return
+		}
+		if optOut != "" {
+			current.path = filepath.Join(optDir, optOut)
+		} else if optDir != "" {
+			current.path = optDir + string(filepath.Separator)
+		}
+		entries = append(entries, current)
+		current, optDir, optOut = nil, "", ""
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		raw := scanner.Text()
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if raw[0] == ' ' || raw[0] == '\t' {
+			if current == nil || current.err != nil {
+				continue
+			}
+			key, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				current.err = fmt.Errorf("invalid option %q", trimmed)
+				continue
+			}
+			switch key {
+			case "dir":
+				optDir = value
+			case "out":
+				optOut = value
+			case "checksum":
+				current.checksumType, current.checksum, current.err = parseChecksum(value)
+			case "split":
+				current.chunks, current.err = parseCount(key, value)
+			case "max-connection-per-server":
+				current.workers, current.err = parseCount(key, value)
+			}
+			continue
+		}
+
+		finish()
+		current = &importEntry{line: line}
+		for _, u := range strings.Split(trimmed, "\t") {
+			if u = strings.TrimSpace(u); u != "" {
+				current.urls = append(current.urls, u)
+			}
+		}
+		current.err = checkURLs(current.urls)
+	}
+	finish()
+	return entries, scanner.Err()
+}
+
+// isCSVList reports whether the first line of text is a CSV header with a
+// url column
+func isCSVList(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		header, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil || len(header) < 2 {
+			return false
+		}
+		return slices.ContainsFunc(header, func(h string) bool {
+			return strings.EqualFold(strings.TrimSpace(h), "url")
+		})
+	}
+	return false
+}
+
+// parseCSVList reads a CSV file with a header naming its columns: url, and
+// optionally path, checksum, checksum_type and state
+func parseCSVList(text string) ([]*importEntry, error) {
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []*importEntry
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				entries = append(entries, &importEntry{line: parseErr.StartLine, err: err})
+				continue
+			}
+			return nil, err
+		}
+
+		line, _ := r.FieldPos(0)
+		entry := &importEntry{line: line, path: field(record, "path"), state: field(record, "state")}
+		if u := field(record, "url"); u != "" {
+			entry.urls = []string{u}
+		}
+		entry.err = checkURLs(entry.urls)
+
+		if checksum := field(record, "checksum"); checksum != "" && entry.err == nil {
+			if algo := field(record, "checksum_type"); algo != "" {
+				checksum = algo + "=" + checksum
+			}
+			entry.checksumType, entry.checksum, entry.err = parseChecksum(checksum)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func checkURLs(urls []string) error {
+	if len(urls) == 0 {
+		return errors.New("missing URL")
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme == "" {
+			return fmt.Errorf("invalid URL %q", u)
+		}
+	}
+	return nil
+}
+
+// parseChecksum reads "sha-256=hex", "sha256:hex" or a bare hex digest,
+// whose type is guessed from its length
+func parseChecksum(value string) (string, string, error) {
+	algo, digest, ok := strings.Cut(value, "=")
+	if !ok {
+		algo, digest, ok = strings.Cut(value, ":")
+	}
+	if !ok {
+		digest = value
+		switch len(value) {
+		case 32:
+			algo = "md5"
+		case 40:
+			algo = "sha-1"
+		case 64:
+			algo = "sha-256"
+		case 128:
+			algo = "sha-512"
+		default:
+			return "", "", fmt.Errorf("can't tell the type of checksum %q", value)
+		}
+	}
+	if _, err := newHash(algo); err != nil {
+		return "", "", err
+	}
+	return algo, strings.ToLower(strings.TrimSpace(digest)), nil
+}
+
+func parseCount(name, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wantEntry is an importEntry as expected by the list parsing tests, err
+// being part of the error message or empty for none
+type wantEntry struct {
+	line         int
+	urls         []string
+	path         string
+	checksumType string
+	checksum     string
+	chunks       int
+	workers      int
+	state        string
+	err          string
+}
+
+func checkEntries(t *testing.T, got []*importEntry, want []wantEntry) {
+	t.Helper()
+	if len(got) != len(want) {
+		for _, e := range got {
+			t.Logf("%+v", *e)
+		}
+		t.Fatalf("%d entries, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		w := want[i]
+		if e.line != w.line || !slices.Equal(e.urls, w.urls) || e.path != w.path || e.checksumType != w.checksumType ||
+			e.checksum != w.checksum || e.chunks != w.chunks || e.workers != w.workers || e.state != w.state {
+			t.Errorf("entry %d is %+v, want %+v", i, *e, w)
+		}
+		switch {
+		case w.err == "" && e.err != nil:
+			t.Errorf("entry %d: %v", i, e.err)
+		case w.err != "" && (e.err == nil || !strings.Contains(e.err.Error(), w.err)):
+			t.Errorf("entry %d error %v, want %q", i, e.err, w.err)
+		}
+	}
+}
+
+func TestParseAria2List(t *testing.T) {
+	sha256 := strings.Repeat("AB", 32)
+	tests := []struct {
+		name, text string
+		want       []wantEntry
+	}{
+		{"plain list with comments", "# downloads\nhttp://a.example.com/1.iso\n\n   \nftp://b.example.com/2.iso  \n# done\n", []wantEntry{
+			{line: 2, urls: []string{"http://a.example.com/1.iso"}},
+			{line: 5, urls: []string{"ftp://b.example.com/2.iso"}},
+		}},
+		{"mirrors and options", strings.Join([]string{
+			"http://a.example.com/f.iso\thttp://b.example.com/f.iso",
+			"  dir=" + filepath.Join("data", "iso"),
+			"  out=f.iso",
+			"  checksum=sha-256=" + sha256,
+			"\tsplit=4",
+			"  max-connection-per-server=2",
+			"  continue=true",
+			"  # options may be commented out",
+			"http://c.example.com/g.iso",
+			"  dir=other",
+			"http://d.example.com/h.iso",
+			"  out=h.iso",
+			"  checksum=md5:0123456789ABCDEF0123456789ABCDEF",
+		}, "\n"), []wantEntry{
+			{
+				line: 1, urls: []string{"http://a.example.com/f.iso", "http://b.example.com/f.iso"},
+				path:         filepath.Join("data", "iso", "f.iso"),
+				checksumType: "sha-256", checksum: strings.ToLower(sha256), chunks: 4, workers: 2,
+			},
+			{line: 9, urls: []string{"http://c.example.com/g.iso"}, path: "other" + string(filepath.Separator)},
+			{line: 11, urls: []string{"http://d.example.com/h.iso"}, path: "h.iso", checksumType: "md5", checksum: "0123456789abcdef0123456789abcdef"},
+		}},
+		{"malformed entries", strings.Join([]string{
+			"  dir=orphaned",
+			"not a url",
+			"  out=ignored.iso",
+			"http://a.example.com/f.iso",
+			"  split=zero",
+			"  out=ignored.iso",
+			"http://b.example.com/f.iso",
+			"  novalue",
+			"http://c.example.com/f.iso",
+			"  checksum=crc32=00000000",
+			"http://d.example.com/f.iso",
+			"  checksum=abc",
+			"http://e.example.com/f.iso",
+			"  max-connection-per-server=-1",
+		}, "\n"), []wantEntry{
+			{line: 2, urls: []string{"not a url"}, err: `invalid URL "not a url"`},
+			{line: 4, urls: []string{"http://a.example.com/f.iso"}, err: `invalid split "zero"`},
+			{line: 7, urls: []string{"http://b.example.com/f.iso"}, err: `invalid option "novalue"`},
+			{line: 9, urls: []string{"http://c.example.com/f.iso"}, err: "unsupported hash type"},
+			{line: 11, urls: []string{"http://d.example.com/f.iso"}, err: "can't tell the type"},
+			{line: 13, urls: []string{"http://e.example.com/f.iso"}, err: `invalid max-connection-per-server "-1"`},
+		}},
+		{"nothing but comments", "# one\n\n# two\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseAria2List(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEntries(t, entries, tt.want)
+		})
+	}
+}
+
+func TestIsCSVList(t *testing.T) {
+	tests := []struct {
+		name, text string
+		want       bool
+	}{
+		{"header", "url,path\nhttp://example.com/a,a", true},
+		{"header after comments", "# export\n\n URL , Path \n", true},
+		{"quoted header", `"path","url"`, true},
+		{"single column", "url\nhttp://example.com/a", false},
+		{"no url column", "link,path\nhttp://example.com/a,a", false},
+		{"URL list", "http://example.com/a\nhttp://example.com/b", false},
+		{"URL with a comma", "http://example.com/a,b", false},
+		{"broken header", `"url,path`, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCSVList(tt.text); got != tt.want {
+				t.Fatalf("isCSVList(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCSVList(t *testing.T) {
+	sha1 := strings.Repeat("C", 40)
+	text := strings.Join([]string{
+		"URL, Path, Checksum, Checksum_Type, State",
+		"http://example.com/1.iso, one.iso, " + sha1 + ",,paused",
+		"# skipped",
+		"http://example.com/2.iso,,DEADBEEF,md5,",
+		"http://example.com/3.iso",
+		",missing.iso",
+		`http://example.com/"4.iso,four.iso`,
+		`"http://example.com/5,6.iso","five, six.iso"`,
+		"relative/7.iso,seven.iso",
+		"http://example.com/8.iso,,1234567",
+		"http://example.com/9.iso,,00,whirlpool",
+	}, "\n")
+
+	entries, err := parseCSVList(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, entries, []wantEntry{
+		{line: 2, urls: []string{"http://example.com/1.iso"}, path: "one.iso", checksumType: "sha-1", checksum: strings.ToLower(sha1), state: "paused"},
+		{line: 4, urls: []string{"http://example.com/2.iso"}, checksumType: "md5", checksum: "deadbeef"},
+		{line: 5, urls: []string{"http://example.com/3.iso"}},
+		{line: 6, path: "missing.iso", err: "missing URL"},
+		{line: 7, err: "bare \""},
+		{line: 8, urls: []string{"http://example.com/5,6.iso"}, path: "five, six.iso"},
+		{line: 9, urls: []string{"relative/7.iso"}, path: "seven.iso", err: "invalid URL"},
+		{line: 10, urls: []string{"http://example.com/8.iso"}, err: "can't tell the type"},
+		{line: 11, urls: []string{"http://example.com/9.iso"}, err: "unsupported hash type"},
+	})
+
+	if _, err := parseCSVList(""); err == nil {
+		t.Fatal("read a CSV list without a header")
+	}
+	if entries, err := parseCSVList("url,path\n"); err != nil || len(entries) != 0 {
+		t.Fatalf("header only read as %d entries, %v", len(entries), err)
+	}
+}
+
+func TestImportPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "imports")
+	abs := filepath.Join(t.TempDir(), "file.iso")
+	sep := string(filepath.Separator)
+
+	tests := []struct {
+		name, path, dir, want string
+	}{
+		{"server named", "", dir, dir + sep},
+		{"relative", "file.iso", dir, filepath.Join(dir, "file.iso")},
+		{"relative directory", "isos" + sep, dir, filepath.Join(dir, "isos")},
+		{"absolute", abs, dir, abs},
+		{"no directory", "file.iso", "", "file.iso"},
+		{"nothing", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := importPath(&importEntry{path: tt.path}, tt.dir); got != tt.want {
+				t.Fatalf("importPath(%q, %q) = %q, want %q", tt.path, tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportURLsReportsEveryLine(t *testing.T) {
+	data := randomData(t, 32*1024)
+	srv := newThrottledServer(t, data, 1<<20, 1<<20)
+	dm := newTestManager(t)
+	dir := t.TempDir()
+
+	list := fmt.Sprintf("# nightly\n%[1]s/a.bin\n  out=a.bin\n  split=2\nnot-a-url\n%[1]s/b.bin\n  out=b.bin\n%[1]s/a.bin\n  out=a.bin\n", srv.URL)
+	results, err := dm.ImportURLs(list, dir, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ImportResult{
+		{Line: 2, URL: srv.URL + "/a.bin", Path: filepath.Join(dir, "a.bin"), Added: true},
+		{Line: 5, URL: "not-a-url", Error: `invalid URL "not-a-url"`},
+		{Line: 6, URL: srv.URL + "/b.bin", Path: filepath.Join(dir, "b.bin"), Added: true},
+		{Line: 8, URL: srv.URL + "/a.bin", Error: "duplicate of line 2"},
+	}
+	if !slices.Equal(results, want) {
+		t.Fatalf("results\n%+v\nwant\n%+v", results, want)
+	}
+
+	d, err := dm.getDownload(srv.URL+"/a.bin", filepath.Join(dir, "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ChunkCount != 2 {
+		t.Errorf("a.bin split into %d chunks, want 2", d.ChunkCount)
+	}
+	if d, err = dm.download(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, StateCompleted, 10*time.Second)
+
+	if _, err := dm.ImportURLs("# only a comment\n", dir, 4, 2); err == nil {
+		t.Fatal("imported a list without URLs")
+	}
+}